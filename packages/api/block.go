@@ -27,6 +27,7 @@ import (
 
 	"github.com/GenesisKernel/go-genesis/packages/consts"
 	"github.com/GenesisKernel/go-genesis/packages/converter"
+	"github.com/GenesisKernel/go-genesis/packages/daemons"
 	"github.com/GenesisKernel/go-genesis/packages/model"
 
 	log "github.com/sirupsen/logrus"
@@ -75,3 +76,22 @@ func getBlockInfo(w http.ResponseWriter, r *http.Request, data *apiData, logger
 	data.result = &GetBlockInfoResult{Hash: block.Hash, EcosystemID: block.EcosystemID, KeyID: block.KeyID, Time: block.Time, Tx: block.Tx, RollbacksHash: block.RollbacksHash}
 	return nil
 }
+
+type GetSyncStatusResult struct {
+	BlockID     int64 `json:"block_id"`
+	MaxBlockID  int64 `json:"max_block_id"`
+	Lag         int64 `json:"lag"`
+	LastCycle   int64 `json:"last_cycle"`
+	InitialLoad bool  `json:"initial_load"`
+}
+
+func getSyncStatus(w http.ResponseWriter, r *http.Request, data *apiData, logger *log.Entry) (err error) {
+	status := daemons.GetSyncStatus()
+	result := &GetSyncStatusResult{BlockID: status.BlockID, MaxBlockID: status.MaxBlockID, Lag: status.Lag,
+		InitialLoad: status.InitialLoad}
+	if !status.LastCycle.IsZero() {
+		result.LastCycle = status.LastCycle.Unix()
+	}
+	data.result = result
+	return nil
+}
@@ -73,6 +73,7 @@ func Route(route *hr.Router) {
 	get(`history/:table/:id`, ``, authWallet, getHistory)
 	get(`block/:id`, ``, getBlockInfo)
 	get(`maxblockid`, ``, getMaxBlockID)
+	get(`syncstatus`, ``, getSyncStatus)
 
 	post(`content/page/:name`, ``, authWallet, getPage)
 	post(`content/menu/:name`, ``, authWallet, getMenu)
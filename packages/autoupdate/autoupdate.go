@@ -232,7 +232,10 @@ func Run() error {
 	return nil
 }
 
-// TryUpdate tries to update for the current block number
+// TryUpdate tries to update for the current block number, it does nothing if InitUpdater hasn't been called
 func TryUpdate(currentBlockNumber uint64) error {
+	if updater == nil {
+		return nil
+	}
 	return updater.tryUpdate(currentBlockNumber)
 }
@@ -82,11 +82,36 @@ type SavedConfig struct {
 	KeyID       int64
 	EcosystemID int64
 
-	BadBlocks              string
-	FirstLoadBlockchainURL string
-	FirstLoadBlockchain    string
+	BadBlocks                 string
+	FirstLoadBlockchainURL    string            // comma separated list of the mirrors of the blockchain file
+	FirstLoadBlockchain       string            // 'file' to load the blockchain from FirstLoadBlockchainURL
+	FirstLoadBlockchainSHA256 string            // hex checksum of the blockchain file, empty means no check
+	FirstLoadTipHash          string            // hex hash of the last block of the blockchain file, it's checked before the load, empty means no check
+	FirstLoadWorkers          int               // count of workers which parse the blocks of the blockchain file, 0 means GOMAXPROCS
+	FirstLoadUserAgent        string            // User-Agent of the download of the blockchain file, empty means the default one
+	FirstLoadHeaders          map[string]string // additional headers of the download, e.g. the token of a private mirror
+	KeepSnapshotFile          bool              // keep the loaded blockchain file as blockchain-<last block id> in WorkDir
+	Checkpoints               map[string]string // block id -> trusted hex hash of the block, they override the checkpoints system parameter
 
 	MaxPageGenerationTime int64 // in milliseconds
+	HostBlockIDCacheTTL   int64 // in milliseconds
+	DownloadRateLimit     int64 // in bytes per second, 0 means unlimited
+	BlockGapWarning       int64 // count of missing blocks to warn about, 0 means the default value
+	MaxBlocksPerCycle     int64 // count of blocks played by one call of UpdateChain, 0 means the default value, negative means unlimited
+	BlockTimeout          int64 // in milliseconds, max time of the check and the play of one block, 0 means unlimited
+	BlockTimeDrift        int64 // in seconds, how far the time of the block can be ahead of the local time
+	MinBlockSize          int64 // in bytes, the smaller blocks of the hosts are rejected, 0 means the default value
+	MaxForkDepth          int64 // count of blocks which can be replaced in the case of fork, 0 means the rb_blocks_1 system parameter
+	TCPDialTimeout        int64 // in milliseconds, 0 means the default value
+	TCPReadWriteTimeout   int64 // in milliseconds, 0 means the default value
+	TCPRequestTimeout     int64 // in milliseconds, max time of all reads and writes of one connection, 0 means the default value
+	ConnBackoffMin        int64 // in milliseconds, first delay of the reconnection to the failed host, 0 means the default value, negative disables the backoff
+	ConnBackoffMax        int64 // in milliseconds, max delay of the reconnection to the failed host, 0 means the default value
+	SyncStartJitter       int64 // in milliseconds, max random delay of the first cycle of the blocks collection, 0 means no delay
+	SyncJitter            int64 // in milliseconds, max random delay added to the pause between the cycles of the blocks collection
+
+	SyncPeers          string // comma separated list of hosts to collect blocks from or empty for the full nodes
+	SyncPeersIntersect bool   // use only the hosts of SyncPeers which are in the full nodes list
 
 	TCPServer HostPort
 	HTTP      HostPort
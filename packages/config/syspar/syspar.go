@@ -65,6 +65,8 @@ const (
 	CommissionWallet = `commission_wallet`
 	// RbBlocks1 rollback from queue_bocks
 	RbBlocks1 = `rb_blocks_1`
+	// Checkpoints is the list of the trusted hashes of the blocks like [["block id", "hex hash"],...]
+	Checkpoints = `checkpoints`
 )
 
 // FullNode is storing full node data
@@ -81,6 +83,7 @@ var (
 	nodesByPosition = make([][]string, 0)
 	fuels           = make(map[int64]string)
 	wallets         = make(map[int64]string)
+	checkpoints     = make(map[int64]string)
 	mutex           = &sync.RWMutex{}
 )
 
@@ -140,6 +143,10 @@ func SysUpdate(dbTransaction *model.DbTransaction) error {
 	}
 	fuels, err = getParams(FuelRate)
 	wallets, err = getParams(CommissionWallet)
+	if err != nil {
+		return err
+	}
+	checkpoints, err = getParams(Checkpoints)
 
 	return err
 }
@@ -291,6 +298,25 @@ func GetCommissionWallet(ecosystem int64) string {
 	return wallets[1]
 }
 
+// GetCheckpoint is returning the trusted hex hash of the block
+func GetCheckpoint(blockID int64) (string, bool) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	ret, ok := checkpoints[blockID]
+	return ret, ok
+}
+
+// GetCheckpoints is returning the copy of the trusted hex hashes of the blocks by their ids
+func GetCheckpoints() map[int64]string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	ret := make(map[int64]string, len(checkpoints))
+	for blockID, hash := range checkpoints {
+		ret[blockID] = hash
+	}
+	return ret
+}
+
 // GetMaxBlockSize is returns max block size
 func GetMaxBlockSize() int64 {
 	return converter.StrToInt64(SysString(MaxBlockSize))
@@ -25,6 +25,9 @@ package consts
 // VERSION is current version
 const VERSION = "0.1.6b11"
 
+// DownloadUserAgent is the default User-Agent of the download of the blockchain file
+const DownloadUserAgent = "go-genesis/" + VERSION
+
 // BLOCK_VERSION is block version
 const BLOCK_VERSION = 1
 
@@ -46,6 +49,16 @@ const MIN_CONFIRMED_NODES = 0
 // DOWNLOAD_CHAIN_TRY_COUNT is number of attempt
 const DOWNLOAD_CHAIN_TRY_COUNT = 10
 
+// BLOCKCHAIN_SIZE is the min size of the downloaded blockchain file
+const BLOCKCHAIN_SIZE = 10240
+
+// BLOCKCHAIN_FILENAME is the name of the file where the downloaded blockchain is stored
+const BLOCKCHAIN_FILENAME = "blockchain"
+
+// DOWNLOAD_CHAIN_TIMEOUT is the time in seconds without the received data after which the attempt
+// to download the blockchain is stopped
+const DOWNLOAD_CHAIN_TIMEOUT = 30
+
 // MAX_TX_FORW How fast could the time of transaction pass
 const MAX_TX_FORW = 0
 
@@ -64,12 +77,62 @@ const READ_TIMEOUT = 20
 // WRITE_TIMEOUT is timeout for TCP
 const WRITE_TIMEOUT = 20
 
+// DIAL_TIMEOUT is timeout for dialing TCP
+const DIAL_TIMEOUT = 10
+
+// REQUEST_TIMEOUT is the max time in seconds of all reads and writes of one TCP connection
+const REQUEST_TIMEOUT = 60
+
+// HostBlockIDCacheTTL is the default time in milliseconds while the max block id of the host is cached
+const HostBlockIDCacheTTL = 1500
+
+// BanNodeTime is the time in seconds while the node which has sent a bad block is banned
+const BanNodeTime = 600
+
+// TransientBanNodeTime is the time in seconds while the node which has a network fault is banned
+const TransientBanNodeTime = 30
+
+// ConnBackoffMin is the default delay in milliseconds of the reconnection to the host after the first
+// connection failure, the delay is doubled by each next failure
+const ConnBackoffMin = 500
+
+// ConnBackoffMax is the default max delay in milliseconds of the reconnection to the failed host
+const ConnBackoffMax = 60000
+
+// MaxBannedNodes is the max count of the stored banned nodes
+const MaxBannedNodes = 1000
+
+// BannedNodesRefreshTime is the time in seconds between the reloading of the banned nodes from the database
+const BannedNodesRefreshTime = 30
+
+// MinBlockSize is the default min size of the block received from the host, it is the size of the smallest block header
+const MinBlockSize = 16
+
+// MaxBlocksPerCycle is the default count of blocks played by one call of UpdateChain
+const MaxBlocksPerCycle = 10000
+
+// MaxForkDepth is the hard limit of the count of blocks received from the host in the case of fork,
+// the deeper forks are refused whatever the rollback depth is configured
+const MaxForkDepth = 1000
+
+// MaxBlockFailovers is the max count of the hosts which can replace the failed host while the chain is updating
+const MaxBlockFailovers = 3
+
+// BlockGapWarning is the default count of missing blocks which means that the node is badly behind
+const BlockGapWarning = 10000
+
 // DATA_TYPE_MAX_BLOCK_ID is block id max datatype
 const DATA_TYPE_MAX_BLOCK_ID = 10
 
 // DATA_TYPE_BLOCK_BODY is body block datatype
 const DATA_TYPE_BLOCK_BODY = 7
 
+// DATA_TYPE_HANDSHAKE is the exchange of the versions of the peer protocol before the request on the same connection
+const DATA_TYPE_HANDSHAKE = 11
+
+// PROTOCOL_VERSION is the version of the peer protocol
+const PROTOCOL_VERSION = 1
+
 // UPD_AND_VER_URL is root url
 const UPD_AND_VER_URL = "http://apla.io"
 
@@ -104,6 +167,9 @@ const PidFilename = "apla.pid"
 // FirstBlockFilename name of first block binary file
 const FirstBlockFilename = "1block"
 
+// FirstLoadMarkerFilename is the name of the file which exists while the blockchain is loaded from the file
+const FirstLoadMarkerFilename = "first_load"
+
 // PrivateKeyFilename name of wallet private key file
 const PrivateKeyFilename = "PrivateKey"
 
@@ -130,3 +196,12 @@ const TLSFullchainPem = "/fullchain.pem"
 
 // TLSPrivkeyPem privkey pem file
 const TLSPrivkeyPem = "/privkey.pem"
+
+// MaxTxParams is the default max count of the data fields of the contract
+const MaxTxParams = 256
+
+// DownloadProgressInterval is the min time in seconds between the reports of the download progress
+const DownloadProgressInterval = 5
+
+// CatchUpProgressInterval is the min time in seconds between the reports of the progress of UpdateChain
+const CatchUpProgressInterval = 10
@@ -97,6 +97,9 @@ func signECDSA(privateKey string, data string) (ret []byte, err error) {
 	priv := new(ecdsa.PrivateKey)
 	priv.PublicKey.Curve = pubkeyCurve
 	priv.D = bi
+	// ecdsa.Sign of the recent versions of Go uses the public key of the private key
+	// and panics if it is nil, so the public key is derived from D
+	priv.PublicKey.X, priv.PublicKey.Y = pubkeyCurve.ScalarBaseMult(b)
 
 	signhash, err := Hash([]byte(data))
 	if err != nil {
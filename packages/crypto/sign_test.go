@@ -0,0 +1,49 @@
+// MIT License
+//
+// Copyright (c) 2016-2018 GenesisKernel
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestSignCheckSign(t *testing.T) {
+	private, public, err := GenHexKeys()
+	if err != nil {
+		t.Fatalf("can't gen keys: %s", err)
+	}
+	sign, err := Sign(private, "data for sign")
+	if err != nil {
+		t.Fatalf("can't sign: %s", err)
+	}
+	pub, err := hex.DecodeString(public)
+	if err != nil {
+		t.Fatalf("can't decode public key: %s", err)
+	}
+	if ok, err := CheckSign(pub, "data for sign", sign); !ok || err != nil {
+		t.Errorf("valid sign is rejected %v", err)
+	}
+	if ok, _ := CheckSign(pub, "other data", sign); ok {
+		t.Errorf("sign of other data is accepted")
+	}
+}
@@ -0,0 +1,164 @@
+// MIT License
+//
+// Copyright (c) 2016-2018 GenesisKernel
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemons
+
+import (
+	"sync"
+	"time"
+
+	"github.com/GenesisKernel/go-genesis/packages/consts"
+	"github.com/GenesisKernel/go-genesis/packages/model"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// bannedNodes is the in-memory view of the banned_nodes table. It is loaded by the first cycle of
+// BlocksCollection and is reloaded every BannedNodesRefreshTime seconds, so the checks of the hosts
+// don't touch the database
+type bannedNodes struct {
+	mutex     sync.Mutex
+	hosts     map[string]time.Time // expire time of the ban
+	refreshed time.Time
+}
+
+var nodesBan = &bannedNodes{hosts: make(map[string]time.Time)}
+
+// refresh reloads the banned nodes from the database if the in-memory view is outdated
+func (bn *bannedNodes) refresh(now time.Time) {
+	bn.mutex.Lock()
+	outdated := now.Sub(bn.refreshed) >= consts.BannedNodesRefreshTime*time.Second
+	bn.mutex.Unlock()
+	if !outdated {
+		return
+	}
+	nodes, err := model.GetBannedNodes(now.Unix())
+	if err != nil {
+		log.WithFields(log.Fields{"type": consts.DBError, "error": err}).Error("getting banned nodes")
+		return
+	}
+	hosts := make(map[string]time.Time, len(nodes))
+	for _, node := range nodes {
+		hosts[node.Host] = time.Unix(node.ExpireTime, 0)
+	}
+
+	bn.mutex.Lock()
+	defer bn.mutex.Unlock()
+	bn.hosts = hosts
+	bn.refreshed = now
+}
+
+func (bn *bannedNodes) isBanned(host string) bool {
+	bn.mutex.Lock()
+	defer bn.mutex.Unlock()
+
+	expire, ok := bn.hosts[host]
+	return ok && time.Now().Before(expire)
+}
+
+func (bn *bannedNodes) ban(host string, expire time.Time) {
+	bn.mutex.Lock()
+	defer bn.mutex.Unlock()
+
+	bn.hosts[host] = expire
+}
+
+func (bn *bannedNodes) unban(host string) {
+	bn.mutex.Lock()
+	defer bn.mutex.Unlock()
+
+	delete(bn.hosts, host)
+}
+
+// banCategory is the kind of the fault of the host, it defines the time of the ban
+type banCategory int
+
+const (
+	// banTransient is a network fault like a timeout, the host can be fine soon
+	banTransient banCategory = iota
+	// banVerification is a block which has failed the verification, the host can be malicious
+	banVerification
+	// banIncompatible is another version of the peer protocol, the host can't be used until it is updated
+	banIncompatible
+)
+
+func (c banCategory) String() string {
+	switch c {
+	case banTransient:
+		return "transient"
+	case banIncompatible:
+		return "incompatible"
+	}
+	return "verification"
+}
+
+// banTime returns the time of the ban of the host for the category of the fault
+func (c banCategory) banTime() time.Duration {
+	if c == banTransient {
+		return consts.TransientBanNodeTime * time.Second
+	}
+	return consts.BanNodeTime * time.Second
+}
+
+// banNode bans the host for TransientBanNodeTime seconds for the transient faults
+// and for BanNodeTime seconds if the host has sent a bad block. The ban is logged with the fields of logger
+func banNode(logger *log.Entry, host string, category banCategory, err error) {
+	now := time.Now()
+	expire := now.Add(category.banTime())
+	nodesBan.ban(host, expire)
+	logger.WithFields(log.Fields{"type": consts.BlockError, "host": host, "error": err, "category": category.String(),
+		"expire": expire}).Warning("node is banned")
+
+	node := &model.BannedNode{Host: host, BanTime: now.Unix(), ExpireTime: expire.Unix()}
+	if err != nil {
+		node.Reason = err.Error()
+	}
+	if err := node.Save(); err != nil {
+		log.WithFields(log.Fields{"type": consts.DBError, "error": err, "host": host}).Error("saving banned node")
+		return
+	}
+	if err := model.DeleteOldestBannedNodes(now.Unix(), consts.MaxBannedNodes); err != nil {
+		log.WithFields(log.Fields{"type": consts.DBError, "error": err}).Error("deleting oldest banned nodes")
+	}
+}
+
+// unbanNode removes the ban of the host
+func unbanNode(host string) {
+	nodesBan.unban(host)
+
+	node := &model.BannedNode{Host: host}
+	if err := node.Delete(); err != nil {
+		log.WithFields(log.Fields{"type": consts.DBError, "error": err, "host": host}).Error("deleting banned node")
+	}
+}
+
+// filterBannedHosts returns the hosts which are not banned
+func filterBannedHosts(hosts []string) []string {
+	ret := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if nodesBan.isBanned(host) {
+			continue
+		}
+		ret = append(ret, host)
+	}
+	return ret
+}
@@ -23,10 +23,24 @@
 package daemons
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -36,9 +50,16 @@ import (
 
 	"io/ioutil"
 
+	"github.com/GenesisKernel/go-genesis/packages/conf"
+	"github.com/GenesisKernel/go-genesis/packages/config/syspar"
 	"github.com/GenesisKernel/go-genesis/packages/consts"
 	"github.com/GenesisKernel/go-genesis/packages/converter"
+	"github.com/GenesisKernel/go-genesis/packages/crypto"
 	"github.com/GenesisKernel/go-genesis/packages/model"
+	"github.com/GenesisKernel/go-genesis/packages/parser"
+	"github.com/GenesisKernel/go-genesis/packages/utils"
+
+	log "github.com/sirupsen/logrus"
 )
 
 func encode(x, y []byte) string {
@@ -50,8 +71,11 @@ func decode(x, y string) []byte {
 }
 
 func initGorm(t *testing.T) *gorm.DB {
-	os.Remove("./db_test")
-	os.Remove("./schema")
+	// the databases are created in the temporary dir, so the tests don't leave them in the sources
+	dbFile := filepath.Join(os.TempDir(), "genesis_daemons_db_test")
+	schemaFile := filepath.Join(os.TempDir(), "genesis_daemons_schema")
+	os.Remove(dbFile)
+	os.Remove(schemaFile)
 
 	drivers := sql.Drivers()
 	found := false
@@ -72,13 +96,14 @@ func initGorm(t *testing.T) *gorm.DB {
 		})
 	}
 
-	schema, err := sql.Open("sqlite3", "./schema")
+	schema, err := sql.Open("sqlite3", schemaFile)
 	if err != nil {
 		t.Fatalf("can't create schema base %s", err)
 	}
 	defer schema.Close()
 
-	gormDb, err := sql.Open("sqlite3_custom", "./db_test")
+	// the writes outside of the transaction of the played block wait for it, so they fail fast
+	gormDb, err := sql.Open("sqlite3_custom", dbFile+"?_busy_timeout=100")
 	if err != nil {
 		t.Fatalf("sqlite failed %s", err)
 	}
@@ -88,51 +113,11 @@ func initGorm(t *testing.T) *gorm.DB {
 	}
 	model.DBConn = db
 
-	err = model.FullNodeCreateTable()
-	if err != nil {
-		t.Fatalf("can't create table: %s", err)
-	}
-
-	err = model.MainLockCreateTable()
-	if err != nil {
-		t.Fatalf("can't create table: %s", err)
-	}
-
-	err = model.BlockChainCreateTable()
-	if err != nil {
-		t.Fatalf("can't create table: %s", err)
-	}
-
-	err = model.DBConn.CreateTable(&testDltWallet{}).Error
-
-	//	err = model.WalletCreateTable()
-	if err != nil {
-		t.Fatalf("can't create table: %s", err)
-	}
-
-	err = model.TransactionsCreateTable()
-	if err != nil {
-		t.Fatalf("can't create table: %s", err)
-	}
-
-	err = model.LogTransactionsCreateTable()
-	if err != nil {
-		t.Fatalf("can't create table: %s", err)
-	}
-
-	err = model.ConfigCreateTable()
-	if err != nil {
-		t.Fatalf("can't create table: %s", err)
-	}
-
-	err = model.SystemRecognizedStatesCreateTable()
-	if err != nil {
-		t.Fatalf("can't create table: %s", err)
-	}
-
-	err = model.InfoBlockCreateTable()
-	if err != nil {
-		t.Fatalf("can't create table: %s", err)
+	for _, table := range []interface{}{&model.InfoBlock{}, &model.Block{}, &model.Transaction{},
+		&model.LogTransaction{}, &model.BannedNode{}, &testDltWallet{}} {
+		if err = db.CreateTable(table).Error; err != nil {
+			t.Fatalf("can't create table: %s", err)
+		}
 	}
 
 	sql := `
@@ -147,8 +132,7 @@ func initGorm(t *testing.T) *gorm.DB {
 		t.Fatalf("%s", err)
 	}
 
-	sql = `ATTACH DATABASE './schema' AS 'information_schema';`
-	_, err = db.DB().Exec(sql)
+	_, err = db.DB().Exec(`ATTACH DATABASE ? AS 'information_schema';`, schemaFile)
 	if err != nil {
 		t.Fatalf("%s", err)
 	}
@@ -163,10 +147,12 @@ func createDaemon(db *sql.DB) *daemon {
 
 	return &daemon{
 		goRoutineName: "test",
+		logger:        log.WithFields(log.Fields{"daemon_name": "test"}),
 	}
 }
 
-func getAndResponse(t *testing.T, l net.Listener, getRequest, sendRequest []byte) {
+// getAndResponse serves one connection, if version isn't zero the handshake with this version precedes the request
+func getAndResponse(t *testing.T, l net.Listener, version int64, getRequest, sendRequest []byte) {
 
 	conn, err := l.Accept()
 	if err != nil {
@@ -178,6 +164,20 @@ func getAndResponse(t *testing.T, l net.Listener, getRequest, sendRequest []byte
 	conn.SetReadDeadline(time.Now().Add(time.Second))
 	conn.SetWriteDeadline(time.Now().Add(time.Second))
 
+	if version != 0 {
+		if _, err = io.ReadFull(conn, make([]byte, 4)); err != nil {
+			t.Errorf("read handshake error: %s", err)
+			return
+		}
+		if _, err = conn.Write(converter.DecToBin(version, 2)); err != nil {
+			t.Errorf("write handshake error: %s", err)
+			return
+		}
+		if version != consts.PROTOCOL_VERSION {
+			return
+		}
+	}
+
 	if getRequest != nil {
 		toRead := make([]byte, len(getRequest))
 		_, err = conn.Read(toRead)
@@ -204,15 +204,19 @@ func TestChooseBlock(t *testing.T) {
 
 	go func() {
 		wg.Add(1)
-		getAndResponse(t, l, converter.DecToBin(consts.DATA_TYPE_MAX_BLOCK_ID, 2), converter.DecToBin(100, 4))
+		getAndResponse(t, l, consts.PROTOCOL_VERSION, converter.DecToBin(consts.DATA_TYPE_MAX_BLOCK_ID, 2), converter.DecToBin(100, 4))
 		wg.Done()
 
 	}()
 
-	host, maxBlockID, err := chooseBestHost(context.Background(), []string{l.Addr().String()})
+	ranked, err := chooseBestHost(context.Background(), []string{l.Addr().String()}, true, log.WithFields(log.Fields{}))
 	if err != nil {
 		t.Fatalf("choose best host return: %s", err)
 	}
+	if len(ranked) != 1 {
+		t.Fatalf("wrong count of hosts: %d", len(ranked))
+	}
+	host, maxBlockID := ranked[0].host, ranked[0].blockID
 
 	if host != l.Addr().String() {
 		t.Errorf("return bad host, want %s, got %s", l.Addr().String(), host)
@@ -224,22 +228,84 @@ func TestChooseBlock(t *testing.T) {
 	wg.Wait()
 }
 
+func TestProbeHosts(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	if err = db.CreateTable(&model.BannedNode{}).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
+	}
+
+	l, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		t.Fatalf("can't start daemon: %s", err)
+	}
+	defer l.Close()
+	// the closed listener gives the address which refuses the connections
+	closed, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		t.Fatalf("can't listen: %s", err)
+	}
+	closed.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		getAndResponse(t, l, consts.PROTOCOL_VERSION, converter.DecToBin(consts.DATA_TYPE_MAX_BLOCK_ID, 2), converter.DecToBin(100, 4))
+		wg.Done()
+	}()
+
+	hosts := []string{l.Addr().String(), closed.Addr().String()}
+	ranked, probes, err := probeHosts(context.Background(), hosts, true, log.WithFields(log.Fields{}))
+	if err != nil {
+		t.Fatalf("probe hosts return: %s", err)
+	}
+	wg.Wait()
+	if len(ranked) != 1 || ranked[0].host != hosts[0] {
+		t.Errorf("wrong ranked hosts %v", ranked)
+	}
+	if len(probes) != 2 {
+		t.Fatalf("wrong count of probes: %d", len(probes))
+	}
+	if probes[0].Host != hosts[0] || probes[0].BlockID != 100 || probes[0].Error != nil {
+		t.Errorf("wrong probe %+v", probes[0])
+	}
+	if probes[1].Host != hosts[1] || probes[1].Error == nil {
+		t.Errorf("wrong probe %+v", probes[1])
+	}
+}
+
+// initNodeDB connects to the postgres database of the node which is set by GENESIS_TEST_DB and
+// installs the schema, the tests which play the real blocks are skipped without it
+func initNodeDB(t *testing.T) {
+	name := os.Getenv("GENESIS_TEST_DB")
+	if len(name) == 0 {
+		t.Skip("GENESIS_TEST_DB isn't set, the test needs the postgres database of the node")
+	}
+	cfg := conf.DBConfig{Name: name, HostPort: conf.HostPort{Host: "localhost", Port: 5432},
+		User: "postgres", Password: os.Getenv("GENESIS_TEST_DB_PASSWORD")}
+	if err := model.InitDB(cfg); err != nil {
+		t.Fatalf("can't init database: %s", err)
+	}
+}
+
 func checkBlock(t *testing.T, id int64) {
 	b := &model.Block{}
-	err := b.GetBlock(1)
-	if err != nil {
-		t.Errorf("get block failed: %s", err)
-	} else {
-		if b.ID != id {
-			t.Errorf("bad blockID want %d, got %d", id, b.ID)
-		}
+	found, err := b.Get(id)
+	if err != nil || !found {
+		t.Errorf("get block failed: %v", err)
+	} else if b.ID != id {
+		t.Errorf("bad blockID want %d, got %d", id, b.ID)
 	}
 }
 
 func checkInfoBlock(t *testing.T, id int64) {
 	ib := &model.InfoBlock{}
-	err := ib.GetInfoBlock()
-	if err != nil {
+	if _, err := ib.Get(); err != nil {
 		t.Errorf("can't get info block: %s", err)
 	}
 
@@ -249,11 +315,18 @@ func checkInfoBlock(t *testing.T, id int64) {
 }
 
 func TestFirstBlock(t *testing.T) {
+	initNodeDB(t)
+	defer model.GormClose()
 
-	g := initGorm(t)
-	defer g.Close()
+	fileName := getTmpFile(t)
+	defer os.Remove(fileName)
+	if err := ioutil.WriteFile(fileName, getFirstBlock(t).Data, 0600); err != nil {
+		t.Fatalf("can't write to file: %s", err)
+	}
+	defer func(path string) { *conf.FirstBlockPath = path }(*conf.FirstBlockPath)
+	*conf.FirstBlockPath = fileName
 
-	err := loadFirstBlock()
+	err := loadFirstBlock(context.Background(), log.WithFields(log.Fields{}))
 	if err != nil {
 		t.Errorf("loadFirstBlock return error: %s", err)
 	}
@@ -264,8 +337,8 @@ func TestFirstBlock(t *testing.T) {
 }
 
 func TestLoadFromFile(t *testing.T) {
-	g := initGorm(t)
-	defer g.Close()
+	initNodeDB(t)
+	defer model.GormClose()
 
 	fileName := getTmpFile(t)
 	defer os.Remove(fileName)
@@ -275,7 +348,7 @@ func TestLoadFromFile(t *testing.T) {
 		t.Fatalf("can't write to file: %s", err)
 	}
 
-	err = loadFromFile(context.Background(), fileName)
+	err = loadFromFile(context.Background(), fileName, nil, log.WithFields(log.Fields{}))
 	if err != nil {
 		t.Fatalf("load from file return error: %s", err)
 	}
@@ -294,3 +367,1938 @@ type testDltWallet struct {
 	ConditionsChange   string `gorm:"not null default ''"`
 	RollbackID         int64  `gorm:"not null default 0"`
 }
+
+func TestLoadFirstBlockStopped(t *testing.T) {
+	file, err := ioutil.TempFile("", "1block")
+	if err != nil {
+		t.Fatalf("can't create file: %s", err)
+	}
+	file.Write([]byte("block"))
+	file.Close()
+	defer os.Remove(file.Name())
+
+	defer func(path string) { *conf.FirstBlockPath = path }(*conf.FirstBlockPath)
+	*conf.FirstBlockPath = file.Name()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = loadFirstBlock(ctx, log.WithFields(log.Fields{})); err != context.Canceled {
+		t.Errorf("bad error: want %s, got %v", context.Canceled, err)
+	}
+}
+
+func TestUpdateChainStopped(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	if err = db.CreateTable(&model.InfoBlock{}).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
+	}
+	if err = db.Create(&model.InfoBlock{BlockID: 5}).Error; err != nil {
+		t.Fatalf("can't create info block: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	d := &daemon{goRoutineName: "test", logger: log.WithFields(log.Fields{"daemon_name": "test"})}
+	if err = UpdateChain(ctx, d, "localhost:0", 10); err != ErrChainUpdateStopped {
+		t.Errorf("bad error: want %s, got %v", ErrChainUpdateStopped, err)
+	}
+
+	ib := &model.InfoBlock{}
+	if _, err = ib.Get(); err != nil {
+		t.Fatalf("can't get info block: %s", err)
+	}
+	if ib.BlockID != 5 {
+		t.Errorf("bad info block: want %d, got %d", 5, ib.BlockID)
+	}
+}
+
+func TestUpdateChainLocalError(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	// there is no block_chain table, so the previous block can't be read from the local database
+	for _, table := range []interface{}{&model.InfoBlock{}, &model.SystemParameter{}, &model.BannedNode{}} {
+		if err = db.CreateTable(table).Error; err != nil {
+			t.Fatalf("can't create table: %s", err)
+		}
+	}
+	blocks, _ := signedChain(t, 1, 0)
+	defer resetFullNodes(t)
+
+	l, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		t.Fatalf("can't listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ioutil.ReadAll(io.LimitReader(conn, 6))
+		conn.Write(append(converter.DecToBin(len(blocks[0]), 4), blocks[0]...))
+	}()
+
+	host := l.Addr().String()
+	d := &daemon{goRoutineName: "test", logger: log.WithFields(log.Fields{"daemon_name": "test"})}
+	if err = UpdateChain(context.Background(), d, host, 1); err == nil {
+		t.Errorf("local error is not returned")
+	}
+	if nodesBan.isBanned(host) {
+		nodesBan.unban(host)
+		t.Errorf("host is banned for the local error")
+	}
+}
+
+func TestProcessBlockRandom(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	if err = db.CreateTable(&model.SystemParameter{}).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
+	}
+	if err = db.Create(&model.SystemParameter{ID: 1, Name: syspar.MaxBlockSize, Value: "67108864"}).Error; err != nil {
+		t.Fatalf("can't create system parameter: %s", err)
+	}
+	if err = syspar.SysUpdate(nil); err != nil {
+		t.Fatalf("can't update system parameters: %s", err)
+	}
+
+	const maxSize = 1024
+	if _, err = processBlock(nil, maxSize); err == nil {
+		t.Error("empty block must be rejected")
+	}
+	if _, err = processBlock(make([]byte, maxSize+1), maxSize); err == nil {
+		t.Error("too big block must be rejected")
+	}
+	if _, err = processBlock([]byte{0, 1}, maxSize); err != ErrBlockTooSmall {
+		t.Errorf("wrong error of truncated block: %v", err)
+	}
+	defer func(size int64) { conf.Config.MinBlockSize = size }(conf.Config.MinBlockSize)
+	conf.Config.MinBlockSize = 100
+	if _, err = processBlock(make([]byte, 99), maxSize); err != ErrBlockTooSmall {
+		t.Errorf("wrong error of small block: %v", err)
+	}
+	conf.Config.MinBlockSize = 0
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		data := make([]byte, r.Intn(maxSize)+1)
+		r.Read(data)
+		// processBlock must never panic, the parsing of the random bytes should fail
+		if block, err := processBlock(data, maxSize); err == nil && block == nil {
+			t.Fatalf("empty block without error for %x", data)
+		}
+	}
+}
+
+func TestMaxForkDepth(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	if err = db.CreateTable(&model.SystemParameter{}).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
+	}
+	if err = db.Create(&model.SystemParameter{ID: 1, Name: syspar.RbBlocks1, Value: "60"}).Error; err != nil {
+		t.Fatalf("can't create system parameter: %s", err)
+	}
+	if err = syspar.SysUpdate(nil); err != nil {
+		t.Fatalf("can't update system parameters: %s", err)
+	}
+	defer func(depth int64) { conf.Config.MaxForkDepth = depth }(conf.Config.MaxForkDepth)
+
+	for _, item := range []struct {
+		configured int64
+		depth      int64
+	}{
+		{0, 60},
+		{-1, 60},
+		{10, 10},
+		{consts.MaxForkDepth + 1, consts.MaxForkDepth},
+	} {
+		conf.Config.MaxForkDepth = item.configured
+		if depth := maxForkDepth(); depth != item.depth {
+			t.Errorf("%d: wrong depth %d, expected %d", item.configured, depth, item.depth)
+		}
+	}
+}
+
+func TestCheckpoints(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	if err = db.CreateTable(&model.SystemParameter{}).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
+	}
+	block := &parser.Block{Header: utils.BlockData{BlockID: 50, Time: 1000}, PrevHeader: &utils.BlockData{BlockID: 49, Hash: []byte{1, 2}}}
+	hash, err := blockHash(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, param := range []model.SystemParameter{
+		{ID: 1, Name: syspar.RbBlocks1, Value: "60"},
+		{ID: 2, Name: syspar.Checkpoints, Value: `[["10","aa"],["50","` + hex.EncodeToString(hash) + `"]]`},
+	} {
+		if err = db.Create(&param).Error; err != nil {
+			t.Fatalf("can't create system parameter: %s", err)
+		}
+	}
+	if err = syspar.SysUpdate(nil); err != nil {
+		t.Fatalf("can't update system parameters: %s", err)
+	}
+	defer func(checkpoints map[string]string) { conf.Config.Checkpoints = checkpoints }(conf.Config.Checkpoints)
+	logger := log.WithFields(log.Fields{})
+
+	conf.Config.Checkpoints = nil
+	if err = checkCheckpoint(block, logger); err != nil {
+		t.Errorf("checkpoint of system parameter: %v", err)
+	}
+	conf.Config.Checkpoints = map[string]string{"50": "bad", "30": "bb"}
+	if err = checkCheckpoint(block, logger); err != ErrCheckpointMismatch {
+		t.Errorf("wrong error %v", err)
+	}
+	block.Header.BlockID = 51
+	if err = checkCheckpoint(block, logger); err != nil {
+		t.Errorf("block without checkpoint: %v", err)
+	}
+
+	for _, item := range []struct {
+		blockID, last, depth int64
+	}{
+		{10, 0, 60},
+		{40, 30, 8},
+		{51, 50, -1},
+		{200, 50, 60},
+	} {
+		if last := lastCheckpoint(item.blockID); last != item.last {
+			t.Errorf("%d: wrong last checkpoint %d", item.blockID, last)
+		}
+		if depth := forkDepth(item.blockID); depth != item.depth {
+			t.Errorf("%d: wrong fork depth %d", item.blockID, depth)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(1000)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := bucket.wait(context.Background(), 500); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("bucket is not throttled, elapsed %s", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := bucket.wait(ctx, 1000); err != context.DeadlineExceeded {
+		t.Errorf("wrong error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("wait has not been canceled, elapsed %s", elapsed)
+	}
+}
+
+func TestLoadFromFileTipHash(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	for _, table := range []interface{}{&model.InfoBlock{}, &model.Block{}, &model.SystemParameter{}} {
+		if err = db.CreateTable(table).Error; err != nil {
+			t.Fatalf("can't create table: %s", err)
+		}
+	}
+	if err = db.Create(&model.InfoBlock{BlockID: 5, Hash: []byte{1, 2, 3}}).Error; err != nil {
+		t.Fatalf("can't create info block: %s", err)
+	}
+	defer resetFullNodes(t)
+
+	file, err := ioutil.TempFile("", "blockchain")
+	if err != nil {
+		t.Fatalf("can't create file: %s", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	// the file without the new blocks leaves the local tip
+	logger := log.WithFields(log.Fields{"daemon_name": "test"})
+	if err = loadFromFile(context.Background(), file.Name(), []byte{1, 2, 3}, logger); err != nil {
+		t.Errorf("load with the right hash: %v", err)
+	}
+	if err = loadFromFile(context.Background(), file.Name(), []byte{3, 2, 1}, logger); err != ErrTipHashMismatch {
+		t.Errorf("bad error: want %s, got %v", ErrTipHashMismatch, err)
+	}
+
+	// the hash of the last block of the file is checked before any block is inserted
+	if err = db.Model(&model.InfoBlock{}).Updates(map[string]interface{}{"block_id": 0, "hash": []byte{}}).Error; err != nil {
+		t.Fatalf("can't update info block: %s", err)
+	}
+	blocks, tipHash := signedChain(t, 4, 0)
+	var chain []byte
+	for id, block := range blocks {
+		chain = append(chain, marshallFileBlock(blockData{ID: int64(id + 1), Data: block})...)
+	}
+	if err = ioutil.WriteFile(file.Name(), chain, 0600); err != nil {
+		t.Fatalf("can't write to file: %s", err)
+	}
+	if err = loadFromFile(context.Background(), file.Name(), []byte{3, 2, 1}, logger); err != ErrTipHashMismatch {
+		t.Errorf("bad error: want %s, got %v", ErrTipHashMismatch, err)
+	}
+	var count int
+	if err = db.Model(&model.Block{}).Count(&count).Error; err != nil || count != 0 {
+		t.Errorf("blocks are inserted: %d %v", count, err)
+	}
+	f, err := os.Open(file.Name())
+	if err != nil {
+		t.Fatalf("can't open file: %s", err)
+	}
+	defer f.Close()
+	if err = checkTipHash(context.Background(), f, &utils.BlockData{}, tipHash, logger); err != nil {
+		t.Errorf("check of the right hash: %v", err)
+	}
+}
+
+func TestGetHostBlockIDTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %s", err)
+	}
+	defer l.Close()
+
+	// the listener accepts connections but never responds
+	var conns []net.Conn
+	var mutex sync.Mutex
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			conns = append(conns, conn)
+			mutex.Unlock()
+		}
+	}()
+	defer func() {
+		mutex.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		mutex.Unlock()
+	}()
+
+	prevTimeout := conf.Config.TCPReadWriteTimeout
+	conf.Config.TCPReadWriteTimeout = 100
+	defer func() { conf.Config.TCPReadWriteTimeout = prevTimeout }()
+
+	goroutines := runtime.NumGoroutine()
+	logger := log.WithFields(log.Fields{"daemon_name": "test"})
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := getHostBlockID(l.Addr().String(), logger); err == nil {
+				t.Error("getting block id from not responding host should fail")
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("requests have not been timed out, elapsed %s", elapsed)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("goroutines leaked: before %d, after %d", goroutines, n)
+	}
+
+	// the listener sends the block byte by byte, each read is in time but the whole request isn't
+	drip, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %s", err)
+	}
+	defer drip.Close()
+	go func() {
+		for {
+			conn, err := drip.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				if _, err := io.ReadFull(conn, make([]byte, 6)); err != nil {
+					return
+				}
+				if _, err := conn.Write(converter.DecToBin(1000, 4)); err != nil {
+					return
+				}
+				for {
+					time.Sleep(20 * time.Millisecond)
+					if _, err := conn.Write([]byte{0}); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	prevRequest := conf.Config.TCPRequestTimeout
+	conf.Config.TCPRequestTimeout = 300
+	defer func() { conf.Config.TCPRequestTimeout = prevRequest }()
+
+	start = time.Now()
+	if _, err = utils.GetBlockBody(drip.Addr().String(), 2, consts.DATA_TYPE_BLOCK_BODY, 10000); err == nil {
+		t.Error("getting block from slow host should fail")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("request has not been timed out, elapsed %s", elapsed)
+	}
+}
+
+func TestNextBestHost(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	if err = db.CreateTable(&model.BannedNode{}).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
+	}
+
+	now := time.Now()
+	cache := &hostBlockCache{hosts: map[string]hostBlockInfo{
+		"failed:7078": {blockID: 20, fetchedAt: now},
+		"banned:7078": {blockID: 20, fetchedAt: now},
+		"slow:7078":   {blockID: 15, latency: time.Second, fetchedAt: now},
+		"fast:7078":   {blockID: 15, latency: time.Millisecond, fetchedAt: now.Add(-time.Hour)},
+		"behind:7078": {blockID: 5, fetchedAt: now},
+	}}
+	banNode(log.WithFields(log.Fields{}), "banned:7078", banVerification, nil)
+	defer unbanNode("banned:7078")
+
+	exclude := map[string]bool{"failed:7078": true}
+	host, blockID, ok := cache.nextBestHost(10, exclude)
+	if !ok || host != "fast:7078" || blockID != 15 {
+		t.Errorf("wrong next host %s %d %v", host, blockID, ok)
+	}
+	if host, _, ok = cache.nextBestHost(16, exclude); ok {
+		t.Errorf("unexpected next host %s", host)
+	}
+}
+
+func TestNextCandidate(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	if err = db.CreateTable(&model.BannedNode{}).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
+	}
+
+	candidates := []rankedHost{
+		{host: "failed:7078", hostBlockInfo: hostBlockInfo{blockID: 20}},
+		{host: "banned:7078", hostBlockInfo: hostBlockInfo{blockID: 20}},
+		{host: "second:7078", hostBlockInfo: hostBlockInfo{blockID: 15}},
+		{host: "third:7078", hostBlockInfo: hostBlockInfo{blockID: 12}},
+	}
+	banNode(log.WithFields(log.Fields{}), "banned:7078", banVerification, nil)
+	defer unbanNode("banned:7078")
+	defer func(cache *hostBlockCache) { hostBlocks = cache }(hostBlocks)
+	hostBlocks = &hostBlockCache{hosts: map[string]hostBlockInfo{
+		"cached:7078": {blockID: 14, fetchedAt: time.Now()},
+	}}
+
+	failed := map[string]bool{"failed:7078": true}
+	if host, blockID, ok := nextCandidate(candidates, 10, failed); !ok || host != "second:7078" || blockID != 15 {
+		t.Errorf("wrong next candidate %s %d %v", host, blockID, ok)
+	}
+	failed["second:7078"] = true
+	if host, blockID, ok := nextCandidate(candidates, 10, failed); !ok || host != "third:7078" || blockID != 12 {
+		t.Errorf("wrong next candidate %s %d %v", host, blockID, ok)
+	}
+	// the other cached hosts are used if the candidates don't have the block
+	if host, blockID, ok := nextCandidate(candidates, 13, failed); !ok || host != "cached:7078" || blockID != 14 {
+		t.Errorf("wrong next cached host %s %d %v", host, blockID, ok)
+	}
+	if host, _, ok := nextCandidate(candidates, 16, failed); ok {
+		t.Errorf("unexpected next candidate %s", host)
+	}
+}
+
+func TestDownloadChainStuck(t *testing.T) {
+	var requests int
+	var mutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests++
+		mutex.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><body>Not found</body></html>"))
+	}))
+	defer server.Close()
+
+	file, err := ioutil.TempFile("", "blockchain")
+	if err != nil {
+		t.Fatalf("can't create file: %s", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	err = downloadChain(context.Background(), file.Name(), server.URL, log.WithFields(log.Fields{"daemon_name": "test"}))
+	if err == nil || !strings.Contains(err.Error(), "text/html") {
+		t.Errorf("wrong error %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("wrong count of requests: want 2, got %d", requests)
+	}
+}
+
+func TestDownloadIdleTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { downloadIdleTimeout = timeout }(downloadIdleTimeout)
+	downloadIdleTimeout = 200 * time.Millisecond
+
+	// the slow download takes longer than the idle timeout in total, but the data is received all the time
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 8; i++ {
+			w.Write([]byte("0123456789"))
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer slow.Close()
+	// the stalled download sends a part of the data and hangs
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer stalled.Close()
+
+	file, err := ioutil.TempFile("", "blockchain")
+	if err != nil {
+		t.Fatalf("can't create file: %s", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	logger := log.WithFields(log.Fields{"daemon_name": "test"})
+
+	size, _, err := downloadToFile(context.Background(), slow.URL, file.Name(), logger)
+	if err != nil || size != 80 {
+		t.Errorf("slow download: size %d, error %v", size, err)
+	}
+	if _, _, err = downloadToFile(context.Background(), stalled.URL, file.Name(), logger); err != ErrDownloadStalled {
+		t.Errorf("stalled download: wrong error %v", err)
+	}
+}
+
+func TestPauseBlocksCollection(t *testing.T) {
+	PauseBlocksCollection()
+	defer ResumeBlocksCollection()
+
+	// the paused daemon must not touch the database, so there is no database here
+	model.DBConn = nil
+	d := &daemon{goRoutineName: "test", logger: log.WithFields(log.Fields{"daemon_name": "test"})}
+	if err := BlocksCollection(context.Background(), d); err != nil {
+		t.Errorf("paused blocks collection returned error: %v", err)
+	}
+}
+
+func TestSyncStatus(t *testing.T) {
+	syncStatus.setBlockID(10)
+	syncStatus.setMaxBlockID(25)
+	syncStatus.cycleDone()
+
+	status := GetSyncStatus()
+	if status.BlockID != 10 || status.MaxBlockID != 25 || status.Lag != 15 || status.LastCycle.IsZero() {
+		t.Errorf("wrong sync status %+v", status)
+	}
+
+	syncStatus.setBlockID(30)
+	if status = GetSyncStatus(); status.Lag != 0 {
+		t.Errorf("wrong lag %d", status.Lag)
+	}
+}
+
+func TestDownloadChainRetries(t *testing.T) {
+	// the closed listener gives the address which refuses the connections
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %s", err)
+	}
+	url := "http://" + l.Addr().String()
+	l.Close()
+
+	file, err := ioutil.TempFile("", "blockchain")
+	if err != nil {
+		t.Fatalf("can't create file: %s", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	logger := log.WithFields(log.Fields{"daemon_name": "test"})
+
+	goroutines := runtime.NumGoroutine()
+	if err = downloadChain(context.Background(), file.Name(), url, logger); err == nil {
+		t.Error("downloading from the closed address should fail")
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("goroutines leaked: before %d, after %d", goroutines, n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = downloadChain(ctx, file.Name(), url, logger); err != context.Canceled {
+		t.Errorf("bad error: want %s, got %v", context.Canceled, err)
+	}
+}
+
+func TestDownloadProgress(t *testing.T) {
+	data := make([]byte, 25000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	file, err := ioutil.TempFile("", "blockchain")
+	if err != nil {
+		t.Fatalf("can't create file: %s", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	var reports [][2]int64
+	DownloadProgress = func(info DownloadInfo) {
+		reports = append(reports, [2]int64{info.Downloaded, info.Total})
+	}
+	defer func() { DownloadProgress = nil }()
+
+	size, _, err := downloadToFile(context.Background(), server.URL, file.Name(), log.WithFields(log.Fields{"daemon_name": "test"}))
+	if err != nil || size != int64(len(data)) {
+		t.Fatalf("wrong download %d %v", size, err)
+	}
+	// the chunks are read faster than the interval, so only the final report is made
+	if len(reports) != 1 || reports[0] != [2]int64{size, size} {
+		t.Errorf("wrong reports %v", reports)
+	}
+
+	reports = reports[:0]
+	progress := newProgressReporter(server.URL, -1, log.WithFields(log.Fields{"daemon_name": "test"}))
+	progress.interval = 0
+	progress.report(10, false)
+	progress.report(20, true)
+	if len(reports) != 2 || reports[0] != [2]int64{10, -1} || reports[1] != [2]int64{20, -1} {
+		t.Errorf("wrong reports %v", reports)
+	}
+
+	progress = newProgressReporter(server.URL, 3000, log.WithFields(log.Fields{"daemon_name": "test"}))
+	progress.last, progress.lastDownloaded = time.Now(), 500
+	info := progress.info(1500, progress.last.Add(2*time.Second))
+	if info.Rate != 500 || info.ETA != 3*time.Second || info.Total != 3000 {
+		t.Errorf("wrong info %+v", info)
+	}
+	if info = progress.info(500, progress.last); info.Rate != 0 || info.ETA != 0 {
+		t.Errorf("rate must be unknown %+v", info)
+	}
+}
+
+func TestBanNodeCategory(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	if err = db.CreateTable(&model.BannedNode{}).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
+	}
+
+	for host, category := range map[string]banCategory{"timeout:7078": banTransient, "badblock:7078": banVerification} {
+		start := time.Now()
+		banNode(log.WithFields(log.Fields{}), host, category, nil)
+		defer unbanNode(host)
+
+		nodesBan.mutex.Lock()
+		expire := nodesBan.hosts[host]
+		nodesBan.mutex.Unlock()
+		if banTime := expire.Sub(start); banTime < category.banTime() || banTime > category.banTime()+time.Second {
+			t.Errorf("%s: wrong ban time %v", host, banTime)
+		}
+		if !nodesBan.isBanned(host) {
+			t.Errorf("%s must be banned", host)
+		}
+	}
+	if banTransient.banTime() >= banVerification.banTime() {
+		t.Errorf("transient ban must be shorter")
+	}
+}
+
+func TestBannedNodesRefresh(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	if err = db.CreateTable(&model.BannedNode{}).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
+	}
+	now := time.Now()
+	node := &model.BannedNode{Host: "stored:7078", BanTime: now.Unix(), ExpireTime: now.Add(time.Minute).Unix()}
+	if err = node.Save(); err != nil {
+		t.Fatalf("can't save banned node: %s", err)
+	}
+
+	defer func() {
+		nodesBan.mutex.Lock()
+		nodesBan.hosts, nodesBan.refreshed = make(map[string]time.Time), time.Time{}
+		nodesBan.mutex.Unlock()
+	}()
+	nodesBan.refresh(now)
+
+	// the checks of the hosts use only the in-memory view
+	model.DBConn = nil
+	if !nodesBan.isBanned("stored:7078") {
+		t.Error("stored node must be banned")
+	}
+	if nodesBan.isBanned("other:7078") {
+		t.Error("other node must not be banned")
+	}
+	if hosts := filterBannedHosts([]string{"stored:7078", "other:7078"}); len(hosts) != 1 || hosts[0] != "other:7078" {
+		t.Errorf("wrong hosts %v", hosts)
+	}
+	// the view isn't reloaded until it is outdated
+	nodesBan.refresh(now.Add(time.Second))
+}
+
+func TestDeleteOldestBannedNodes(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+	if err = db.CreateTable(&model.BannedNode{}).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
+	}
+
+	// one expired ban and five live ones with the limit of three
+	now := time.Now().Unix()
+	nodes := []model.BannedNode{{Host: "expired:7078", BanTime: now - 100, ExpireTime: now - 10}}
+	for i := int64(1); i <= 5; i++ {
+		nodes = append(nodes, model.BannedNode{Host: "live" + strconv.FormatInt(i, 10) + ":7078", BanTime: now - 50 + i, ExpireTime: now + 600})
+	}
+	for _, node := range nodes {
+		if err = node.Save(); err != nil {
+			t.Fatalf("can't save banned node: %s", err)
+		}
+	}
+	if err = model.DeleteOldestBannedNodes(now, 3); err != nil {
+		t.Fatalf("can't delete banned nodes: %s", err)
+	}
+	var hosts []string
+	if err = db.Model(&model.BannedNode{}).Order("host").Pluck("host", &hosts).Error; err != nil {
+		t.Fatalf("can't get banned nodes: %s", err)
+	}
+	if strings.Join(hosts, ",") != "live3:7078,live4:7078,live5:7078" {
+		t.Errorf("wrong banned nodes %v", hosts)
+	}
+}
+
+func TestBanNodeLog(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	if err = db.CreateTable(&model.BannedNode{}).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
+	}
+
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.Out = &buf
+	logger.Formatter = &log.JSONFormatter{}
+
+	banNode(log.NewEntry(logger).WithFields(log.Fields{"block_id": 12}), "logged:7078", banVerification, errors.New("bad block"))
+	defer unbanNode("logged:7078")
+
+	var entry map[string]interface{}
+	if err = json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log entry must be json: %s", err)
+	}
+	for key, value := range map[string]interface{}{"msg": "node is banned", "host": "logged:7078",
+		"category": "verification", "block_id": float64(12), "error": "bad block"} {
+		if entry[key] != value {
+			t.Errorf("%s: expected %v, got %v", key, value, entry[key])
+		}
+	}
+}
+
+func TestSyncHosts(t *testing.T) {
+	defer func(peers string, intersect bool) {
+		conf.Config.SyncPeers, conf.Config.SyncPeersIntersect = peers, intersect
+	}(conf.Config.SyncPeers, conf.Config.SyncPeersIntersect)
+
+	remote := []string{"node1:7078", "node2:7078"}
+	table := []struct {
+		peers     string
+		intersect bool
+		want      string
+	}{
+		{"", false, "node1:7078,node2:7078"},
+		{"node3:7078, node1:7078", false, "node3:7078,node1:7078"},
+		{"node3:7078, node1:7078", true, "node1:7078"},
+		{"node3:7078", true, ""},
+	}
+	for _, item := range table {
+		conf.Config.SyncPeers, conf.Config.SyncPeersIntersect = item.peers, item.intersect
+		if hosts := strings.Join(syncHosts(remote), ","); hosts != item.want {
+			t.Errorf("%q %v: want %q, got %q", item.peers, item.intersect, item.want, hosts)
+		}
+	}
+}
+
+func TestCycleMaxBlockID(t *testing.T) {
+	defer func(limit int64) { conf.Config.MaxBlocksPerCycle = limit }(conf.Config.MaxBlocksPerCycle)
+
+	table := []struct {
+		limit, cur, max, want int64
+	}{
+		{0, 10, 1000, 1000},
+		{0, 10, 100000, 10010},
+		{-1, 10, 100000, 100000},
+		{100, 10, 1000, 110},
+		{100, 10, 50, 50},
+		{100, 10, 110, 110},
+	}
+	for _, item := range table {
+		conf.Config.MaxBlocksPerCycle = item.limit
+		if got := cycleMaxBlockID(item.cur, item.max); got != item.want {
+			t.Errorf("%v: got %d", item, got)
+		}
+	}
+}
+
+func TestBlockTimeDrift(t *testing.T) {
+	defer func(drift int64) { conf.Config.BlockTimeDrift = drift }(conf.Config.BlockTimeDrift)
+
+	now := time.Now().Unix()
+	for _, item := range []struct {
+		drift, blockTime int64
+		err              error
+	}{
+		{0, now, nil},
+		{0, now + 1, parser.ErrBlockFromFuture},
+		{10, now + 10, nil},
+		{10, now + 11, parser.ErrBlockFromFuture},
+		{10, now - 100, nil},
+		{-5, now + 1, parser.ErrBlockFromFuture},
+	} {
+		if err := parser.CheckBlockTime(item.blockTime, now, item.drift); err != item.err {
+			t.Errorf("%+v: wrong error %v", item, err)
+		}
+	}
+
+	// the drift is allowed only by the synchronization, the check of the block is strict
+	conf.Config.BlockTimeDrift = 10
+	block := &parser.Block{Header: utils.BlockData{BlockID: 2, Time: time.Now().Unix() + 5}}
+	if err := block.CheckBlock(); err == nil || !strings.Contains(err.Error(), parser.ErrBlockFromFuture.Error()) {
+		t.Errorf("block from the future must be rejected, got %v", err)
+	}
+
+	if err := waitBlockTime(context.Background(), now-1, now); err != nil {
+		t.Errorf("wait of the past block: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := waitBlockTime(ctx, now+5, now); err != context.Canceled {
+		t.Errorf("wrong error of the canceled wait %v", err)
+	}
+}
+
+func TestStageTimer(t *testing.T) {
+	disabled := stageTimer{}
+	disabled.start()
+	if d := disabled.next(); d != 0 || !disabled.last.IsZero() {
+		t.Errorf("disabled timer measures %v", d)
+	}
+
+	timer := stageTimer{enabled: true}
+	timer.start()
+	time.Sleep(10 * time.Millisecond)
+	if d := timer.next(); d < 10*time.Millisecond {
+		t.Errorf("wrong first stage %v", d)
+	}
+	if timer.last.IsZero() {
+		t.Error("next stage is not started")
+	}
+}
+
+func TestOversizedBlock(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	if err = db.CreateTable(&model.SystemParameter{}).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
+	}
+	if err = db.Create(&model.SystemParameter{ID: 1, Name: syspar.MaxBlockSize, Value: "1000"}).Error; err != nil {
+		t.Fatalf("can't create system parameter: %s", err)
+	}
+	if err = syspar.SysUpdate(nil); err != nil {
+		t.Fatalf("can't update system parameters: %s", err)
+	}
+	logger := log.WithFields(log.Fields{"daemon_name": "test"})
+
+	// the peer announces the block bigger than the max size
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ioutil.ReadAll(io.LimitReader(conn, 6))
+		conn.Write(converter.DecToBin(1001, 4))
+	}()
+	if _, err = utils.GetBlockBody(l.Addr().String(), 2, consts.DATA_TYPE_BLOCK_BODY, syspar.GetMaxBlockSize()); err != utils.ErrBlockSize {
+		t.Errorf("wrong error of oversized block from peer: %v", err)
+	}
+
+	// the file contains the block bigger than the max size
+	buf := bytes.NewBuffer(converter.DecToBin(1001, WordSize))
+	buf.Write(make([]byte, 1001+WordSize))
+	if block, err := readBlock(buf, logger); err == nil || block != nil {
+		t.Errorf("oversized block from file must return error")
+	}
+}
+
+func TestCatchUpProgress(t *testing.T) {
+	var reports []CatchUpInfo
+	CatchUpProgress = func(info CatchUpInfo) {
+		reports = append(reports, info)
+	}
+	defer func() { CatchUpProgress = nil }()
+
+	r := newCatchUpReporter(100, 1100, log.WithFields(log.Fields{"daemon_name": "test"}))
+	info := r.info(200, r.start.Add(10*time.Second))
+	if info.Rate != 10 || info.ETA != 90*time.Second || info.MaxBlockID != 1100 {
+		t.Errorf("wrong info %+v", info)
+	}
+	if info = r.info(100, r.start); info.Rate != 0 || info.ETA != 0 {
+		t.Errorf("wrong info without played blocks %+v", info)
+	}
+
+	// the reports are throttled by the interval
+	r.report(101)
+	if len(reports) != 0 {
+		t.Errorf("unexpected reports %v", reports)
+	}
+	r.interval = 0
+	r.report(102)
+	r.report(103)
+	if len(reports) != 2 || reports[1].BlockID != 103 {
+		t.Errorf("wrong reports %v", reports)
+	}
+}
+
+func TestDownloadGzip(t *testing.T) {
+	data := bytes.Repeat([]byte("blockchain"), 3000)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(data)
+	gz.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/encoded" {
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(compressed.Len()))
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	file, err := ioutil.TempFile("", "blockchain")
+	if err != nil {
+		t.Fatalf("can't create file: %s", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	// the rate limit and the progress are of the compressed data, the decompressed file is downloaded
+	// for 30 seconds with this limit
+	defer func(rate int64) { conf.Config.DownloadRateLimit = rate }(conf.Config.DownloadRateLimit)
+	conf.Config.DownloadRateLimit = 1000
+	var last DownloadInfo
+	DownloadProgress = func(info DownloadInfo) {
+		last = info
+	}
+	defer func() { DownloadProgress = nil }()
+
+	logger := log.WithFields(log.Fields{"daemon_name": "test"})
+	for _, path := range []string{"/blockchain.gz", "/encoded"} {
+		start := time.Now()
+		size, _, err := downloadToFile(context.Background(), server.URL+path, file.Name(), logger)
+		if err != nil || size != int64(len(data)) {
+			t.Errorf("%s: wrong download %d %v", path, size, err)
+			continue
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: decompressed data is throttled, downloaded in %s", path, elapsed)
+		}
+		if last.Downloaded != int64(compressed.Len()) || last.Total != int64(compressed.Len()) {
+			t.Errorf("%s: wrong progress %+v", path, last)
+		}
+		if saved, err := ioutil.ReadFile(file.Name()); err != nil || !bytes.Equal(saved, data) {
+			t.Errorf("%s: wrong saved file %v", path, err)
+		}
+	}
+	// the compressed file is smaller than BLOCKCHAIN_SIZE but the decompressed one is not
+	if err = downloadChain(context.Background(), file.Name(), server.URL+"/blockchain.gz", logger); err != nil {
+		t.Errorf("downloading gzipped blockchain: %v", err)
+	}
+}
+
+func TestDownloadChainMirrors(t *testing.T) {
+	good := bytes.Repeat([]byte("good"), consts.BLOCKCHAIN_SIZE)
+	bad := bytes.Repeat([]byte("evil"), consts.BLOCKCHAIN_SIZE)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/good":
+			w.Write(good)
+		case "/bad":
+			w.Write(bad)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	file, err := ioutil.TempFile("", "blockchain")
+	if err != nil {
+		t.Fatalf("can't create file: %s", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	defer func(checksum string) { conf.Config.FirstLoadBlockchainSHA256 = checksum }(conf.Config.FirstLoadBlockchainSHA256)
+	sum := sha256.Sum256(good)
+	conf.Config.FirstLoadBlockchainSHA256 = hex.EncodeToString(sum[:])
+
+	logger := log.WithFields(log.Fields{"daemon_name": "test"})
+	urls := []string{server.URL + "/missing", server.URL + "/bad", server.URL + "/good"}
+	url, err := downloadChainMirrors(context.Background(), file.Name(), urls, logger)
+	if err != nil || url != server.URL+"/good" {
+		t.Errorf("wrong mirror %s %v", url, err)
+	}
+	if data, err := ioutil.ReadFile(file.Name()); err != nil || !bytes.Equal(data, good) {
+		t.Errorf("wrong downloaded file %v", err)
+	}
+	if _, err = downloadChainMirrors(context.Background(), file.Name(), urls[:2], logger); err == nil {
+		t.Errorf("all mirrors failed but there is no error")
+	}
+}
+
+func TestExcludeSelf(t *testing.T) {
+	defer func(server conf.HostPort) { conf.Config.TCPServer = server }(conf.Config.TCPServer)
+	logger := log.WithFields(log.Fields{"daemon_name": "test"})
+
+	conf.Config.TCPServer = conf.HostPort{Host: "Node1.Example.com", Port: 7078}
+	hosts := excludeSelf([]string{"node1.example.com.:7078", "node1.example.com:7079", "localhost:7078",
+		"127.0.0.1:7078", "[::1]:7078", "node2.example.com:7078"}, logger)
+	if strings.Join(hosts, ",") != "node1.example.com:7079,node2.example.com:7078" {
+		t.Errorf("wrong hosts %v", hosts)
+	}
+
+	conf.Config.TCPServer = conf.HostPort{Host: "10.0.0.1", Port: 7078}
+	hosts = excludeSelf([]string{"10.0.0.1:7078", "[::ffff:10.0.0.1]:7078", "10.0.0.2:7078"}, logger)
+	if strings.Join(hosts, ",") != "10.0.0.2:7078" {
+		t.Errorf("wrong hosts %v", hosts)
+	}
+
+	if hosts = excludeSelf([]string{"10.0.0.1:7078"}, logger); len(hosts) != 0 {
+		t.Errorf("wrong hosts %v", hosts)
+	}
+}
+
+func TestGetHostPort(t *testing.T) {
+	for _, item := range []struct {
+		host string
+		want string
+	}{
+		{"10.0.0.1", "10.0.0.1:7078"},
+		{"10.0.0.1:8000", "10.0.0.1:8000"},
+		{"node1.example.com", "node1.example.com:7078"},
+		{"node1.example.com:8000", "node1.example.com:8000"},
+		{"::1", "[::1]:7078"},
+		{"2001:db8::1", "[2001:db8::1]:7078"},
+		{"[2001:db8::1]", "[2001:db8::1]:7078"},
+		{"[2001:db8::1]:8000", "[2001:db8::1]:8000"},
+		{"fe80::1%eth0", "[fe80::1%eth0]:7078"},
+		{"node1:example:com", "node1:example:com"},
+	} {
+		if addr := getHostPort(item.host); addr != item.want {
+			t.Errorf("%s: wrong address %s", item.host, addr)
+		}
+	}
+
+	hosts := resolveHosts([]string{"2001:db8::1", "[2001:db8::1]:8000", "node1:example:com", "node1.example.com"})
+	if strings.Join(hosts, ",") != "[2001:db8::1]:7078,[2001:db8::1]:8000,node1.example.com:7078" {
+		t.Errorf("wrong hosts %v", hosts)
+	}
+}
+
+type testBlockSource struct {
+	maxBlockID int64
+	requested  []int64
+}
+
+func (s *testBlockSource) GetBlock(id int64) ([]byte, error) {
+	s.requested = append(s.requested, id)
+	return nil, errors.New("block is unavailable")
+}
+
+func (s *testBlockSource) MaxBlockID() (int64, error) {
+	return s.maxBlockID, nil
+}
+
+func TestCustomBlockSource(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	if err = db.CreateTable(&model.InfoBlock{}).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
+	}
+	if err = db.Create(&model.InfoBlock{BlockID: 5}).Error; err != nil {
+		t.Fatalf("can't create info block: %s", err)
+	}
+
+	source := &testBlockSource{maxBlockID: 5}
+	CustomBlockSource = source
+	defer func() { CustomBlockSource = nil }()
+	var applied []int64
+	OnBlockApplied = func(blockID int64) { applied = append(applied, blockID) }
+	OnBlockStages = func(blockID int64, fetch, parse, validate, play time.Duration) { applied = append(applied, blockID) }
+	defer func() { OnBlockApplied, OnBlockStages = nil, nil }()
+
+	d := &daemon{goRoutineName: "test", logger: log.WithFields(log.Fields{"daemon_name": "test"})}
+	if err = blocksCollection(context.Background(), d); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if len(source.requested) != 0 {
+		t.Errorf("blocks are requested: %v", source.requested)
+	}
+
+	// the custom source isn't replaced with the peers if it fails
+	source.maxBlockID = 7
+	if err = blocksCollection(context.Background(), d); err == nil || err.Error() != "block is unavailable" {
+		t.Errorf("bad error: %v", err)
+	}
+	if len(source.requested) != 1 || source.requested[0] != 6 {
+		t.Errorf("bad requested blocks: %v", source.requested)
+	}
+	if len(applied) != 0 {
+		t.Errorf("failed blocks are reported as applied: %v", applied)
+	}
+	if got := sourceName(source); got != "*daemons.testBlockSource" {
+		t.Errorf("bad source name: %s", got)
+	}
+}
+
+func TestCheckFirstBlockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "firstblock")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/1block"
+	if err = checkFirstBlockFile(path); err == nil || !strings.Contains(err.Error(), "unavailable") {
+		t.Errorf("bad error for missing file: %v", err)
+	}
+	if err = ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatalf("can't write file: %s", err)
+	}
+	if err = checkFirstBlockFile(path); err == nil || !strings.Contains(err.Error(), "is empty") {
+		t.Errorf("bad error for empty file: %v", err)
+	}
+	if err = ioutil.WriteFile(path, []byte{1}, 0600); err != nil {
+		t.Fatalf("can't write file: %s", err)
+	}
+	if err = checkFirstBlockFile(path); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestLoadChainFile(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+	if err = db.CreateTable(&model.InfoBlock{}).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
+	}
+	if err = db.Create(&model.InfoBlock{BlockID: 5}).Error; err != nil {
+		t.Fatalf("can't create info block: %s", err)
+	}
+
+	var chain []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(chain)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "firstload")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(cfg conf.SavedConfig) { conf.Config = cfg }(conf.Config)
+	conf.Config.WorkDir = dir
+	conf.Config.FirstLoadBlockchain = "file"
+	conf.Config.FirstLoadBlockchainURL = server.URL
+	conf.Config.FirstLoadBlockchainSHA256 = ""
+
+	logger := log.WithFields(log.Fields{"daemon_name": "test"})
+	fileName := dir + "/" + consts.BLOCKCHAIN_FILENAME
+
+	// the broken file isn't kept and the load is continued by the next cycle
+	chain = bytes.Repeat([]byte("broken"), consts.BLOCKCHAIN_SIZE)
+	if err = loadChainFile(context.Background(), logger); err == nil {
+		t.Errorf("broken file is loaded")
+	}
+	if _, err = os.Stat(fileName); !os.IsNotExist(err) {
+		t.Errorf("blockchain file is not removed: %v", err)
+	}
+	if toLoad, err := needLoad(logger); err != nil || !toLoad {
+		t.Errorf("unfinished load is not continued: %v %v", toLoad, err)
+	}
+
+	// the zero size of the block marks the end of the blockchain file
+	chain = make([]byte, consts.BLOCKCHAIN_SIZE)
+	if err = loadChainFile(context.Background(), logger); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if toLoad, err := needLoad(logger); err != nil || toLoad {
+		t.Errorf("finished load is continued: %v %v", toLoad, err)
+	}
+
+	// the loaded file is kept with the id of the last block in the name
+	conf.Config.KeepSnapshotFile = true
+	if err = loadChainFile(context.Background(), logger); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err = os.Stat(fileName + "-5"); err != nil {
+		t.Errorf("blockchain file is not kept: %v", err)
+	}
+	if _, err = os.Stat(fileName); !os.IsNotExist(err) {
+		t.Errorf("blockchain file is not renamed: %v", err)
+	}
+}
+
+func TestBlockTimeout(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	defer func(timeout int64) { conf.Config.BlockTimeout = timeout }(conf.Config.BlockTimeout)
+	conf.Config.BlockTimeout = 0
+	ctx, cancel := blockContext(context.Background())
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("unlimited block context has deadline")
+	}
+	cancel()
+
+	conf.Config.BlockTimeout = 1
+	ctx, cancel = blockContext(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); !ok {
+		t.Errorf("block context has no deadline")
+	}
+	<-ctx.Done()
+
+	// the timed out block isn't played
+	block := &parser.Block{Parsers: []*parser.Parser{{}}}
+	if err = block.PlayBlockSafeContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("bad error: want %s, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestChooseBlockIncompatible(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+	if err = db.CreateTable(&model.BannedNode{}).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
+	}
+
+	compatible, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		t.Fatalf("can't listen: %s", err)
+	}
+	defer compatible.Close()
+	incompatible, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		t.Fatalf("can't listen: %s", err)
+	}
+	defer incompatible.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		getAndResponse(t, compatible, consts.PROTOCOL_VERSION, converter.DecToBin(consts.DATA_TYPE_MAX_BLOCK_ID, 2),
+			converter.DecToBin(10, 4))
+	}()
+	go func() {
+		defer wg.Done()
+		getAndResponse(t, incompatible, consts.PROTOCOL_VERSION+1, nil, nil)
+	}()
+
+	ranked, err := chooseBestHost(context.Background(),
+		[]string{incompatible.Addr().String(), compatible.Addr().String()}, true, log.WithFields(log.Fields{}))
+	wg.Wait()
+	if err != nil || len(ranked) != 1 || ranked[0].host != compatible.Addr().String() || ranked[0].blockID != 10 {
+		t.Errorf("wrong ranked hosts %v %v", ranked, err)
+	}
+	if !nodesBan.isBanned(incompatible.Addr().String()) {
+		t.Errorf("incompatible host is not banned")
+	}
+	nodesBan.unban(incompatible.Addr().String())
+}
+
+func TestChooseBlockLegacy(t *testing.T) {
+	legacy, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		t.Fatalf("can't listen: %s", err)
+	}
+	defer legacy.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// the host of the previous release closes the connection on the unknown request type
+		conn, err := legacy.Accept()
+		if err != nil {
+			t.Errorf("accept error %s", err)
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err = io.ReadFull(conn, make([]byte, 2)); err != nil {
+			t.Errorf("read request type error: %s", err)
+		}
+		conn.Close()
+		getAndResponse(t, legacy, 0, converter.DecToBin(consts.DATA_TYPE_MAX_BLOCK_ID, 2), converter.DecToBin(7, 4))
+	}()
+
+	ranked, err := chooseBestHost(context.Background(), []string{legacy.Addr().String()}, true, log.WithFields(log.Fields{}))
+	wg.Wait()
+	if err != nil || len(ranked) != 1 || ranked[0].blockID != 7 {
+		t.Errorf("wrong ranked hosts %v %v", ranked, err)
+	}
+	if nodesBan.isBanned(legacy.Addr().String()) {
+		t.Errorf("legacy host is banned")
+	}
+}
+
+func TestInsertFileBlocks(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	if err = db.CreateTable(&model.SystemParameter{}).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
+	}
+	if err = db.Create(&model.SystemParameter{ID: 1, Name: syspar.MaxBlockSize, Value: "1000"}).Error; err != nil {
+		t.Fatalf("can't create system parameter: %s", err)
+	}
+	if err = syspar.SysUpdate(nil); err != nil {
+		t.Fatalf("can't update system parameters: %s", err)
+	}
+	defer func(cfg conf.SavedConfig, endBlockID int64) {
+		conf.Config, *conf.EndBlockID = cfg, endBlockID
+	}(conf.Config, *conf.EndBlockID)
+	conf.Config.FirstLoadWorkers = 2
+	logger := log.WithFields(log.Fields{"daemon_name": "test"})
+
+	// the blocks can't be parsed, so any block which isn't skipped fails the load
+	var chain []byte
+	for id := int64(1); id <= 10; id++ {
+		chain = append(chain, marshallFileBlock(blockData{ID: id, Data: []byte("broken")})...)
+	}
+	chain = append(chain, make([]byte, WordSize)...)
+
+	for _, item := range []struct {
+		lastBlockID int64
+		endBlockID  int64
+		failed      bool
+	}{
+		{10, 0, false},
+		{9, 0, true},
+		{5, 6, false},
+		{5, 7, true},
+		{0, 1, false},
+	} {
+		*conf.EndBlockID = item.endBlockID
+		err := insertFileBlocks(context.Background(), bytes.NewReader(chain), item.lastBlockID, logger)
+		if (err != nil) != item.failed {
+			t.Errorf("%+v: unexpected result %v", item, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = insertFileBlocks(ctx, bytes.NewReader(chain), 10, logger); err != context.Canceled {
+		t.Errorf("cancelled load returned %v", err)
+	}
+
+	// the ids of the blocks must grow even if the blocks are skipped
+	*conf.EndBlockID = 0
+	disordered := append(marshallFileBlock(blockData{ID: 2, Data: []byte("broken")}),
+		marshallFileBlock(blockData{ID: 2, Data: []byte("broken")})...)
+	if err = insertFileBlocks(context.Background(), bytes.NewReader(disordered), 10, logger); err == nil {
+		t.Errorf("blocks with the same id are loaded")
+	}
+}
+
+func TestFileBlocksPreCheck(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	if err = db.CreateTable(&model.SystemParameter{}).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
+	}
+	defer resetFullNodes(t)
+	defer func(workers int) { conf.Config.FirstLoadWorkers = workers }(conf.Config.FirstLoadWorkers)
+	conf.Config.FirstLoadWorkers = 3
+
+	blocks, tipHash := signedChain(t, 8, 5)
+	var chain []byte
+	for id, block := range blocks {
+		chain = append(chain, marshallFileBlock(blockData{ID: int64(id + 1), Data: block})...)
+	}
+
+	// the workers link the blocks and check their signatures, so the forged signature isn't checked again
+	// except the signature of the bad block which has failed the check
+	var lastHash []byte
+	err = processFileBlocks(context.Background(), bytes.NewReader(chain), 0, &utils.BlockData{},
+		log.WithFields(log.Fields{"daemon_name": "test"}), func(res parsedFileBlock) error {
+			if res.err != nil {
+				return res.err
+			}
+			block := res.block
+			if block.PrevHeader == nil || block.PrevHeader.BlockID != res.blockID-1 {
+				t.Errorf("block %d isn't linked", res.blockID)
+				return nil
+			}
+			if lastHash, err = blockHash(block); err != nil {
+				return err
+			}
+			block.Header.Sign = []byte("forged")
+			if ok, _ := block.CheckHash(); ok != (res.blockID != 5) {
+				t.Errorf("block %d: wrong check of the signature %v", res.blockID, ok)
+			}
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Equal(lastHash, tipHash) {
+		t.Errorf("wrong hash of the last block %x, expected %x", lastHash, tipHash)
+	}
+}
+
+func TestScanChainFile(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	if err = db.CreateTable(&model.SystemParameter{}).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
+	}
+	if err = db.Create(&model.SystemParameter{ID: 1, Name: syspar.MaxBlockSize, Value: "1000"}).Error; err != nil {
+		t.Fatalf("can't create system parameter: %s", err)
+	}
+	if err = syspar.SysUpdate(nil); err != nil {
+		t.Fatalf("can't update system parameters: %s", err)
+	}
+
+	var chain []byte
+	for id := int64(1); id <= 5; id++ {
+		chain = append(chain, marshallFileBlock(blockData{ID: id, Data: []byte("broken")})...)
+	}
+	file, err := ioutil.TempFile("", "blockchain")
+	if err != nil {
+		t.Fatalf("can't create file: %s", err)
+	}
+	file.Close()
+	fileName := file.Name()
+	defer os.Remove(fileName)
+
+	// the scan continues after the bad blocks and reports all of them
+	if err = ioutil.WriteFile(fileName, append(chain, make([]byte, WordSize)...), 0600); err != nil {
+		t.Fatalf("can't write to file: %s", err)
+	}
+	failed, err := ScanChainFile(context.Background(), fileName)
+	if err != nil || len(failed) != 5 {
+		t.Fatalf("unexpected result %v %v", failed, err)
+	}
+	for i, res := range failed {
+		if res.BlockID != int64(i+1) || res.Check != VerifyCheckProcess || res.Error == nil {
+			t.Errorf("wrong result %+v", res)
+		}
+	}
+
+	// the unreadable data stops the scan, the failures found before are returned
+	if err = ioutil.WriteFile(fileName, append(chain, 0xff, 0xff, 0xff, 0xff, 0xff), 0600); err != nil {
+		t.Fatalf("can't write to file: %s", err)
+	}
+	if failed, err = ScanChainFile(context.Background(), fileName); err == nil || len(failed) != 5 {
+		t.Errorf("unexpected result of unreadable file %v %v", failed, err)
+	}
+
+	if _, err = ScanChainFile(context.Background(), fileName+"-missing"); err == nil {
+		t.Error("missing file must fail")
+	}
+}
+
+func TestDownloadHeaders(t *testing.T) {
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		w.Write([]byte("chain"))
+	}))
+	defer server.Close()
+
+	file, err := ioutil.TempFile("", "blockchain")
+	if err != nil {
+		t.Fatalf("can't create file: %s", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	defer func(cfg conf.SavedConfig) { conf.Config = cfg }(conf.Config)
+	logger := log.WithFields(log.Fields{"daemon_name": "test"})
+
+	conf.Config.FirstLoadUserAgent = ""
+	conf.Config.FirstLoadHeaders = nil
+	if _, _, err = downloadToFile(context.Background(), server.URL, file.Name(), logger); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ua := header.Get("User-Agent"); ua != consts.DownloadUserAgent {
+		t.Errorf("wrong default user agent %s", ua)
+	}
+
+	conf.Config.FirstLoadUserAgent = "mirror-client"
+	conf.Config.FirstLoadHeaders = map[string]string{"Authorization": "Bearer token"}
+	if _, _, err = downloadToFile(context.Background(), server.URL, file.Name(), logger); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ua, auth := header.Get("User-Agent"), header.Get("Authorization"); ua != "mirror-client" || auth != "Bearer token" {
+		t.Errorf("wrong headers %s %s", ua, auth)
+	}
+}
+
+func TestCollectionJitter(t *testing.T) {
+	defer func(start, cycle int64) {
+		conf.Config.SyncStartJitter, conf.Config.SyncJitter = start, cycle
+	}(conf.Config.SyncStartJitter, conf.Config.SyncJitter)
+
+	conf.Config.SyncStartJitter, conf.Config.SyncJitter = 0, 0
+	if start, cycle := daemonsJitter["BlocksCollection"](); start != 0 || cycle != 0 {
+		t.Errorf("jitter must be disabled by default, got %v %v", start, cycle)
+	}
+	if delay := randomDelay(0); delay != 0 {
+		t.Errorf("wrong delay %v", delay)
+	}
+
+	conf.Config.SyncStartJitter, conf.Config.SyncJitter = 3000, 200
+	start, cycle := daemonsJitter["BlocksCollection"]()
+	if start != 3*time.Second || cycle != 200*time.Millisecond {
+		t.Fatalf("wrong jitter %v %v", start, cycle)
+	}
+	delays := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		delay := randomDelay(cycle)
+		if delay < 0 || delay > cycle {
+			t.Fatalf("delay %v is out of range [0, %v]", delay, cycle)
+		}
+		delays[delay] = true
+	}
+	if len(delays) < 2 {
+		t.Error("delays must be random")
+	}
+}
+
+func TestConnBackoff(t *testing.T) {
+	defer func(min, max int64) {
+		conf.Config.ConnBackoffMin, conf.Config.ConnBackoffMax = min, max
+	}(conf.Config.ConnBackoffMin, conf.Config.ConnBackoffMax)
+	conf.Config.ConnBackoffMin, conf.Config.ConnBackoffMax = 200, 300
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := listener.Addr().String()
+	listener.Close()
+
+	logger := log.WithFields(log.Fields{})
+	if _, err := getHostBlockID(host, logger); err == nil || err == utils.ErrBackoff {
+		t.Fatalf("wrong error %v", err)
+	}
+	if _, err := getHostBlockID(host, logger); err != utils.ErrBackoff {
+		t.Fatalf("reconnection must be delayed, got %v", err)
+	}
+	if _, err := utils.GetBlockBody(host, 2, consts.DATA_TYPE_BLOCK_BODY, 1000); err != utils.ErrBackoff {
+		t.Errorf("block request must be delayed, got %v", err)
+	}
+	// the sending of the blocks and the transactions isn't delayed
+	if _, err := utils.TCPConn(host); err == nil || err == utils.ErrBackoff {
+		t.Errorf("wrong error of connection %v", err)
+	}
+	state, ok := utils.GetHostBackoffs()[host]
+	if !ok || state.Failures != 1 || state.Delay != 200*time.Millisecond {
+		t.Fatalf("wrong backoff %+v", state)
+	}
+
+	time.Sleep(state.Delay)
+	getHostBlockID(host, logger)
+	state = utils.GetHostBackoffs()[host]
+	if state.Failures != 2 || state.Delay != 300*time.Millisecond {
+		t.Fatalf("delay must be doubled up to the max, got %+v", state)
+	}
+
+	listener, err = net.Listen("tcp", host)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer listener.Close()
+	time.Sleep(state.Delay)
+	conn, err := utils.TCPConnBackoff(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if _, ok := utils.GetHostBackoffs()[host]; ok {
+		t.Error("successful connection must reset the backoff")
+	}
+}
+
+func TestUpdateChainBackoff(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+	for _, table := range []interface{}{&model.InfoBlock{}, &model.BannedNode{}} {
+		if err = db.CreateTable(table).Error; err != nil {
+			t.Fatalf("can't create table: %s", err)
+		}
+	}
+	if err = db.Create(&model.InfoBlock{BlockID: 5}).Error; err != nil {
+		t.Fatalf("can't create info block: %s", err)
+	}
+	defer func(min int64) { conf.Config.ConnBackoffMin = min }(conf.Config.ConnBackoffMin)
+	conf.Config.ConnBackoffMin = 10000
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := listener.Addr().String()
+	listener.Close()
+	if _, err = utils.TCPConnBackoff(host); err == nil {
+		t.Fatal("connection to the closed port must fail")
+	}
+
+	// the host which reconnection is delayed isn't banned for it
+	d := &daemon{goRoutineName: "test", logger: log.WithFields(log.Fields{"daemon_name": "test"})}
+	if err = UpdateChain(context.Background(), d, host, 6); err == nil {
+		t.Error("delayed host must fail")
+	}
+	if nodesBan.isBanned(host) {
+		nodesBan.unban(host)
+		t.Error("delayed host is banned")
+	}
+}
+
+func TestValidateChainRange(t *testing.T) {
+	for _, r := range [][2]int64{{1, 10}, {0, 0}, {10, 5}} {
+		if blockID, err := ValidateChain(context.Background(), "localhost:1", r[0], r[1]); err == nil || blockID != r[0] {
+			t.Errorf("%v: wrong result %d %v", r, blockID, err)
+		}
+	}
+
+	closed, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		t.Fatalf("can't listen: %s", err)
+	}
+	closed.Close()
+	if blockID, err := ValidateChain(context.Background(), closed.Addr().String(), 5, 7); err == nil || blockID != 5 {
+		t.Errorf("unreachable host: wrong result %d %v", blockID, err)
+	}
+}
+
+// signedChain returns the blocks from 1 to count signed by the only full node and the hash of the last block,
+// the block bad is signed by another key. The system parameters of the full node are set in the database of the test
+func signedChain(t *testing.T, count, bad int64) ([][]byte, []byte) {
+	nodeKey, nodePublic, err := crypto.GenHexKeys()
+	if err != nil {
+		t.Fatalf("can't gen keys: %s", err)
+	}
+	otherKey, _, err := crypto.GenHexKeys()
+	if err != nil {
+		t.Fatalf("can't gen keys: %s", err)
+	}
+	setFullNode(t, nodePublic)
+
+	blocks := make([][]byte, 0, count)
+	start := time.Now().Unix() - 2*count
+	prevHeader := &utils.BlockData{}
+	for blockID := int64(1); blockID <= count; blockID++ {
+		// the first block has no sign
+		var key string
+		switch blockID {
+		case 1:
+		case bad:
+			key = otherKey
+		default:
+			key = nodeKey
+		}
+		header := &utils.BlockData{BlockID: blockID, Time: start + 2*blockID, KeyID: 1, Version: consts.BLOCK_VERSION}
+		blockBin, err := parser.MarshallBlock(header, nil, prevHeader.Hash, key)
+		if err != nil {
+			t.Fatalf("can't marshal block: %s", err)
+		}
+		block, err := parser.ParseBlock(blockBin)
+		if err != nil {
+			t.Fatalf("can't parse block: %s", err)
+		}
+		block.PrevHeader = prevHeader
+		if block.Header.Hash, err = blockHash(block); err != nil {
+			t.Fatalf("can't hash block: %s", err)
+		}
+		prevHeader = &block.Header
+		blocks = append(blocks, blockBin)
+	}
+	return blocks, prevHeader.Hash
+}
+
+func TestVerifyBlockRange(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	for _, table := range []interface{}{&model.SystemParameter{}, &model.Block{}} {
+		if err = db.CreateTable(table).Error; err != nil {
+			t.Fatalf("can't create table: %s", err)
+		}
+	}
+	defer resetFullNodes(t)
+
+	blocks, _ := signedChain(t, 4, 0)
+	prevHeader := &utils.BlockData{}
+	for _, blockBin := range blocks {
+		block, err := parser.ParseBlock(blockBin)
+		if err != nil {
+			t.Fatalf("can't parse block: %s", err)
+		}
+		block.PrevHeader = prevHeader
+		if block.Header.Hash, err = blockHash(block); err != nil {
+			t.Fatalf("can't hash block: %s", err)
+		}
+		stored := &model.Block{ID: block.Header.BlockID, Hash: block.Header.Hash, Data: blockBin,
+			EcosystemID: block.Header.EcosystemID, KeyID: block.Header.KeyID, Time: block.Header.Time}
+		// the stored hash of the third block and the data of the fourth block are corrupted
+		switch block.Header.BlockID {
+		case 3:
+			stored.Hash = []byte{1, 2, 3}
+		case 4:
+			stored.Data = []byte("broken")
+		}
+		if err = db.Create(stored).Error; err != nil {
+			t.Fatalf("can't create block: %s", err)
+		}
+		prevHeader = &block.Header
+	}
+
+	results, err := VerifyBlockRange(2, 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := []BlockVerifyResult{{BlockID: 2, Valid: true}, {BlockID: 3, Check: VerifyCheckStoredHash},
+		{BlockID: 4, Check: VerifyCheckProcess}, {BlockID: 5, Check: VerifyCheckRead}}
+	if len(results) != len(want) {
+		t.Fatalf("wrong results %+v", results)
+	}
+	for i, res := range results {
+		if res.BlockID != want[i].BlockID || res.Valid != want[i].Valid || res.Check != want[i].Check ||
+			res.Valid != (res.Error == nil) {
+			t.Errorf("wrong result %+v, want %+v", res, want[i])
+		}
+	}
+
+	if _, err = VerifyBlockRange(3, 2); err == nil {
+		t.Error("wrong range must fail")
+	}
+}
+
+// setFullNode writes the system parameters of the blocks with the only full node which has key id 1
+func setFullNode(t *testing.T, nodePublic string) {
+	params := map[string]string{syspar.MaxBlockSize: "100000", syspar.GapsBetweenBlocks: "2",
+		syspar.MaxBlockUserTx: "100", syspar.FullNodes: `[["127.0.0.1","1","` + nodePublic + `"]]`}
+	var id int64
+	for name, value := range params {
+		id++
+		if err := model.DBConn.Create(&model.SystemParameter{ID: id, Name: name, Value: value}).Error; err != nil {
+			t.Fatalf("can't create system parameter: %s", err)
+		}
+	}
+	if err := syspar.SysUpdate(nil); err != nil {
+		t.Fatalf("can't update system parameters: %s", err)
+	}
+}
+
+// resetFullNodes clears the full nodes which have been set by signedChain
+func resetFullNodes(t *testing.T) {
+	err := model.DBConn.Model(&model.SystemParameter{}).Where("name = ?", syspar.FullNodes).Update("value", "").Error
+	if err != nil {
+		t.Fatalf("can't clear system parameters: %s", err)
+	}
+	if err := syspar.SysUpdate(nil); err != nil {
+		t.Fatalf("can't update system parameters: %s", err)
+	}
+}
+
+func TestScanChainFileBadBlock(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("gorm init failed: %s", err)
+	}
+	defer db.Close()
+	model.DBConn = db
+
+	if err = db.CreateTable(&model.SystemParameter{}).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
+	}
+	defer resetFullNodes(t)
+
+	file, err := ioutil.TempFile("", "blockchain")
+	if err != nil {
+		t.Fatalf("can't create file: %s", err)
+	}
+	file.Close()
+	fileName := file.Name()
+	defer os.Remove(fileName)
+
+	blocks, _ := signedChain(t, 6, 3)
+	writeChain := func() {
+		var chain []byte
+		for id, block := range blocks {
+			chain = append(chain, marshallFileBlock(blockData{ID: int64(id + 1), Data: block})...)
+		}
+		if err = ioutil.WriteFile(fileName, chain, 0600); err != nil {
+			t.Fatalf("can't write to file: %s", err)
+		}
+	}
+
+	// the blocks after the bad one are checked against it, so only the bad block is reported
+	writeChain()
+	failed, err := ScanChainFile(context.Background(), fileName)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(failed) != 1 || failed[0].BlockID != 3 || failed[0].Check != VerifyCheckBlock {
+		t.Errorf("wrong failures %+v", failed)
+	}
+
+	// the block after the block which can't be parsed can't be linked, the blocks after it aren't reported
+	blocks[2] = []byte("broken")
+	writeChain()
+	if failed, err = ScanChainFile(context.Background(), fileName); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(failed) != 2 || failed[0].BlockID != 3 || failed[0].Check != VerifyCheckProcess ||
+		failed[1].BlockID != 4 || failed[1].Check != VerifyCheckChain {
+		t.Errorf("wrong failures %+v", failed)
+	}
+}
@@ -134,7 +134,7 @@ func generateNextBlock(
 
 	header := &utils.BlockData{
 		BlockID:      prevBlock.BlockID + 1,
-		Time:         time.Now().Unix(),
+		Time:         blockTime,
 		EcosystemID:  ecosystemID,
 		KeyID:        keyID,
 		NodePosition: myNodePosition,
@@ -23,47 +23,53 @@
 package daemons
 
 import (
+	"bytes"
 	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
-	"github.com/GenesisKernel/go-genesis/packages/model"
-
+	"github.com/GenesisKernel/go-genesis/packages/conf"
+	"github.com/GenesisKernel/go-genesis/packages/consts"
+	"github.com/GenesisKernel/go-genesis/packages/converter"
 	"github.com/GenesisKernel/go-genesis/packages/crypto"
+	"github.com/GenesisKernel/go-genesis/packages/model"
+	"github.com/GenesisKernel/go-genesis/packages/parser"
 	"github.com/GenesisKernel/go-genesis/packages/utils"
 )
 
 func TestBlockMarshall(t *testing.T) {
 	prevBlock := &model.InfoBlock{BlockID: 1}
 
-	_, priv, err := crypto.GenHexKeys()
+	priv, _, err := crypto.GenHexKeys()
 	if err != nil {
 		t.Fatalf("can't gen keys: %s", err)
 	}
 
 	blockTime := time.Now().Unix() - 100
-	conf := &model.Config{
-		StateID:     1,
-		DltWalletID: 100,
-	}
+	var ecosystemID, keyID int64 = 1, 100
 
-	blockBin, err := generateNextBlock(prevBlock, nil, priv, conf, blockTime)
+	blockBin, err := generateNextBlock(prevBlock, nil, priv, blockTime, 0, ecosystemID, keyID)
 	if err != nil {
 		t.Fatalf("generateNextBlock error: %s", err)
 	}
 
-	block := blockBin[1:] // skip type
-	data := utils.ParseBlockHeader(&block)
+	data, err := parser.ParseBlockHeader(bytes.NewBuffer(blockBin))
+	if err != nil {
+		t.Fatalf("ParseBlockHeader error: %s", err)
+	}
 	if data.BlockID != 2 {
 		t.Errorf("bad block_id: want 2, got %d", data.BlockID)
 	}
 
-	if data.WalletID != conf.DltWalletID {
-		t.Errorf("bad wallet value: want %d, got %d", conf.DltWalletID, data.WalletID)
+	if data.KeyID != keyID {
+		t.Errorf("bad key value: want %d, got %d", keyID, data.KeyID)
 	}
 
-	if data.StateID != conf.StateID {
-		t.Errorf("bad state id: want %d, got %d", conf.StateID, data.StateID)
+	if data.EcosystemID != ecosystemID {
+		t.Errorf("bad ecosystem id: want %d, got %d", ecosystemID, data.EcosystemID)
 	}
 
 	if data.Time != blockTime {
@@ -72,68 +78,89 @@ func TestBlockMarshall(t *testing.T) {
 }
 
 func TestBlockGenerator(t *testing.T) {
-
 	db := initGorm(t)
-
-	config := &model.Config{
-		DltWalletID: 1000,
-		StateID:     1,
-		CitizenID:   100,
+	defer db.Close()
+	for _, table := range []interface{}{&model.SystemParameter{}, &model.TransactionStatus{}, &model.QueueTx{}} {
+		if err := db.CreateTable(table).Error; err != nil {
+			t.Fatalf("can't create table: %s", err)
+		}
 	}
-	if err := config.Save(); err != nil {
-		t.Fatalf("can't save config: %s", err)
+	// the data of the rollbacks is jsonb in postgres
+	if err := db.Exec(`CREATE TABLE "rollback_tx" ("id" integer primary key, "block_id" integer, "tx_hash" blob,
+		"table_name" text, "table_id" text, "data" text)`).Error; err != nil {
+		t.Fatalf("can't create table: %s", err)
 	}
+	defer resetFullNodes(t)
 
-	nodes := &model.FullNode{
-		ID:       1,
-		WalletID: 1000,
-		StateID:  1,
-	}
-	if err := nodes.Create(nil); err != nil {
-		t.Fatalf("can't create full_nodes config: %s", err)
-	}
+	defer func(cfg conf.SavedConfig) { conf.Config = cfg }(conf.Config)
+	conf.Config.KeyID = 1000
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	d := createDaemon(db.DB())
 
-	prevBlock := &model.InfoBlock{
-		StateID:  1,
-		WalletID: 1000,
-		BlockID:  2,
-		Time:     time.Now().Unix() - 100,
-		Hash:     []byte("ttt"),
+	// the node which isn't in the full nodes list doesn't generate blocks and waits longer
+	err := BlockGenerator(ctx, d)
+	if err != nil {
+		t.Fatalf("block generator return: %s", err)
 	}
-	if err := prevBlock.Create(nil); err != nil {
-		t.Fatalf("can't create prevBlock value: %s", err)
+	if d.sleepTime != 10*time.Second {
+		t.Errorf("bad sleep time: want %v, got %v", 10*time.Second, d.sleepTime)
+	}
+	bl := &model.Block{}
+	if found, err := bl.GetMaxBlock(); err != nil || found {
+		t.Errorf("block must not be generated: %d %v", bl.ID, err)
 	}
 
-	_, public, err := crypto.GenBytesKeys()
+	// the full node generates the next block with the transaction
+	nodeKey, nodePublic, err := crypto.GenHexKeys()
 	if err != nil {
 		t.Fatalf("can't gen keys: %s", err)
 	}
-
-	wallet := &model.DltWallet{
-		WalletID:      1000,
-		PublicKey:     public,
-		NodePublicKey: public,
+	setFullNode(t, nodePublic)
+	conf.Config.KeyID = 1
+	if conf.Config.PrivateDir, err = ioutil.TempDir("", "private"); err != nil {
+		t.Fatalf("can't create private dir: %s", err)
 	}
-	if err := wallet.Create(nil); err != nil {
-		t.Fatalf("can't create wallet: %s", err)
+	defer os.RemoveAll(conf.Config.PrivateDir)
+	if err = ioutil.WriteFile(filepath.Join(conf.Config.PrivateDir, consts.NodePrivateKeyFilename), []byte(nodeKey), 0600); err != nil {
+		t.Fatalf("can't write node key: %s", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
-	d := createDaemon(db.DB())
+	prevBlock := &utils.BlockData{BlockID: 1, Time: time.Now().Unix() - 100, KeyID: 1, Version: consts.BLOCK_VERSION}
+	blockBin, err := parser.MarshallBlock(prevBlock, nil, nil, "")
+	if err != nil {
+		t.Fatalf("can't marshal block: %s", err)
+	}
+	if err = parser.InsertBlockWOForks(blockBin); err != nil {
+		t.Fatalf("can't insert block: %s", err)
+	}
 
-	err = BlockGenerator(d, ctx)
+	var tx []byte
+	if _, err = converter.BinMarshal(&tx, &consts.FirstBlock{
+		TxHeader: consts.TxHeader{Type: 1, Time: uint32(time.Now().Unix()), KeyID: 1},
+		Host:     "127.0.0.1",
+	}); err != nil {
+		t.Fatalf("can't marshal transaction: %s", err)
+	}
+	hash, err := crypto.Hash(tx)
 	if err != nil {
+		t.Fatalf("can't hash transaction: %s", err)
+	}
+	if err = db.Create(&model.Transaction{Hash: hash, Data: tx, Type: 1, KeyID: 1, Verified: 1}).Error; err != nil {
+		t.Fatalf("can't create transaction: %s", err)
+	}
+
+	if err = BlockGenerator(ctx, d); err != nil {
 		t.Fatalf("block generator return: %s", err)
 	}
 
-	bl := &model.Block{}
-	err = bl.GetMaxBlock()
+	bl = &model.Block{}
+	found, err := bl.GetMaxBlock()
 	if err != nil {
 		t.Fatalf("can't get block: %s", err)
 	}
-
-	if bl.ID != prevBlock.BlockID+1 {
+	if !found || bl.ID != prevBlock.BlockID+1 {
 		t.Errorf("bad block_id: wanted %d, got %d", prevBlock.BlockID+1, bl.ID)
 	}
 }
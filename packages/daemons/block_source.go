@@ -0,0 +1,73 @@
+// MIT License
+//
+// Copyright (c) 2016-2018 GenesisKernel
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemons
+
+import (
+	"fmt"
+
+	"github.com/GenesisKernel/go-genesis/packages/config/syspar"
+	"github.com/GenesisKernel/go-genesis/packages/consts"
+	"github.com/GenesisKernel/go-genesis/packages/utils"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BlockSource is the source of the blocks for BlocksCollection
+type BlockSource interface {
+	// GetBlock returns the binary data of the block with the specified id
+	GetBlock(id int64) ([]byte, error)
+	// MaxBlockID returns the id of the last block which the source has
+	MaxBlockID() (int64, error)
+}
+
+// CustomBlockSource replaces the peers of the network as the source of the blocks for BlocksCollection
+// if it isn't nil. It should be set before the daemons are started. The custom source isn't banned and
+// can't resolve the forks, so the blocks of the source must continue the local blockchain.
+// If the source implements fmt.Stringer, the result of String is used in the logs
+var CustomBlockSource BlockSource
+
+// peerSource is the default block source which gets the blocks from the peer over TCP
+type peerSource struct {
+	host   string
+	logger *log.Entry
+}
+
+func (p *peerSource) GetBlock(id int64) ([]byte, error) {
+	return utils.GetBlockBody(p.host, id, consts.DATA_TYPE_BLOCK_BODY, syspar.GetMaxBlockSize())
+}
+
+func (p *peerSource) MaxBlockID() (int64, error) {
+	return getHostBlockID(p.host, p.logger)
+}
+
+func (p *peerSource) String() string {
+	return p.host
+}
+
+// sourceName returns the name of the block source for the logs
+func sourceName(source BlockSource) string {
+	if s, ok := source.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", source)
+}
@@ -23,14 +23,23 @@
 package daemons
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/GenesisKernel/go-genesis/packages/conf"
 	"github.com/GenesisKernel/go-genesis/packages/config/syspar"
@@ -38,14 +47,79 @@ import (
 	"github.com/GenesisKernel/go-genesis/packages/converter"
 	"github.com/GenesisKernel/go-genesis/packages/model"
 	"github.com/GenesisKernel/go-genesis/packages/parser"
+	"github.com/GenesisKernel/go-genesis/packages/statsd"
 	"github.com/GenesisKernel/go-genesis/packages/utils"
 
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/net/context/ctxhttp"
 )
 
+// ErrChainUpdateStopped is returned by UpdateChain when the context has been cancelled between blocks.
+// All blocks played before the stop are committed completely
+var ErrChainUpdateStopped = errors.New("chain updating has been stopped")
+
+// ErrBlockTimeout is returned by UpdateChain when the block is not played in BlockTimeout
+var ErrBlockTimeout = errors.New("block processing timeout")
+
+// ErrBlockTooSmall is returned by UpdateChain when the host sends the block smaller than MinBlockSize
+var ErrBlockTooSmall = errors.New("block is smaller than the min block size")
+
+// ErrDownloadStalled is returned by downloadToFile when no data is received for downloadIdleTimeout
+var ErrDownloadStalled = errors.New("no data of the download is received in time")
+
+// downloadIdleTimeout is the max time without the received data of the download of the blockchain file
+var downloadIdleTimeout = consts.DOWNLOAD_CHAIN_TIMEOUT * time.Second
+
+// ErrTipHashMismatch is returned by loadFromFile when the hash of the last block of the file differs from the expected one
+var ErrTipHashMismatch = errors.New("hash of the last block of the file does not match the expected hash")
+
+// OnFork is called by UpdateChain after the local blocks have been successfully replaced with the blocks
+// of the host in the case of fork. blockID is the id of the block which revealed the fork and rolledBack
+// is the count of the rolled back local blocks. It is called in the goroutine of the daemon, nil disables it
+var OnFork func(blockID int64, host string, rolledBack int)
+
+// OnBlockApplied is called by UpdateChain after each block has been successfully played and committed.
+// It isn't called for the failed blocks and for the blocks which replaced the local ones in the case of fork.
+// It is called synchronously in the goroutine of the daemon, so the slow callback slows down the synchronization
+// and should pass the work to another goroutine. nil disables it
+var OnBlockApplied func(blockID int64)
+
+// OnBlockStages is called by UpdateChain after each successfully played block with the durations of the stages
+// of its processing: the receiving from the source, the parsing, the validation and the play. The resolution
+// of the fork isn't included. It is called in the goroutine of the daemon, nil disables it and the measurement
+var OnBlockStages func(blockID int64, fetch, parse, validate, play time.Duration)
+
+var (
+	// collectionCycle is locked while the cycle of BlocksCollection is running
+	collectionCycle  sync.Mutex
+	collectionPaused int32
+)
+
+// PauseBlocksCollection stops the collection of blocks, e.g. for the maintenance of the database.
+// It waits for the running cycle, so no blocks are played and DBLock isn't held by BlocksCollection
+// after it returns. The daemon keeps sleeping between the cycles until ResumeBlocksCollection is called
+func PauseBlocksCollection() {
+	atomic.StoreInt32(&collectionPaused, 1)
+	collectionCycle.Lock()
+	collectionCycle.Unlock()
+	log.WithFields(log.Fields{"daemon_name": "BlocksCollection"}).Info("blocks collection is paused")
+}
+
+// ResumeBlocksCollection resumes the collection of blocks paused by PauseBlocksCollection
+func ResumeBlocksCollection() {
+	atomic.StoreInt32(&collectionPaused, 0)
+	log.WithFields(log.Fields{"daemon_name": "BlocksCollection"}).Info("blocks collection is resumed")
+}
+
 // BlocksCollection collects and parses blocks
 func BlocksCollection(ctx context.Context, d *daemon) error {
+	collectionCycle.Lock()
+	defer collectionCycle.Unlock()
+	if atomic.LoadInt32(&collectionPaused) == 1 {
+		d.logger.Debug("blocks collection is paused")
+		return nil
+	}
+	nodesBan.refresh(time.Now())
+
 	if err := initialLoad(ctx, d); err != nil {
 		return err
 	}
@@ -58,6 +132,13 @@ func BlocksCollection(ctx context.Context, d *daemon) error {
 	return blocksCollection(ctx, d)
 }
 
+// collectionJitter returns the max random delays of the first cycle and of the pauses between
+// the cycles of BlocksCollection from the config
+func collectionJitter() (time.Duration, time.Duration) {
+	return time.Duration(conf.Config.SyncStartJitter) * time.Millisecond,
+		time.Duration(conf.Config.SyncJitter) * time.Millisecond
+}
+
 func initialLoad(ctx context.Context, d *daemon) error {
 
 	// check for initial load
@@ -68,6 +149,8 @@ func initialLoad(ctx context.Context, d *daemon) error {
 
 	if toLoad {
 		d.logger.Debug("start first block loading")
+		syncStatus.setInitialLoad(true)
+		defer syncStatus.setInitialLoad(false)
 
 		if err := firstLoad(ctx, d); err != nil {
 			return err
@@ -79,14 +162,6 @@ func initialLoad(ctx context.Context, d *daemon) error {
 
 func blocksCollection(ctx context.Context, d *daemon) error {
 
-	hosts := syspar.GetRemoteHosts()
-
-	// get a host with the biggest block id
-	host, maxBlockID, err := chooseBestHost(ctx, hosts, d.logger)
-	if err != nil {
-		return err
-	}
-
 	// NOTE: should be generalized in separate method
 	infoBlock := &model.InfoBlock{}
 	found, err := infoBlock.Get()
@@ -98,70 +173,162 @@ func blocksCollection(ctx context.Context, d *daemon) error {
 		log.WithFields(log.Fields{"type": consts.NotFound, "error": err}).Error("Info block not found")
 		return errors.New("Info block not found")
 	}
+	syncStatus.setBlockID(infoBlock.BlockID)
+
+	var (
+		source     BlockSource
+		candidates []rankedHost
+		maxBlockID int64
+	)
+	if CustomBlockSource != nil {
+		source = CustomBlockSource
+		if maxBlockID, err = source.MaxBlockID(); err != nil {
+			d.logger.WithFields(log.Fields{"type": consts.BlockError, "error": err, "host": sourceName(source)}).Error("getting max block id")
+			return err
+		}
+	} else {
+		// get a host with the biggest block id, the cached block ids are not used while we are catching up
+		catchUp := hostBlocks.maxBlockID() > infoBlock.BlockID
+		hosts := syncHosts(syspar.GetRemoteHosts())
+		ranked, probes, err := probeHosts(ctx, hosts, catchUp, d.logger)
+		if err != nil {
+			return err
+		}
+		syncStatus.setHosts(probes)
+		maxBlockID = -1
+		if len(ranked) > 0 {
+			source, maxBlockID = &peerSource{host: ranked[0].host, logger: d.logger}, ranked[0].blockID
+			candidates = ranked[1:]
+			d.logger.WithFields(log.Fields{"host": ranked[0].host, "block_id": maxBlockID, "latency": ranked[0].latency.String(),
+				"candidates": len(candidates)}).Debug("host is chosen")
+		}
+	}
+	syncStatus.setMaxBlockID(maxBlockID)
 
 	if infoBlock.BlockID >= maxBlockID {
-		log.WithFields(log.Fields{"blockID": infoBlock.BlockID, "maxBlockID": maxBlockID}).Debug("Max block is already in the host")
+		d.logger.WithFields(log.Fields{"block_id": infoBlock.BlockID, "max_block_id": maxBlockID}).Debug("max block is already in the host")
+		syncStatus.cycleDone()
 		return nil
 	}
 
 	DBLock()
 	defer DBUnlock()
-	// update our chain till maxBlockID from the host
-	return UpdateChain(ctx, d, host, maxBlockID)
+	// update our chain till maxBlockID from the source
+	if err = updateChain(ctx, d, source, candidates, maxBlockID); err != nil {
+		return err
+	}
+	syncStatus.cycleDone()
+	return nil
 }
 
-// best host is a host with the biggest last block ID
-func chooseBestHost(ctx context.Context, hosts []string, logger *log.Entry) (string, int64, error) {
-	type blockAndHost struct {
-		host    string
-		blockID int64
-		err     error
+// syncHosts returns the hosts to collect blocks from. If SyncPeers is set it replaces the remote full nodes
+// or, with SyncPeersIntersect, only the peers which are in the full nodes list are used
+func syncHosts(remoteHosts []string) []string {
+	if len(strings.TrimSpace(conf.Config.SyncPeers)) == 0 {
+		return remoteHosts
 	}
-	c := make(chan blockAndHost, len(hosts))
+	remote := make(map[string]bool, len(remoteHosts))
+	for _, host := range remoteHosts {
+		remote[host] = true
+	}
+	hosts := make([]string, 0)
+	for _, host := range strings.Split(conf.Config.SyncPeers, ",") {
+		host = strings.TrimSpace(host)
+		if len(host) == 0 || (conf.Config.SyncPeersIntersect && !remote[host]) {
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		log.WithFields(log.Fields{"type": consts.EmptyObject, "sync_peers": conf.Config.SyncPeers}).Warning("there are no hosts from sync peers")
+	}
+	return hosts
+}
+
+// chooseBestHost returns the hosts ranked by their last block IDs, the host with the lower latency is preferred
+// if the block ids are equal. The hosts which have failed the probe are not returned. The block ids are cached
+// and are requested from the hosts again only if refresh is true or the cached values are expired
+func chooseBestHost(ctx context.Context, hosts []string, refresh bool, logger *log.Entry) ([]rankedHost, error) {
+	ranked, _, err := probeHosts(ctx, hosts, refresh, logger)
+	return ranked, err
+}
+
+// probeHosts works like chooseBestHost but also returns the outcomes of the probes of all hosts
+// in the order of hosts. The banned, own and malformed hosts are not probed
+func probeHosts(ctx context.Context, hosts []string, refresh bool, logger *log.Entry) ([]rankedHost, []HostProbe, error) {
+	hosts = filterBannedHosts(excludeSelf(resolveHosts(hosts), logger))
+	probes := make([]HostProbe, len(hosts))
 
 	var wg sync.WaitGroup
-	for _, h := range hosts {
+	for i, h := range hosts {
 		if ctx.Err() != nil {
 			logger.WithFields(log.Fields{"error": ctx.Err(), "type": consts.ContextError}).Error("context error")
-			return "", 0, ctx.Err()
+			return nil, nil, ctx.Err()
 		}
 		wg.Add(1)
 
-		go func(host string) {
-			blockID, err := getHostBlockID(host, logger)
-			wg.Done()
+		go func(i int, host string) {
+			defer wg.Done()
+			info, err := getCachedHostBlockID(host, refresh, logger)
+			probes[i] = HostProbe{Host: host, BlockID: info.blockID, Latency: info.latency, Error: err}
+		}(i, h)
+	}
+	wg.Wait()
 
-			c <- blockAndHost{
-				host:    host,
-				blockID: blockID,
-				err:     err,
+	ranked := make([]rankedHost, 0, len(hosts))
+	for _, probe := range probes {
+		// the hosts which have failed the probe are skipped
+		if probe.Error != nil {
+			if probe.Error == utils.ErrProtocolVersion {
+				banNode(logger, probe.Host, banIncompatible, probe.Error)
 			}
-		}(getHostPort(h))
+			continue
+		}
+		ranked = append(ranked, rankedHost{host: probe.Host,
+			hostBlockInfo: hostBlockInfo{blockID: probe.BlockID, latency: probe.Latency}})
 	}
-	wg.Wait()
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].blockID != ranked[j].blockID {
+			return ranked[i].blockID > ranked[j].blockID
+		}
+		return ranked[i].latency < ranked[j].latency
+	})
 
-	maxBlockID := int64(-1)
-	var bestHost string
-	for i := 0; i < len(hosts); i++ {
-		bl := <-c
+	return ranked, probes, nil
+}
 
-		if bl.blockID > maxBlockID {
-			maxBlockID = bl.blockID
-			bestHost = bl.host
+// nextCandidate returns the first of the ranked candidates which has blockID and hasn't failed or been banned.
+// The other cached hosts are used if there is no such candidate
+func nextCandidate(candidates []rankedHost, blockID int64, failedHosts map[string]bool) (string, int64, bool) {
+	for _, candidate := range candidates {
+		if candidate.blockID >= blockID && !failedHosts[candidate.host] && !nodesBan.isBanned(candidate.host) {
+			return candidate.host, candidate.blockID, true
 		}
 	}
-
-	return bestHost, maxBlockID, nil
+	return hostBlocks.nextBestHost(blockID, failedHosts)
 }
 
 func getHostBlockID(host string, logger *log.Entry) (int64, error) {
-	conn, err := utils.TCPConn(host)
+	conn, err := utils.TCPConnBackoff(host)
 	if err != nil {
 		logger.WithFields(log.Fields{"error": err, "type": consts.ConnectionError, "host": host}).Debug("error connecting to host")
 		return 0, err
 	}
 	defer conn.Close()
 
+	// the host of the previous release closes the connection after the handshake,
+	// so the request is sent to it on the new connection without the handshake
+	if err = utils.Handshake(conn, host); err == utils.ErrNoHandshake {
+		conn.Close()
+		if conn, err = utils.TCPConnBackoff(host); err != nil {
+			logger.WithFields(log.Fields{"error": err, "type": consts.ConnectionError, "host": host}).Debug("error connecting to host")
+			return 0, err
+		}
+		defer conn.Close()
+	} else if err != nil {
+		return 0, err
+	}
+
 	// get max block request
 	_, err = conn.Write(converter.DecToBin(consts.DATA_TYPE_MAX_BLOCK_ID, 2))
 	if err != nil {
@@ -182,6 +349,34 @@ func getHostBlockID(host string, logger *log.Entry) (int64, error) {
 
 // UpdateChain load from host all blocks from our last block to maxBlockID
 func UpdateChain(ctx context.Context, d *daemon, host string, maxBlockID int64) error {
+	return updateChain(ctx, d, &peerSource{host: host, logger: d.logger}, nil, maxBlockID)
+}
+
+// waitBlockTime waits until the local time reaches the time of the block
+func waitBlockTime(ctx context.Context, blockTime, now int64) error {
+	if blockTime <= now {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(blockTime-now) * time.Second):
+		return nil
+	}
+}
+
+// updateChain loads from the source all blocks from our last block to maxBlockID. Only the peers
+// are banned for the bad blocks and are replaced with other peers, the forks are resolved only with the peers.
+// If the peer fails to send the block, the next of the ranked candidates continues from the same block
+func updateChain(ctx context.Context, d *daemon, source BlockSource, candidates []rankedHost, maxBlockID int64) error {
+	host := sourceName(source)
+	_, isPeer := source.(*peerSource)
+	var blockID int64
+	ban := func(category banCategory, err error) {
+		if isPeer {
+			banNode(d.logger.WithFields(log.Fields{"block_id": blockID}), host, category, err)
+		}
+	}
 
 	// get current block id from our blockchain
 	curBlock := &model.InfoBlock{}
@@ -189,26 +384,97 @@ func UpdateChain(ctx context.Context, d *daemon, host string, maxBlockID int64)
 		d.logger.WithFields(log.Fields{"type": consts.DBError, "error": err}).Error("Getting info block")
 		return err
 	}
+	checkBlockGap(d.logger, host, curBlock.BlockID, maxBlockID)
+	if limited := cycleMaxBlockID(curBlock.BlockID, maxBlockID); limited < maxBlockID {
+		d.logger.WithFields(log.Fields{"block_id": curBlock.BlockID, "max_block_id": maxBlockID,
+			"limit": limited - curBlock.BlockID}).Info("blocks of the cycle are limited, the rest is played by the next cycle")
+		maxBlockID = limited
+	}
 
-	for blockID := curBlock.BlockID + 1; blockID <= maxBlockID; blockID++ {
+	var failovers int
+	failedHosts := make(map[string]bool)
+	progress := newCatchUpReporter(curBlock.BlockID, maxBlockID, d.logger)
+	onStages := OnBlockStages
+	stages := stageTimer{enabled: onStages != nil}
+	for blockID = curBlock.BlockID + 1; blockID <= maxBlockID; blockID++ {
+		// every block is played in its own db transaction by PlayBlockSafe,
+		// so we can stop only between blocks
 		if ctx.Err() != nil {
-			d.logger.WithFields(log.Fields{"type": consts.ContextError, "error": ctx.Err()}).Error("context error")
-			return ctx.Err()
+			d.logger.WithFields(log.Fields{"type": consts.ContextError, "error": ctx.Err(), "last_block_id": blockID - 1,
+				"max_block_id": maxBlockID}).Info("chain updating stopped")
+			return ErrChainUpdateStopped
 		}
 
-		blockBin, err := utils.GetBlockBody(host, blockID, consts.DATA_TYPE_BLOCK_BODY)
+		stages.start()
+		blockBin, err := source.GetBlock(blockID)
 		if err != nil {
-			d.logger.WithFields(log.Fields{"error": err, "type": consts.BlockError}).Error("getting block body")
-			return err
+			d.logger.WithFields(log.Fields{"error": err, "type": consts.BlockError, "host": host}).Error("getting block body")
+			// the host is not available or has sent too big block,
+			// continue from the same block with the next best host.
+			// The host which reconnection is delayed isn't banned, it hasn't been requested
+			switch err {
+			case utils.ErrBlockSize:
+				ban(banVerification, err)
+			case utils.ErrBackoff:
+			default:
+				ban(banTransient, err)
+			}
+			if !isPeer {
+				return err
+			}
+			failedHosts[host] = true
+			if failovers >= consts.MaxBlockFailovers {
+				return err
+			}
+			nextHost, nextMaxBlockID, ok := nextCandidate(candidates, blockID, failedHosts)
+			if !ok {
+				return err
+			}
+			failovers++
+			d.logger.WithFields(log.Fields{"type": consts.BlockError, "host": host, "next_host": nextHost,
+				"block_id": blockID}).Warning("switching to another host")
+			host = nextHost
+			source = &peerSource{host: nextHost, logger: d.logger}
+			if nextMaxBlockID < maxBlockID {
+				maxBlockID = nextMaxBlockID
+				progress.maxBlockID = maxBlockID
+			}
+			blockID--
+			continue
 		}
 
-		block, err := parser.ProcessBlockWherePrevFromBlockchainTable(blockBin)
+		fetch := stages.next()
+		block, err := processBlock(blockBin, syspar.GetMaxBlockSize())
 		if err != nil {
 			// we got bad block and should ban this host
-			banNode(host, err)
+			ban(banVerification, err)
 			d.logger.WithFields(log.Fields{"error": err, "type": consts.BlockError}).Error("processing block")
 			return err
 		}
+		parse := stages.next()
+
+		// the host could send another block instead of the requested one
+		if block.Header.BlockID != blockID {
+			err = fmt.Errorf("host %s sent block %d instead of block %d", host, block.Header.BlockID, blockID)
+			ban(banVerification, err)
+			d.logger.WithFields(log.Fields{"type": consts.BlockError, "host": host, "block_id": blockID,
+				"received_block_id": block.Header.BlockID}).Error("wrong block id")
+			return err
+		}
+
+		// the block from the future is rejected before it can cause the rollback of the local blocks.
+		// The block which is ahead of the local time within conf.Config.BlockTimeDrift waits for its time,
+		// because CheckBlock doesn't allow any drift
+		now := time.Now().Unix()
+		if err = parser.CheckBlockTime(block.Header.Time, now, conf.Config.BlockTimeDrift); err != nil {
+			ban(banVerification, err)
+			d.logger.WithFields(log.Fields{"type": consts.BlockError, "host": host, "block_id": blockID,
+				"block_time": block.Header.Time, "drift": conf.Config.BlockTimeDrift}).Error("block from the future")
+			return err
+		}
+		if err = waitBlockTime(ctx, block.Header.Time, now); err != nil {
+			return err
+		}
 
 		// hash compare could be failed in the case of fork
 		hashMatched, thisErrIsOk := block.CheckHash()
@@ -216,14 +482,31 @@ func UpdateChain(ctx context.Context, d *daemon, host string, maxBlockID int64)
 			d.logger.WithFields(log.Fields{"error": err, "type": consts.BlockError}).Error("checking block hash")
 		}
 
+		if !hashMatched && !isPeer {
+			err = fmt.Errorf("block %d of %s doesn't continue the local blockchain", blockID, host)
+			d.logger.WithFields(log.Fields{"type": consts.BlockError, "host": host, "block_id": blockID}).Error("fork from block source")
+			return err
+		}
+		validate := stages.next()
 		if !hashMatched {
 			// it should be fork, replace our previous blocks to ones from the host
-			err := parser.GetBlocks(blockID-1, host)
+			d.logger.WithFields(log.Fields{"type": consts.BlockError, "host": host, "block_id": blockID}).Warning("fork is detected")
+			depth := forkDepth(blockID)
+			rolledBack, err := parser.GetBlocks(blockID-1, host, depth)
+			if err == parser.ErrForkTooDeep {
+				d.logger.WithFields(log.Fields{"type": consts.BlockError, "host": host, "block_id": blockID,
+					"max_depth": depth}).Error("fork is deeper than the max rollback depth, it is refused")
+			}
 			if err != nil {
 				d.logger.WithFields(log.Fields{"error": err, "type": consts.ParserError}).Error("processing block")
-				banNode(host, err)
+				// the errors of GetBlocks lose their types, so they are considered as the verification ones
+				ban(banVerification, err)
 				return err
 			}
+			d.logger.WithFields(log.Fields{"host": host, "block_id": blockID, "rolled_back": rolledBack}).Info("fork is resolved")
+			if onFork := OnFork; onFork != nil {
+				onFork(blockID, host, rolledBack)
+			}
 		} else {
 			/* TODO should we uncomment this ?????????????
 			_, err := model.MarkTransactionsUnverified()
@@ -233,48 +516,340 @@ func UpdateChain(ctx context.Context, d *daemon, host string, maxBlockID int64)
 			*/
 		}
 
+		stages.start()
+		// the errors of the local database aren't the faults of the host, so it isn't banned for them
 		block.PrevHeader, err = parser.GetBlockDataFromBlockChain(block.Header.BlockID - 1)
 		if err != nil {
-			banNode(host, err)
 			return utils.ErrInfo(fmt.Errorf("can't get block %d", block.Header.BlockID-1))
 		}
+		blockCtx, cancel := blockContext(ctx)
 		if err = block.CheckBlock(); err != nil {
-			banNode(host, err)
+			cancel()
+			ban(banVerification, err)
 			return err
 		}
-		if err = block.PlayBlockSafe(); err != nil {
-			banNode(host, err)
+		if err = checkCheckpoint(block, d.logger.WithFields(log.Fields{"host": host})); err != nil {
+			cancel()
+			ban(banVerification, err)
+			return err
+		}
+		validate += stages.next()
+		err = block.PlayBlockSafeContext(blockCtx)
+		cancel()
+		play := stages.next()
+		switch err {
+		case nil:
+		case context.DeadlineExceeded:
+			// the block isn't committed, so it is played again by the next cycle
+			d.logger.WithFields(log.Fields{"type": consts.BlockError, "host": host, "block_id": blockID,
+				"timeout": conf.Config.BlockTimeout}).Error("block processing timeout")
+			if statsd.Client != nil {
+				statsd.Client.Inc(statsd.DaemonCounterName("BlocksCollection")+statsd.BlockTimeout, 1, 1.0)
+			}
+			return ErrBlockTimeout
+		case context.Canceled:
+			d.logger.WithFields(log.Fields{"type": consts.ContextError, "error": err, "last_block_id": blockID - 1,
+				"max_block_id": maxBlockID}).Info("chain updating stopped")
+			return ErrChainUpdateStopped
+		default:
+			// the bad transactions are skipped by PlayBlockSafe, so its errors are local ones like the db errors
+			d.logger.WithFields(log.Fields{"type": consts.BlockError, "error": err, "host": host, "block_id": blockID}).Error("playing block")
 			return err
 		}
+		d.logger.WithFields(log.Fields{"host": host, "block_id": blockID}).Debug("block is applied")
+		syncStatus.setBlockID(blockID)
+		progress.report(blockID)
+		if onApplied := OnBlockApplied; onApplied != nil {
+			onApplied(blockID)
+		}
+		if onStages != nil {
+			onStages(blockID, fetch, parse, validate, play)
+		}
 	}
 	return nil
 }
 
-func downloadChain(ctx context.Context, fileName, url string, logger *log.Entry) error {
+// stageTimer measures the durations of the stages of the processing of the block, the time
+// isn't requested if it is disabled
+type stageTimer struct {
+	enabled bool
+	last    time.Time
+}
 
-	for i := 0; i < consts.DOWNLOAD_CHAIN_TRY_COUNT; i++ {
-		loadCtx, cancel := context.WithTimeout(ctx, 30)
-		defer cancel()
+// start starts the measurement of the next stage
+func (t *stageTimer) start() {
+	if t.enabled {
+		t.last = time.Now()
+	}
+}
+
+// next returns the duration of the current stage and starts the next one
+func (t *stageTimer) next() time.Duration {
+	if !t.enabled {
+		return 0
+	}
+	now := time.Now()
+	d := now.Sub(t.last)
+	t.last = now
+	return d
+}
+
+// blockContext returns the context for the check and the play of one block which is limited by BlockTimeout
+func blockContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout := conf.Config.BlockTimeout; timeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+	}
+	return context.WithCancel(ctx)
+}
+
+// cycleMaxBlockID returns the last block which can be played in one call of UpdateChain, the rest
+// of the blocks are played in the next cycles so the other daemons can get DBLock between them
+func cycleMaxBlockID(curBlockID, maxBlockID int64) int64 {
+	limit := conf.Config.MaxBlocksPerCycle
+	if limit == 0 {
+		limit = consts.MaxBlocksPerCycle
+	}
+	if limit > 0 && maxBlockID-curBlockID > limit {
+		return curBlockID + limit
+	}
+	return maxBlockID
+}
+
+// checkBlockGap reports the count of the missing blocks and warns if the node is badly behind the host
+func checkBlockGap(logger *log.Entry, host string, curBlockID, maxBlockID int64) {
+	gap := maxBlockID - curBlockID
+	if statsd.Client != nil {
+		statsd.Client.Gauge(statsd.DaemonCounterName("BlocksCollection")+statsd.BlockGap, gap, 1.0)
+	}
+
+	threshold := conf.Config.BlockGapWarning
+	if threshold <= 0 {
+		threshold = consts.BlockGapWarning
+	}
+	if gap > threshold {
+		logger.WithFields(log.Fields{"type": consts.BlockError, "host": host, "block_id": curBlockID,
+			"max_block_id": maxBlockID, "gap": gap}).Warning("node is badly behind, consider loading the blockchain from a file")
+	}
+}
+
+// maxForkDepth returns the max count of the blocks which can be received from the host in the case of fork.
+// It is the rb_blocks_1 system parameter if MaxForkDepth isn't set, and it never exceeds consts.MaxForkDepth
+func maxForkDepth() int64 {
+	depth := conf.Config.MaxForkDepth
+	if depth <= 0 {
+		depth = syspar.GetRbBlocks1()
+	}
+	if depth > consts.MaxForkDepth {
+		depth = consts.MaxForkDepth
+	}
+	return depth
+}
+
+// processBlock parses the block received from the host. The panics of the parser are converted
+// to errors, so the malformed block leads to the ban of the host instead of the crash of the daemon
+func processBlock(blockBin []byte, maxSize int64) (block *parser.Block, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithFields(log.Fields{"type": consts.PanicRecoveredError, "error": r}).Error("panic while processing block")
+			block, err = nil, fmt.Errorf("malformed block: %v", r)
+		}
+	}()
+
+	if len(blockBin) == 0 || int64(len(blockBin)) > maxSize {
+		log.WithFields(log.Fields{"type": consts.ParameterExceeded, "size": len(blockBin), "max_size": maxSize}).Error("wrong size of block")
+		return nil, fmt.Errorf("wrong block size %d", len(blockBin))
+	}
+	minSize := conf.Config.MinBlockSize
+	if minSize <= 0 {
+		minSize = consts.MinBlockSize
+	}
+	if int64(len(blockBin)) < minSize {
+		log.WithFields(log.Fields{"type": consts.SizeDoesNotMatch, "size": len(blockBin), "min_size": minSize}).Error("block is too small")
+		return nil, ErrBlockTooSmall
+	}
+	return parser.ProcessBlockWherePrevFromBlockchainTable(blockBin)
+}
+
+// ValidateChain checks the blocks from fromBlockID to toBlockID received from host without playing them.
+// The block fromBlockID-1 must be in the local blockchain, e.g. fromBlockID is the next block after
+// the last local block. It returns the ID of the first block which fails the validation and the reason
+// of the failure. Every block is checked against the header of the previous validated block kept in memory, so
+// the result is correct only if the validation doesn't depend on side effects of PlayBlockSafe
+// of the previous blocks (e.g. the changes of the full nodes list or system parameters)
+func ValidateChain(ctx context.Context, host string, fromBlockID, toBlockID int64) (int64, error) {
+	logger := log.WithFields(log.Fields{"host": host})
+	if fromBlockID < 2 || toBlockID < fromBlockID {
+		logger.WithFields(log.Fields{"type": consts.InvalidObject, "from": fromBlockID, "to": toBlockID}).Error("wrong range of blocks")
+		return fromBlockID, fmt.Errorf("wrong range of blocks [%d, %d]", fromBlockID, toBlockID)
+	}
+
+	var prevHeader *utils.BlockData
+	for blockID := fromBlockID; blockID <= toBlockID; blockID++ {
+		if ctx.Err() != nil {
+			logger.WithFields(log.Fields{"type": consts.ContextError, "error": ctx.Err()}).Error("context error")
+			return blockID, ctx.Err()
+		}
+
+		blockBin, err := utils.GetBlockBody(host, blockID, consts.DATA_TYPE_BLOCK_BODY, syspar.GetMaxBlockSize())
+		if err != nil {
+			logger.WithFields(log.Fields{"error": err, "type": consts.BlockError}).Error("getting block body")
+			return blockID, err
+		}
+
+		var block *parser.Block
+		if prevHeader == nil {
+			block, err = parser.ProcessBlockWherePrevFromBlockchainTable(blockBin)
+		} else {
+			block, err = parser.ProcessBlockWherePrevFromMemory(blockBin)
+		}
+		if err != nil {
+			logger.WithFields(log.Fields{"error": err, "type": consts.BlockError, "block_id": blockID}).Error("processing block")
+			return blockID, err
+		}
 
-		_, err := downloadToFile(loadCtx, url, fileName, logger)
+		// the previous block hasn't been played, so we must be sure that we check the expected block
+		if block.Header.BlockID != blockID {
+			logger.WithFields(log.Fields{"header_block_id": block.Header.BlockID, "block_id": blockID, "type": consts.InvalidObject}).Error("block ids does not match")
+			return blockID, fmt.Errorf("bad block id %d, expected %d", block.Header.BlockID, blockID)
+		}
+		if prevHeader != nil {
+			block.PrevHeader = prevHeader
+		}
+
+		hashMatched, err := block.CheckHash()
+		if err != nil {
+			logger.WithFields(log.Fields{"error": err, "type": consts.BlockError, "block_id": blockID}).Error("checking block hash")
+			return blockID, err
+		}
+		if !hashMatched {
+			logger.WithFields(log.Fields{"type": consts.BlockError, "block_id": blockID}).Error("block hash does not match")
+			return blockID, fmt.Errorf("block %d hash does not match", blockID)
+		}
+
+		if err = block.CheckBlock(); err != nil {
+			logger.WithFields(log.Fields{"error": err, "type": consts.BlockError, "block_id": blockID}).Error("checking block")
+			return blockID, err
+		}
+
+		block.Header.Hash, err = blockHash(block)
+		if err != nil {
+			logger.WithFields(log.Fields{"type": consts.CryptoError, "error": err}).Error("double hashing block")
+			return blockID, err
+		}
+		header := block.Header
+		prevHeader = &header
+	}
+	return 0, nil
+}
+
+func downloadChain(ctx context.Context, fileName, url string, logger *log.Entry) error {
+	prevSize := int64(-1)
+	var lastErr error
+	for i := 0; i < consts.DOWNLOAD_CHAIN_TRY_COUNT; i++ {
+		if ctx.Err() != nil {
+			logger.WithFields(log.Fields{"type": consts.ContextError, "error": ctx.Err()}).Error("context error")
+			return ctx.Err()
+		}
+		size, contentType, err := downloadToFile(ctx, url, fileName, logger)
 		if err != nil {
+			lastErr = err
+			logger.WithFields(log.Fields{"type": consts.NetworkError, "url": url, "attempt": i + 1, "error": err}).Warning("downloading blockchain, retrying")
 			continue
 		}
+		if size >= consts.BLOCKCHAIN_SIZE {
+			return nil
+		}
+		// the same small file again means that the url serves something else, e.g. an error page
+		if size == prevSize {
+			logger.WithFields(log.Fields{"type": consts.InvalidObject, "url": url, "size": size,
+				"content_type": contentType}).Error("downloaded blockchain is too small")
+			return fmt.Errorf("can't download blockchain from %s: got %d bytes of %s twice", url, size, contentType)
+		}
+		prevSize = size
+		lastErr = fmt.Errorf("got %d bytes of %s", size, contentType)
+	}
+	return fmt.Errorf("can't download blockchain from %s: %v", url, lastErr)
+}
+
+// blockchainMirrors returns the urls of the blockchain file from FirstLoadBlockchainURL
+// or the url from the system parameters if the config has no urls
+func blockchainMirrors() []string {
+	urls := make([]string, 0)
+	for _, url := range strings.Split(conf.Config.FirstLoadBlockchainURL, ",") {
+		if url = strings.TrimSpace(url); len(url) > 0 {
+			urls = append(urls, url)
+		}
+	}
+	if len(urls) == 0 {
+		if url := syspar.GetBlockchainURL(); len(url) > 0 {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// downloadChainMirrors downloads the blockchain from the first available mirror in the order of urls.
+// The next mirror is used if the download has failed or the checksum of the file doesn't match
+// FirstLoadBlockchainSHA256. It returns the url of the used mirror
+func downloadChainMirrors(ctx context.Context, fileName string, urls []string, logger *log.Entry) (string, error) {
+	if len(urls) == 0 {
+		logger.WithFields(log.Fields{"type": consts.EmptyObject}).Error("there are no blockchain urls")
+		return "", errors.New("there are no blockchain urls")
+	}
+	var err error
+	for _, url := range urls {
+		if err = downloadChain(ctx, fileName, url, logger); err == nil {
+			if err = checkFileChecksum(fileName, conf.Config.FirstLoadBlockchainSHA256); err == nil {
+				return url, nil
+			}
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		logger.WithFields(log.Fields{"type": consts.BlockError, "url": url, "error": err}).Warning("trying next blockchain mirror")
+	}
+	return "", err
+}
+
+// checkFileChecksum compares SHA256 of the file with the hex checksum, the empty checksum is not checked
+func checkFileChecksum(fileName, checksum string) error {
+	if len(checksum) == 0 {
+		return nil
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		log.WithFields(log.Fields{"type": consts.IOError, "error": err}).Error("opening blockchain file")
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		log.WithFields(log.Fields{"type": consts.IOError, "error": err}).Error("reading blockchain file")
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, checksum) {
+		log.WithFields(log.Fields{"type": consts.InvalidObject, "checksum": sum, "expected": checksum}).Error("wrong checksum of blockchain file")
+		return fmt.Errorf("checksum %s of blockchain file does not match %s", sum, checksum)
 	}
-	return fmt.Errorf("can't download blockchain from %s", url)
+	return nil
 }
 
-// init first block from file or from embedded value
-func loadFirstBlock(logger *log.Entry) error {
+// init first block from file or from embedded value, nothing is inserted if ctx is done
+func loadFirstBlock(ctx context.Context, logger *log.Entry) error {
 
 	newBlock, err := ioutil.ReadFile(*conf.FirstBlockPath)
 	if err != nil {
 		logger.WithFields(log.Fields{
 			"type": consts.IOError, "error": err, "path": *conf.FirstBlockPath,
 		}).Error("reading first block from file")
+		return err
 	}
 
-	if err = parser.InsertBlockWOForks(newBlock); err != nil {
+	if ctx.Err() != nil {
+		logger.WithFields(log.Fields{"type": consts.ContextError, "error": ctx.Err()}).Error("context error")
+		return ctx.Err()
+	}
+	if err = parser.InsertBlockWOForksContext(ctx, newBlock); err != nil {
 		logger.WithFields(log.Fields{"type": consts.ParserError, "error": err}).Error("inserting new block")
 		return err
 	}
@@ -282,12 +857,100 @@ func loadFirstBlock(logger *log.Entry) error {
 	return nil
 }
 
+// VerifyFirstBlock checks the first block file if the node has the empty blockchain and is going to start
+// from the first block, so the node fails at the start instead of the first sync of the blocks
+func VerifyFirstBlock() error {
+	if conf.Config.StartDaemons == "null" || conf.Config.FirstLoadBlockchain == "file" {
+		return nil
+	}
+	toLoad, err := needLoad(log.WithFields(log.Fields{"path": *conf.FirstBlockPath}))
+	if err != nil || !toLoad {
+		return err
+	}
+	return checkFirstBlockFile(*conf.FirstBlockPath)
+}
+
+func checkFirstBlockFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		log.WithFields(log.Fields{"type": consts.IOError, "error": err, "path": path}).Error("checking first block file")
+		return fmt.Errorf("first block file %s is unavailable: %s", path, err)
+	}
+	if info.Size() == 0 {
+		log.WithFields(log.Fields{"type": consts.EmptyObject, "path": path}).Error("first block file is empty")
+		return fmt.Errorf("first block file %s is empty", path)
+	}
+	return nil
+}
+
 func firstLoad(ctx context.Context, d *daemon) error {
 
 	DBLock()
 	defer DBUnlock()
 
-	return loadFirstBlock(d.logger)
+	if conf.Config.FirstLoadBlockchain == "file" {
+		return loadChainFile(ctx, d.logger)
+	}
+
+	return loadFirstBlock(ctx, d.logger)
+}
+
+func firstLoadMarker() string {
+	return filepath.Join(conf.Config.WorkDir, consts.FirstLoadMarkerFilename)
+}
+
+// loadChainFile downloads the blockchain file and loads it. The marker file exists until the whole file
+// is loaded, so needLoad continues the interrupted or failed load and the node doesn't collect blocks
+// on the half-loaded blockchain. The downloaded file is removed if the load fails and is renamed
+// by keepSnapshotFile after the successful load if KeepSnapshotFile is set
+func loadChainFile(ctx context.Context, logger *log.Entry) error {
+	marker := firstLoadMarker()
+	if err := ioutil.WriteFile(marker, nil, 0600); err != nil {
+		logger.WithFields(log.Fields{"type": consts.IOError, "error": err, "path": marker}).Error("creating first load marker")
+		return err
+	}
+
+	expectedHash, err := hex.DecodeString(conf.Config.FirstLoadTipHash)
+	if err != nil {
+		logger.WithFields(log.Fields{"type": consts.ConversionError, "error": err, "value": conf.Config.FirstLoadTipHash}).Error("decoding tip hash of the blockchain file")
+		return err
+	}
+	fileName := filepath.Join(conf.Config.WorkDir, consts.BLOCKCHAIN_FILENAME)
+	_, err = downloadChainMirrors(ctx, fileName, blockchainMirrors(), logger)
+	if err == nil {
+		err = loadFromFile(ctx, fileName, expectedHash, logger)
+	}
+	if err != nil {
+		if errRemove := os.Remove(fileName); errRemove != nil && !os.IsNotExist(errRemove) {
+			logger.WithFields(log.Fields{"type": consts.IOError, "error": errRemove, "path": fileName}).Error("removing blockchain file")
+		}
+		return err
+	}
+	if conf.Config.KeepSnapshotFile {
+		keepSnapshotFile(fileName, logger)
+	}
+
+	if err = os.Remove(marker); err != nil {
+		logger.WithFields(log.Fields{"type": consts.IOError, "error": err, "path": marker}).Error("removing first load marker")
+		return err
+	}
+	return nil
+}
+
+// keepSnapshotFile renames the loaded blockchain file, so it isn't overwritten by the next download
+// and can be used to seed other nodes. The failures are only logged because the blocks are loaded
+func keepSnapshotFile(fileName string, logger *log.Entry) {
+	infoBlock := &model.InfoBlock{}
+	if _, err := infoBlock.Get(); err != nil {
+		logger.WithFields(log.Fields{"type": consts.DBError, "error": err}).Error("getting info block")
+		return
+	}
+	kept := fmt.Sprintf("%s-%d", fileName, infoBlock.BlockID)
+	if err := os.Rename(fileName, kept); err != nil {
+		logger.WithFields(log.Fields{"type": consts.IOError, "error": err, "path": fileName}).Error("renaming blockchain file")
+		return
+	}
+	logger.WithFields(log.Fields{"path": kept, "block_id": infoBlock.BlockID}).Info("blockchain file is kept")
 }
 
 func needLoad(logger *log.Entry) (bool, error) {
@@ -297,82 +960,194 @@ func needLoad(logger *log.Entry) (bool, error) {
 		logger.WithFields(log.Fields{"error": err, "type": consts.DBError}).Error("getting info block")
 		return false, err
 	}
-	// we have empty blockchain, we need to load blockchain from file or other source
-	if infoBlock.BlockID == 0 || *conf.StartBlockID > 0 {
+	// we have empty blockchain or the load of the blockchain file is not finished,
+	// we need to load blockchain from file or other source
+	if infoBlock.BlockID == 0 || *conf.StartBlockID > 0 || isFirstLoadUnfinished() {
 		logger.Debug("blockchain should be loaded")
 		return true, nil
 	}
 	return false, nil
 }
 
-func banNode(host string, err error) {
-	// TODO
+func isFirstLoadUnfinished() bool {
+	if conf.Config.FirstLoadBlockchain != "file" {
+		return false
+	}
+	_, err := os.Stat(firstLoadMarker())
+	return err == nil
 }
 
-func loadFromFile(ctx context.Context, fileName string, logger *log.Entry) error {
+// loadFromFile inserts the blocks from the file. If expectedHash isn't empty, the hash of the last block
+// of the file is compared with it before the load, so the corrupted or forked file isn't inserted at all
+func loadFromFile(ctx context.Context, fileName string, expectedHash []byte, logger *log.Entry) error {
 	file, err := os.Open(fileName)
 	if err != nil {
 		logger.WithFields(log.Fields{"type": consts.IOError, "error": err}).Error("opening file, to load blockhain from it")
 		return err
 	}
 	defer file.Close()
-	for {
-		if ctx.Err() != nil {
-			logger.WithFields(log.Fields{"type": consts.ContextError, "error": err}).Error("context error")
-			return ctx.Err()
-		}
 
-		block, err := readBlock(file, logger)
-		if err != nil {
-			if err == io.EOF {
-				return nil
+	// the blocks which are in the blockchain already are skipped, so the interrupted load can be continued
+	infoBlock := &model.InfoBlock{}
+	if _, err = infoBlock.Get(); err != nil {
+		logger.WithFields(log.Fields{"type": consts.DBError, "error": err}).Error("getting info block")
+		return err
+	}
+	lastBlockID := *conf.StartBlockID
+	if infoBlock.BlockID > lastBlockID {
+		lastBlockID = infoBlock.BlockID
+	}
+	if len(expectedHash) > 0 {
+		lastHeader := &utils.BlockData{BlockID: infoBlock.BlockID, Hash: infoBlock.Hash}
+		if lastBlockID != infoBlock.BlockID {
+			if lastHeader, err = parser.GetBlockDataFromBlockChain(lastBlockID); err != nil {
+				return err
 			}
+		}
+		if err = checkTipHash(ctx, file, lastHeader, expectedHash, logger); err != nil {
 			return err
 		}
-
-		if block == nil {
-			return nil
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			logger.WithFields(log.Fields{"type": consts.IOError, "error": err}).Error("seeking blockchain file")
+			return err
 		}
+	}
+	return insertFileBlocks(ctx, file, lastBlockID, logger)
+}
 
-		if *conf.EndBlockID > 0 && block.ID == *conf.EndBlockID {
-			return nil
+// checkTipHash computes the hash of the last block of the file from the header of the last block
+// of the blockchain and compares it with the expected hash. Nothing is written to the blockchain
+func checkTipHash(ctx context.Context, r io.Reader, lastHeader *utils.BlockData, expectedHash []byte, logger *log.Entry) error {
+	prevHeader := lastHeader
+	err := processFileBlocks(ctx, r, lastHeader.BlockID, nil, logger, func(res parsedFileBlock) error {
+		if res.err != nil {
+			return res.err
 		}
-
-		if *conf.StartBlockID == 0 || (*conf.StartBlockID > 0 && block.ID > *conf.StartBlockID) {
-			if err = parser.InsertBlockWOForks(block.Data); err != nil {
-				return err
-			}
+		block := res.block
+		if block.Header.BlockID != prevHeader.BlockID+1 {
+			logger.WithFields(log.Fields{"type": consts.InvalidObject, "block_id": block.Header.BlockID, "prev_block_id": prevHeader.BlockID}).Error("blocks of the file are not sequential")
+			return fmt.Errorf("bad block id %d, expected %d", block.Header.BlockID, prevHeader.BlockID+1)
+		}
+		block.PrevHeader = prevHeader
+		hash, err := blockHash(block)
+		if err != nil {
+			logger.WithFields(log.Fields{"type": consts.CryptoError, "error": err}).Error("hashing block")
+			return err
 		}
+		header := block.Header
+		header.Hash = hash
+		prevHeader = &header
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(prevHeader.Hash, expectedHash) {
+		logger.WithFields(log.Fields{"type": consts.BlockError, "block_id": prevHeader.BlockID, "hash": fmt.Sprintf("%x", prevHeader.Hash),
+			"expected_hash": fmt.Sprintf("%x", expectedHash)}).Error("hash of the last block of the file does not match")
+		return ErrTipHashMismatch
+	}
+	return nil
+}
+
+// isGzipped returns true if the downloaded file is compressed with gzip and http.Transport
+// hasn't decompressed it, e.g. the file has .gz extension
+func isGzipped(resp *http.Response, url string) bool {
+	if resp.Uncompressed {
+		return false
 	}
+	return strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") || strings.HasSuffix(url, ".gz")
 }
 
-// downloadToFile downloads and saves the specified file
-func downloadToFile(ctx context.Context, url, file string, logger *log.Entry) (int64, error) {
-	resp, err := ctxhttp.Get(ctx, &http.Client{}, url)
+// setDownloadHeaders sets User-Agent and the additional headers of the download of the blockchain file.
+// The additional headers override User-Agent
+func setDownloadHeaders(req *http.Request) {
+	userAgent := conf.Config.FirstLoadUserAgent
+	if len(userAgent) == 0 {
+		userAgent = consts.DownloadUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+	// the explicit encoding stops http.Transport from decompressing the body, so downloadToFile
+	// decompresses it after the rate limit and the progress of the received bytes
+	req.Header.Set("Accept-Encoding", "gzip")
+	for name, value := range conf.Config.FirstLoadHeaders {
+		req.Header.Set(name, value)
+	}
+}
+
+// downloadToFile downloads and saves the specified file, it returns the size and the content type of the file.
+// The compressed files are decompressed, so the size is the size of the decompressed file
+func downloadToFile(ctx context.Context, url, file string, logger *log.Entry) (int64, string, error) {
+	// the attempt is stopped only if no data is received for downloadIdleTimeout,
+	// so the download of the big file or the throttled one isn't limited in time
+	attemptCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var stalled int32
+	idle := time.AfterFunc(downloadIdleTimeout, func() {
+		atomic.StoreInt32(&stalled, 1)
+		cancel()
+	})
+	defer idle.Stop()
+	stopped := func(err error) error {
+		if atomic.LoadInt32(&stalled) == 1 {
+			logger.WithFields(log.Fields{"type": consts.NetworkError, "url": url, "timeout": downloadIdleTimeout}).Error("download is stalled")
+			return ErrDownloadStalled
+		}
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(attemptCtx, http.MethodGet, url, nil)
+	if err != nil {
+		logger.WithFields(log.Fields{"type": consts.NetworkError, "error": err, "url": url}).Error("creating download request")
+		return 0, "", utils.ErrInfo(err)
+	}
+	setDownloadHeaders(req)
+	resp, err := (&http.Client{}).Do(req)
 	if err != nil {
 		logger.WithFields(log.Fields{"type": consts.ContextError, "error": err, "url": url}).Error("context error")
-		return 0, utils.ErrInfo(err)
+		return 0, "", stopped(utils.ErrInfo(err))
 	}
 	defer resp.Body.Close()
 
+	chunkSize := int64(10000)
+	var bucket *tokenBucket
+	if rate := conf.Config.DownloadRateLimit; rate > 0 {
+		bucket = newTokenBucket(rate)
+		if rate < chunkSize {
+			chunkSize = rate
+		}
+	}
+	// the received bytes are throttled and counted before the decompression, ContentLength is -1 if the size is unknown
+	link := &downloadReader{ctx: attemptCtx, body: resp.Body, bucket: bucket, chunkSize: chunkSize,
+		progress: newProgressReporter(url, resp.ContentLength, logger), idle: idle}
+	body := io.Reader(link)
+	if isGzipped(resp, url) {
+		gz, err := gzip.NewReader(link)
+		if err != nil {
+			logger.WithFields(log.Fields{"type": consts.IOError, "error": err, "url": url}).Error("reading gzip header")
+			return 0, "", stopped(utils.ErrInfo(err))
+		}
+		defer gz.Close()
+		body = gz
+	}
+
 	f, err := os.Create(file)
 	if err != nil {
 		logger.WithFields(log.Fields{"type": consts.IOError, "error": err}).Error("creating file for writing downloaded blockchain")
-		return 0, utils.ErrInfo(err)
+		return 0, "", utils.ErrInfo(err)
 	}
 	defer f.Close()
 
 	var offset int64
 	for {
+		data, err := ioutil.ReadAll(io.LimitReader(body, chunkSize))
 		if ctx.Err() != nil {
 			logger.WithFields(log.Fields{"type": consts.ContextError, "error": ctx.Err()}).Error("context error")
-			return 0, ctx.Err()
+			return 0, "", ctx.Err()
 		}
-
-		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 10000))
 		if err != nil {
 			logger.WithFields(log.Fields{"type": consts.IOError, "error": err, "url": url}).Error("downloading file from url")
-			return offset, utils.ErrInfo(err)
+			return offset, "", stopped(utils.ErrInfo(err))
 		}
 
 		f.WriteAt(data, offset)
@@ -381,5 +1156,6 @@ func downloadToFile(ctx context.Context, url, file string, logger *log.Entry) (i
 			break
 		}
 	}
-	return offset, nil
+	link.progress.report(link.received, true)
+	return offset, resp.Header.Get("Content-Type"), nil
 }
@@ -0,0 +1,97 @@
+// MIT License
+//
+// Copyright (c) 2016-2018 GenesisKernel
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemons
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/GenesisKernel/go-genesis/packages/conf"
+	"github.com/GenesisKernel/go-genesis/packages/config/syspar"
+	"github.com/GenesisKernel/go-genesis/packages/consts"
+	"github.com/GenesisKernel/go-genesis/packages/parser"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrCheckpointMismatch is returned by UpdateChain when the hash of the block of the host differs
+// from the trusted hash of the checkpoint at its height
+var ErrCheckpointMismatch = errors.New("block hash does not match the checkpoint")
+
+// checkpointHash returns the trusted hex hash of the block. The checkpoints of the config override
+// the checkpoints system parameter
+func checkpointHash(blockID int64) (string, bool) {
+	if hash, ok := conf.Config.Checkpoints[strconv.FormatInt(blockID, 10)]; ok {
+		return hash, true
+	}
+	return syspar.GetCheckpoint(blockID)
+}
+
+// lastCheckpoint returns the height of the last checkpoint below blockID or 0 if there is no one
+func lastCheckpoint(blockID int64) int64 {
+	var last int64
+	for id := range syspar.GetCheckpoints() {
+		if id < blockID && id > last {
+			last = id
+		}
+	}
+	for key := range conf.Config.Checkpoints {
+		if id, err := strconv.ParseInt(key, 10, 64); err == nil && id < blockID && id > last {
+			last = id
+		}
+	}
+	return last
+}
+
+// checkCheckpoint compares the hash of the block with the checkpoint at its height, it does nothing
+// if there is no checkpoint. The block must have PrevHeader to calculate its hash
+func checkCheckpoint(block *parser.Block, logger *log.Entry) error {
+	expected, ok := checkpointHash(block.Header.BlockID)
+	if !ok {
+		return nil
+	}
+	hash, err := blockHash(block)
+	if err != nil {
+		logger.WithFields(log.Fields{"type": consts.CryptoError, "error": err}).Error("double hashing block")
+		return err
+	}
+	if !strings.EqualFold(hex.EncodeToString(hash), expected) {
+		logger.WithFields(log.Fields{"type": consts.BlockError, "block_id": block.Header.BlockID,
+			"hash": hex.EncodeToString(hash), "expected_hash": expected}).Error("block hash does not match the checkpoint")
+		return ErrCheckpointMismatch
+	}
+	return nil
+}
+
+// forkDepth returns the max count of the blocks received from the host in the case of fork revealed
+// by blockID. The blocks at the checkpoint heights are never replaced, so the fork can't go below the last one
+func forkDepth(blockID int64) int64 {
+	depth := maxForkDepth()
+	// GetBlocks receives the blocks from blockID-1 down to blockID-1-depth
+	if last := lastCheckpoint(blockID); last > 0 && blockID-2-last < depth {
+		depth = blockID - 2 - last
+	}
+	return depth
+}
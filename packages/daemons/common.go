@@ -25,6 +25,9 @@ package daemons
 import (
 	"context"
 	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -45,6 +48,8 @@ var (
 type daemon struct {
 	goRoutineName string
 	sleepTime     time.Duration
+	startJitter   time.Duration
+	jitter        time.Duration
 	logger        *log.Entry
 }
 
@@ -59,6 +64,12 @@ var daemonsList = map[string]func(context.Context, *daemon) error{
 	"Scheduler":         Scheduler,
 }
 
+// daemonsJitter returns the max random delays of the first cycle and of the pauses between the cycles
+// of the daemon, so the nodes started together don't request the same hosts simultaneously
+var daemonsJitter = map[string]func() (time.Duration, time.Duration){
+	"BlocksCollection": collectionJitter,
+}
+
 var serverList = []string{
 	"BlocksCollection",
 	"BlockGenerator",
@@ -94,6 +105,21 @@ func daemonLoop(ctx context.Context, goRoutineName string, handler func(context.
 		sleepTime:     1 * time.Second,
 		logger:        logger,
 	}
+	if jitter, ok := daemonsJitter[goRoutineName]; ok {
+		d.startJitter, d.jitter = jitter()
+	}
+
+	if d.startJitter > 0 {
+		delay := randomDelay(d.startJitter)
+		logger.WithFields(log.Fields{"delay": delay}).Debug("delaying the first cycle")
+		select {
+		case <-ctx.Done():
+			logger.Info("daemon done his work")
+			retCh <- goRoutineName
+			return
+		case <-time.After(delay):
+		}
+	}
 
 	startTime := time.Now()
 	counterName := statsd.DaemonCounterName(goRoutineName)
@@ -107,7 +133,7 @@ func daemonLoop(ctx context.Context, goRoutineName string, handler func(context.
 			retCh <- goRoutineName
 			return
 
-		case <-time.After(d.sleepTime):
+		case <-time.After(d.sleepTime + randomDelay(d.jitter)):
 			MonitorDaemonCh <- []string{d.goRoutineName, converter.Int64ToStr(time.Now().Unix())}
 			startTime := time.Now()
 			counterName := statsd.DaemonCounterName(goRoutineName)
@@ -117,6 +143,14 @@ func daemonLoop(ctx context.Context, goRoutineName string, handler func(context.
 	}
 }
 
+// randomDelay returns the random duration in [0, max], 0 if max isn't positive
+func randomDelay(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
+
 // StartDaemons starts daemons
 func StartDaemons() {
 	if conf.Config.StartDaemons == "null" {
@@ -131,7 +165,7 @@ func StartDaemons() {
 			daemonNameAndTime := <-MonitorDaemonCh
 			daemonsTable[daemonNameAndTime[0]] = daemonNameAndTime[1]
 			if time.Now().Unix()%10 == 0 {
-				log.Debug("daemonsTable: %v\n", daemonsTable)
+				log.WithFields(log.Fields{"daemons": daemonsTable}).Debug("daemons table")
 			}
 		}
 	}()
@@ -162,9 +196,109 @@ func StartDaemons() {
 	}
 }
 
+// getHostPort returns the host:port address of the host, the default port is appended if the host
+// has no port. IPv6 addresses are bracketed, an IPv6 address with a port must be written as [host]:port.
+// The host which can't be parsed is returned as is, so resolveHosts skips it
 func getHostPort(h string) string {
-	if strings.Contains(h, ":") {
+	if host, port, err := net.SplitHostPort(h); err == nil {
+		return net.JoinHostPort(host, port)
+	}
+	host := h
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	if strings.Contains(host, ":") && net.ParseIP(strings.SplitN(host, "%", 2)[0]) == nil {
 		return h
 	}
-	return fmt.Sprintf("%s:%d", h, consts.DEFAULT_TCP_PORT)
+	return net.JoinHostPort(host, strconv.Itoa(consts.DEFAULT_TCP_PORT))
+}
+
+// resolveHosts returns the list of host:port addresses, the malformed hosts are skipped
+func resolveHosts(hosts []string) []string {
+	ret := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		addr := getHostPort(strings.TrimSpace(h))
+		host, port, err := net.SplitHostPort(addr)
+		if err == nil {
+			if len(host) == 0 {
+				err = fmt.Errorf("empty host")
+			} else if iport, errPort := strconv.Atoi(port); errPort != nil || iport <= 0 || iport > 65535 {
+				err = fmt.Errorf("wrong port %s", port)
+			}
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"type": consts.InvalidObject, "host": h, "error": err}).Warning("skipping malformed host")
+			continue
+		}
+		ret = append(ret, addr)
+	}
+	return ret
+}
+
+// excludeSelf removes the address of our own node from the resolved hosts, so the node
+// doesn't collect blocks from itself
+func excludeSelf(hosts []string, logger *log.Entry) []string {
+	ret := make([]string, 0, len(hosts))
+	for _, addr := range hosts {
+		if isSelfAddress(addr) {
+			logger.WithFields(log.Fields{"host": addr}).Debug("skipping own host")
+			continue
+		}
+		ret = append(ret, addr)
+	}
+	if len(ret) == 0 && len(hosts) > 0 {
+		logger.WithFields(log.Fields{"type": consts.EmptyObject, "hosts": hosts}).Warning("there are no hosts except own node")
+	}
+	return ret
+}
+
+// isSelfAddress returns true if the host:port address points to the TCP server of our node.
+// The names are compared case-insensitively and the IP addresses are compared in the parsed form.
+// The loopback addresses and, if the server listens on all interfaces, the local addresses are ours too
+func isSelfAddress(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	selfPort := conf.Config.TCPServer.Port
+	if selfPort == 0 {
+		selfPort = consts.DEFAULT_TCP_PORT
+	}
+	if iport, err := strconv.Atoi(port); err != nil || iport != selfPort {
+		return false
+	}
+
+	normalize := func(h string) string {
+		return strings.ToLower(strings.TrimSuffix(h, "."))
+	}
+	host = normalize(host)
+	selfHost := normalize(conf.Config.TCPServer.Host)
+	if host == selfHost || host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	if selfIP := net.ParseIP(selfHost); selfIP != nil && !selfIP.IsUnspecified() {
+		return ip.Equal(selfIP)
+	}
+	if len(selfHost) > 0 && net.ParseIP(selfHost) == nil {
+		return false
+	}
+	// the server listens on all interfaces
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.WithFields(log.Fields{"type": consts.NetworkError, "error": err}).Error("getting interface addresses")
+		return false
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
 }
@@ -23,6 +23,7 @@
 package daemons
 
 import (
+	"fmt"
 	"io"
 	"os"
 
@@ -111,10 +112,11 @@ func readBlock(r io.Reader, logger *log.Entry) (*blockData, error) {
 		return nil, err
 	}
 
+	// the size is checked before the allocation of the block
 	size := converter.BinToDec(buf)
-	if size > syspar.GetMaxBlockSize() {
-		logger.WithFields(log.Fields{"size": size, "max_size": syspar.GetMaxBlockSize(), "type": consts.ParameterExceeded}).Error("reading block from file")
-		return nil, utils.ErrInfo("size > conts.MAX_BLOCK_SIZE")
+	if maxSize := syspar.GetMaxBlockSize(); size > maxSize {
+		logger.WithFields(log.Fields{"size": size, "max_size": maxSize, "type": consts.ParameterExceeded}).Error("reading block from file")
+		return nil, fmt.Errorf("block size %d exceeds the max block size %d", size, maxSize)
 	}
 
 	if size == 0 {
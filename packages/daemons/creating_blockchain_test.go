@@ -23,16 +23,21 @@
 package daemons
 
 import (
-	"database/sql"
-	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"regexp"
 	"testing"
+	"time"
+
+	"github.com/GenesisKernel/go-genesis/packages/consts"
+	"github.com/GenesisKernel/go-genesis/packages/converter"
+	"github.com/GenesisKernel/go-genesis/packages/crypto"
+	"github.com/GenesisKernel/go-genesis/packages/model"
+	"github.com/GenesisKernel/go-genesis/packages/parser"
+	"github.com/GenesisKernel/go-genesis/packages/utils"
 
-	"github.com/GenesisKernel/go-genesis/packages/static"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	log "github.com/sirupsen/logrus"
 )
 
 func getTmpFile(t *testing.T) string {
@@ -49,22 +54,47 @@ func TestEmptyFile(t *testing.T) {
 	fileName := getTmpFile(t)
 	defer os.Remove(fileName)
 
-	err := writeNextBlocks(fileName, 1)
+	err := writeNextBlocks(fileName, 1, log.WithFields(log.Fields{}))
 	if err == nil {
-		t.Errorf("should be emty_file error")
+		t.Fatalf("should be emty_file error")
 	}
 	matched, regErr := regexp.Match("empty blockchain file", []byte(err.Error()))
 	if regErr != nil || !matched {
 		t.Errorf("bad error %s", err)
 	}
 }
+
+// getFirstBlock returns the first block generated like the install of the node does
 func getFirstBlock(t *testing.T) blockData {
-	newBlock, err := static.Asset("static/1block")
+	private, public, err := crypto.GenHexKeys()
 	if err != nil {
-		t.Fatalf("Can't get first block")
+		t.Fatalf("can't gen keys: %s", err)
+	}
+	publicKey := converter.HexToBin(public)
+
+	now := time.Now().Unix()
+	header := &utils.BlockData{
+		BlockID: 1,
+		Time:    now,
+		KeyID:   crypto.Address(publicKey),
+		Version: consts.BLOCK_VERSION,
+	}
+	var tx []byte
+	_, err = converter.BinMarshal(&tx, &consts.FirstBlock{
+		TxHeader:      consts.TxHeader{Type: 1, Time: uint32(now), KeyID: header.KeyID},
+		PublicKey:     publicKey,
+		NodePublicKey: publicKey,
+		Host:          "127.0.0.1",
+	})
+	if err != nil {
+		t.Fatalf("can't marshal first block transaction: %s", err)
+	}
+	newBlock, err := parser.MarshallBlock(header, [][]byte{tx}, []byte("0"), private)
+	if err != nil {
+		t.Fatalf("can't marshal first block: %s", err)
 	}
 
-	block, err := unmarshalBlockData(newBlock)
+	block, err := unmarshalBlockData(marshallFileBlock(blockData{ID: 1, Data: newBlock})[WordSize:], log.WithFields(log.Fields{}))
 	if err != nil {
 		t.Fatalf("readBlock error: %s", err)
 	}
@@ -92,7 +122,7 @@ func TestLastBlock(t *testing.T) {
 		t.Fatalf("can't write to file: %s", err)
 	}
 
-	blockID, err := getLastBlockID(fileName)
+	blockID, err := getLastBlockID(fileName, log.WithFields(log.Fields{}))
 	if err != nil {
 		t.Fatalf("can't get last id: %s", err)
 	}
@@ -102,27 +132,16 @@ func TestLastBlock(t *testing.T) {
 	}
 }
 
-func addBlockInfo(t *testing.T, blockID int64, db *sql.DB) {
-	var err error
-	_, err = db.Exec(fmt.Sprintf("insert into info_block(block_id) values(%d)", blockID))
-	if err != nil {
+func addBlockInfo(t *testing.T, blockID int64) {
+	if err := (&model.InfoBlock{BlockID: blockID}).Create(nil); err != nil {
 		t.Fatal(err)
 	}
 }
 
-func addBlock(t *testing.T, blockID int64, data []byte, db *sql.DB) {
-
-	stmt, err := db.Prepare("insert into block_chain(id, data) values(?, ?)")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer stmt.Close()
-
-	_, err = stmt.Exec(blockID, data)
-	if err != nil {
+func addBlock(t *testing.T, blockID int64, data []byte) {
+	if err := (&model.Block{ID: blockID, Data: data}).Create(nil); err != nil {
 		t.Fatal(err)
 	}
-
 }
 
 func TestWriteNext(t *testing.T) {
@@ -140,26 +159,27 @@ func TestWriteNext(t *testing.T) {
 		t.Fatalf("can't write to file: %s", err)
 	}
 
-	addBlockInfo(t, 2, db.DB())
-	addBlock(t, 2, []byte("test"), db.DB())
+	addBlockInfo(t, 2)
+	addBlock(t, 2, []byte("test"))
 
-	err = writeNextBlocks(fileName, 1)
+	err = writeNextBlocks(fileName, 1, log.WithFields(log.Fields{}))
 	if err != nil {
-		log.Fatalf("writeNextBlocks error: %s", err)
+		t.Fatalf("writeNextBlocks error: %s", err)
 	}
 
 	file, err := os.Open(fileName)
 	if err != nil {
 		t.Fatalf("can't open file: %s", err)
 	}
+	defer file.Close()
 
 	for i := 0; i < 2; i++ {
-		blockData, err := readBlock(file)
+		blockData, err := readBlock(file, log.WithFields(log.Fields{}))
 		if err != nil {
 			t.Fatalf("readBlock error: %s", err)
 		}
 		if blockData.ID != int64(i+1) {
-			t.Errorf("bad block id: want %d, got %d", i, blockData.ID)
+			t.Errorf("bad block id: want %d, got %d", i+1, blockData.ID)
 		}
 
 		if i == 1 {
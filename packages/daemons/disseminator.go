@@ -236,7 +236,7 @@ func MarshallTrHash(tr model.Transaction) []byte {
 
 func sendPacketToAll(reqType int, buf []byte, respHand func(resp []byte, w io.Writer, logger *log.Entry) error, logger *log.Entry) error {
 
-	hosts := syspar.GetRemoteHosts()
+	hosts := resolveHosts(syspar.GetRemoteHosts())
 	var wg sync.WaitGroup
 
 	for _, host := range hosts {
@@ -244,7 +244,7 @@ func sendPacketToAll(reqType int, buf []byte, respHand func(resp []byte, w io.Wr
 		go func(h string) {
 			sendDRequest(h, reqType, buf, respHand, logger)
 			wg.Done()
-		}(getHostPort(host))
+		}(host)
 	}
 	wg.Wait()
 
@@ -0,0 +1,131 @@
+// MIT License
+//
+// Copyright (c) 2016-2018 GenesisKernel
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemons
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/GenesisKernel/go-genesis/packages/consts"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DownloadInfo is the progress of the download of the blockchain file
+type DownloadInfo struct {
+	Downloaded int64         // the downloaded size in bytes
+	Total      int64         // the size of the file, -1 if it is unknown
+	Rate       float64       // bytes per second since the previous report
+	ETA        time.Duration // estimated time to download the rest, 0 if the size or the rate is unknown
+}
+
+// DownloadProgress is called while the blockchain file is downloading. It is called not more often than
+// once per consts.DownloadProgressInterval seconds and once at the end of the download, nil disables it
+var DownloadProgress func(DownloadInfo)
+
+// progressReporter logs the progress of the download and calls DownloadProgress on a throttled cadence
+type progressReporter struct {
+	url            string
+	total          int64
+	interval       time.Duration
+	last           time.Time
+	lastDownloaded int64 // the downloaded size at the previous report, the rate is measured from it
+	logger         *log.Entry
+}
+
+func newProgressReporter(url string, total int64, logger *log.Entry) *progressReporter {
+	return &progressReporter{url: url, total: total, interval: consts.DownloadProgressInterval * time.Second,
+		last: time.Now(), logger: logger}
+}
+
+// info calculates the rate since the previous report and ETA for the downloaded size
+func (p *progressReporter) info(downloaded int64, now time.Time) DownloadInfo {
+	info := DownloadInfo{Downloaded: downloaded, Total: p.total}
+	if elapsed := now.Sub(p.last).Seconds(); elapsed > 0 && downloaded > p.lastDownloaded {
+		info.Rate = float64(downloaded-p.lastDownloaded) / elapsed
+		if p.total > downloaded {
+			info.ETA = time.Duration(float64(p.total-downloaded) / info.Rate * float64(time.Second))
+		}
+	}
+	return info
+}
+
+// report reports the downloaded size if the interval has passed since the previous report or done is true
+func (p *progressReporter) report(downloaded int64, done bool) {
+	now := time.Now()
+	if !done && now.Sub(p.last) < p.interval {
+		return
+	}
+	info := p.info(downloaded, now)
+	p.last, p.lastDownloaded = now, downloaded
+
+	fields := log.Fields{"url": p.url, "downloaded": downloaded, "rate": fmt.Sprintf("%.0f", info.Rate)}
+	if p.total > 0 {
+		fields["total"] = p.total
+		fields["percent"] = downloaded * 100 / p.total
+		fields["eta"] = info.ETA.Round(time.Second).String()
+	}
+	p.logger.WithFields(fields).Info("downloading file")
+
+	if onProgress := DownloadProgress; onProgress != nil {
+		onProgress(info)
+	}
+}
+
+// downloadReader reads the body of the download response by chunks which are throttled by bucket
+// and reports the progress of the received bytes. The decompression reads from it, so the rate limit
+// and the progress are of the received data and not of the decompressed file
+type downloadReader struct {
+	ctx       context.Context
+	body      io.Reader
+	bucket    *tokenBucket // nil means unlimited
+	chunkSize int64
+	progress  *progressReporter
+	received  int64
+	idle      *time.Timer // it is reset by the received data, so it fires only if the download is stalled
+}
+
+func (r *downloadReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.chunkSize {
+		p = p[:r.chunkSize]
+	}
+	if r.bucket != nil {
+		if err := r.bucket.wait(r.ctx, int64(len(p))); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.body.Read(p)
+	if r.bucket != nil {
+		r.bucket.refund(int64(len(p) - n))
+	}
+	if n > 0 {
+		r.received += int64(n)
+		r.progress.report(r.received, false)
+		if r.idle != nil {
+			r.idle.Reset(downloadIdleTimeout)
+		}
+	}
+	return n, err
+}
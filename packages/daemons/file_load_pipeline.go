@@ -0,0 +1,307 @@
+// MIT License
+//
+// Copyright (c) 2016-2018 GenesisKernel
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemons
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/GenesisKernel/go-genesis/packages/conf"
+	"github.com/GenesisKernel/go-genesis/packages/consts"
+	"github.com/GenesisKernel/go-genesis/packages/parser"
+	"github.com/GenesisKernel/go-genesis/packages/utils"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// parsedFileBlock is the block of the blockchain file which has been parsed by the worker.
+// blockID is the id from the file, it is 0 if the block hasn't been read
+type parsedFileBlock struct {
+	blockID int64
+	block   *parser.Block
+	err     error
+}
+
+// fileBlockJob is the block which is waiting for the worker, the worker sends the result to done.
+// If the blocks are linked, the worker gets the header of the previous block from prev and sends
+// the header of this block to next, nil header means that the block can't be linked
+type fileBlockJob struct {
+	data *blockData
+	done chan parsedFileBlock
+	prev <-chan *utils.BlockData
+	next chan<- *utils.BlockData
+}
+
+func fileLoadWorkers() int {
+	if workers := conf.Config.FirstLoadWorkers; workers > 0 {
+		return workers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// insertFileBlocks reads the blocks from r and inserts the blocks with ids which are bigger than lastBlockID.
+// The blocks are parsed and their signatures are checked by the workers concurrently, but they are inserted
+// by the caller goroutine one by one in the order of the file. The reading stops at the end of the file
+// or at EndBlockID
+func insertFileBlocks(ctx context.Context, r io.Reader, lastBlockID int64, logger *log.Entry) error {
+	// the signatures aren't checked by the workers if the last block isn't in the blockchain,
+	// e.g. StartBlockID is bigger than it, the insertion checks them in this case
+	var lastHeader *utils.BlockData
+	if lastBlockID == 0 {
+		lastHeader = &utils.BlockData{}
+	} else if header, err := parser.GetBlockDataFromBlockChain(lastBlockID); err == nil {
+		lastHeader = header
+	}
+	return processFileBlocks(ctx, r, lastBlockID, lastHeader, logger, func(res parsedFileBlock) error {
+		if res.err != nil {
+			return res.err
+		}
+		// the previous block is read from the blockchain like before, the signature isn't checked again
+		// if the hash of the previous block is the same as the linked one
+		res.block.PrevHeader = nil
+		return parser.InsertParsedBlockWOForksContext(ctx, res.block)
+	})
+}
+
+// processFileBlocks parses the blocks from r with ids which are bigger than lastBlockID by the workers
+// and passes them to handle in the order of the file. It stops if handle returns the error.
+// If lastHeader isn't nil, it is the header of the block lastBlockID and the workers link the blocks
+// with the previous ones and check their signatures with PreCheckHash
+func processFileBlocks(ctx context.Context, r io.Reader, lastBlockID int64, lastHeader *utils.BlockData,
+	logger *log.Entry, handle func(parsedFileBlock) error) error {
+
+	ctx, cancel := context.WithCancel(ctx)
+	workers := fileLoadWorkers()
+	jobs := make(chan fileBlockJob, workers)
+	ordered := make(chan chan parsedFileBlock, 2*workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				block, err := parser.ParseBlock(job.data.Data)
+				res := parsedFileBlock{blockID: job.data.ID, block: block, err: err}
+				if job.next != nil {
+					linkFileBlock(ctx, job, res, logger)
+				}
+				job.done <- res
+			}
+		}()
+	}
+	go func() {
+		readFileBlocks(ctx, r, lastBlockID, lastHeader, jobs, ordered, logger)
+		close(jobs)
+		close(ordered)
+	}()
+	// the reader and the workers are stopped before the return, so they don't touch r after it
+	defer wg.Wait()
+	defer cancel()
+
+	for done := range ordered {
+		var res parsedFileBlock
+		select {
+		case res = <-done:
+		case <-ctx.Done():
+			logger.WithFields(log.Fields{"type": consts.ContextError, "error": ctx.Err()}).Error("context error")
+			return ctx.Err()
+		}
+		if err := handle(res); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		logger.WithFields(log.Fields{"type": consts.ContextError, "error": ctx.Err()}).Error("context error")
+		return ctx.Err()
+	}
+	return nil
+}
+
+// ScanChainFile validates the blocks of the blockchain file without inserting them and returns the results
+// of the failed blocks. Unlike the load it doesn't stop at the failed block, so all bad blocks of the corrupted
+// file are found and the operator can decide whether the file can be used. Every block is checked against
+// the header of the previous block of the file like ValidateChain does, the blocks which are checked against
+// the full nodes or the system parameters changed by the previous blocks can fail. The error is returned
+// only if the file can't be read, the results of the blocks before the unreadable data are returned with it.
+// The hash of the block which can't be parsed is unknown, so the blocks after it aren't checked and the first
+// of them is reported with VerifyCheckChain
+func ScanChainFile(ctx context.Context, fileName string) ([]BlockVerifyResult, error) {
+	logger := log.WithFields(log.Fields{"path": fileName})
+	file, err := os.Open(fileName)
+	if err != nil {
+		logger.WithFields(log.Fields{"type": consts.IOError, "error": err}).Error("opening file, to scan blockhain")
+		return nil, err
+	}
+	defer file.Close()
+
+	var (
+		failed     []BlockVerifyResult
+		prevHeader *utils.BlockData
+		// unlinked is set when the hash of the previous block is unknown, the blocks after the block
+		// which can't be parsed can't be checked and only the first of them is reported
+		unlinked, prevBroken bool
+	)
+	fail := func(blockID int64, check string, err error) {
+		logger.WithFields(log.Fields{"type": consts.BlockError, "block_id": blockID, "check": check, "error": err}).Warning("block failed the scan")
+		failed = append(failed, BlockVerifyResult{BlockID: blockID, Check: check, Error: err})
+	}
+	broken := func(blockID int64, err error) {
+		fail(blockID, VerifyCheckProcess, err)
+		prevHeader, unlinked, prevBroken = nil, true, true
+	}
+	err = processFileBlocks(ctx, file, 0, nil, logger, func(res parsedFileBlock) error {
+		if res.blockID == 0 {
+			return res.err
+		}
+		if res.err != nil {
+			broken(res.blockID, res.err)
+			return nil
+		}
+		block := res.block
+		if block.Header.BlockID != res.blockID {
+			broken(res.blockID, fmt.Errorf("bad block id %d, expected %d", block.Header.BlockID, res.blockID))
+			return nil
+		}
+		if unlinked {
+			if prevBroken {
+				fail(res.blockID, VerifyCheckChain, fmt.Errorf("previous block %d can't be parsed", res.blockID-1))
+			}
+			prevBroken = false
+			return nil
+		}
+		if prevHeader != nil && prevHeader.BlockID == block.Header.BlockID-1 {
+			block.PrevHeader = prevHeader
+		}
+		if err := block.CheckBlock(); err != nil {
+			fail(res.blockID, VerifyCheckBlock, err)
+		}
+		// the next block is checked against this one even if it has failed, so only the bad blocks are reported
+		if block.PrevHeader == nil {
+			prevHeader, unlinked = nil, true
+			return nil
+		}
+		hash, err := blockHash(block)
+		if err != nil {
+			return err
+		}
+		header := block.Header
+		header.Hash = hash
+		prevHeader = &header
+		return nil
+	})
+	return failed, err
+}
+
+// linkFileBlock sets the header of the previous block as PrevHeader of the parsed block and sends the header
+// with the hash of the block to the worker of the next block. The signature is checked after that,
+// so the signatures of the blocks are checked concurrently. The failed check is only logged because
+// the block can be signed by the node which is added by the previous blocks, the insertion checks it again
+func linkFileBlock(ctx context.Context, job fileBlockJob, res parsedFileBlock, logger *log.Entry) {
+	var prevHeader *utils.BlockData
+	select {
+	case prevHeader = <-job.prev:
+	case <-ctx.Done():
+		return
+	}
+	if res.err != nil || prevHeader == nil || res.block.Header.BlockID != prevHeader.BlockID+1 {
+		job.next <- nil
+		return
+	}
+	block := res.block
+	block.PrevHeader = prevHeader
+	hash, err := blockHash(block)
+	if err != nil {
+		logger.WithFields(log.Fields{"type": consts.CryptoError, "error": err, "block_id": res.blockID}).Error("hashing block")
+		job.next <- nil
+		return
+	}
+	header := block.Header
+	header.Hash = hash
+	job.next <- &header
+
+	if err = block.PreCheckHash(); err != nil {
+		logger.WithFields(log.Fields{"type": consts.BlockError, "error": err, "block_id": res.blockID}).Debug("checking block signature")
+	}
+}
+
+// readFileBlocks sends the blocks to the workers and their result channels to ordered in the order
+// of the file. The error of the reading is sent to ordered as the result of the next block.
+// The ids of the blocks must grow, the blocks which are in the blockchain already are skipped
+func readFileBlocks(ctx context.Context, r io.Reader, lastBlockID int64, lastHeader *utils.BlockData,
+	jobs chan<- fileBlockJob, ordered chan<- chan parsedFileBlock, logger *log.Entry) {
+
+	var prev chan *utils.BlockData
+	if lastHeader != nil {
+		prev = make(chan *utils.BlockData, 1)
+		prev <- lastHeader
+	}
+	var prevID int64
+	for ctx.Err() == nil {
+		block, err := readBlock(r, logger)
+		if err == io.EOF || (err == nil && block == nil) {
+			return
+		}
+		if err == nil && block.ID <= prevID {
+			logger.WithFields(log.Fields{"type": consts.InvalidObject, "block_id": block.ID, "prev_block_id": prevID}).Error("block ids of the file don't grow")
+			err = fmt.Errorf("block id %d is not bigger than the previous block id %d", block.ID, prevID)
+		}
+		done := make(chan parsedFileBlock, 1)
+		if err != nil {
+			done <- parsedFileBlock{err: err}
+			select {
+			case ordered <- done:
+			case <-ctx.Done():
+			}
+			return
+		}
+		prevID = block.ID
+
+		if *conf.EndBlockID > 0 && block.ID == *conf.EndBlockID {
+			return
+		}
+		if block.ID <= lastBlockID {
+			continue
+		}
+
+		job := fileBlockJob{data: block, done: done}
+		if prev != nil {
+			next := make(chan *utils.BlockData, 1)
+			job.prev, job.next, prev = prev, next, next
+		}
+		select {
+		case ordered <- done:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case jobs <- job:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
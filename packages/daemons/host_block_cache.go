@@ -0,0 +1,140 @@
+// MIT License
+//
+// Copyright (c) 2016-2018 GenesisKernel
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemons
+
+import (
+	"sync"
+	"time"
+
+	"github.com/GenesisKernel/go-genesis/packages/conf"
+	"github.com/GenesisKernel/go-genesis/packages/consts"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type hostBlockInfo struct {
+	blockID   int64
+	latency   time.Duration
+	fetchedAt time.Time
+}
+
+// rankedHost is the host with its max block id, chooseBestHost returns the hosts ranked by them
+type rankedHost struct {
+	host string
+	hostBlockInfo
+}
+
+// hostBlockCache keeps the max block ids received from the hosts
+type hostBlockCache struct {
+	mutex sync.Mutex
+	hosts map[string]hostBlockInfo
+}
+
+var hostBlocks = &hostBlockCache{hosts: make(map[string]hostBlockInfo)}
+
+func hostBlockCacheTTL() time.Duration {
+	ttl := conf.Config.HostBlockIDCacheTTL
+	if ttl <= 0 {
+		ttl = consts.HostBlockIDCacheTTL
+	}
+	return time.Duration(ttl) * time.Millisecond
+}
+
+func (c *hostBlockCache) get(host string) (hostBlockInfo, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	info, ok := c.hosts[host]
+	if !ok || time.Since(info.fetchedAt) > hostBlockCacheTTL() {
+		return hostBlockInfo{}, false
+	}
+	return info, true
+}
+
+func (c *hostBlockCache) set(host string, info hostBlockInfo) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.hosts[host] = info
+}
+
+// maxBlockID returns the biggest cached block id including the expired ones
+func (c *hostBlockCache) maxBlockID() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var maxBlockID int64
+	for _, info := range c.hosts {
+		if info.blockID > maxBlockID {
+			maxBlockID = info.blockID
+		}
+	}
+	return maxBlockID
+}
+
+// nextBestHost returns the cached host with the biggest block id which is not less than minBlockID.
+// The hosts from exclude and the banned hosts are skipped, the expired block ids are used too
+// because the block ids of the hosts can only grow
+func (c *hostBlockCache) nextBestHost(minBlockID int64, exclude map[string]bool) (string, int64, bool) {
+	c.mutex.Lock()
+	candidates := make(map[string]hostBlockInfo)
+	for host, info := range c.hosts {
+		if info.blockID >= minBlockID && !exclude[host] {
+			candidates[host] = info
+		}
+	}
+	c.mutex.Unlock()
+
+	var (
+		bestHost string
+		best     hostBlockInfo
+	)
+	for host, info := range candidates {
+		if nodesBan.isBanned(host) {
+			continue
+		}
+		if len(bestHost) == 0 || info.blockID > best.blockID ||
+			(info.blockID == best.blockID && info.latency < best.latency) {
+			bestHost, best = host, info
+		}
+	}
+	return bestHost, best.blockID, len(bestHost) > 0
+}
+
+// getCachedHostBlockID returns the max block id of the host from the cache or requests it from the host
+func getCachedHostBlockID(host string, refresh bool, logger *log.Entry) (hostBlockInfo, error) {
+	if !refresh {
+		if info, ok := hostBlocks.get(host); ok {
+			return info, nil
+		}
+	}
+
+	start := time.Now()
+	blockID, err := getHostBlockID(host, logger)
+	if err != nil {
+		return hostBlockInfo{}, err
+	}
+	info := hostBlockInfo{blockID: blockID, latency: time.Since(start), fetchedAt: time.Now()}
+	hostBlocks.set(host, info)
+	return info, nil
+}
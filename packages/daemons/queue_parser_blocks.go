@@ -83,7 +83,7 @@ func QueueParserBlocks(ctx context.Context, d *daemon) error {
 	}
 
 	if queueBlock.FullNodeID == conf.Config.KeyID {
-		d.logger.WithFields(log.Fields{"type": consts.DuplicateObject}).Debug("queueBlock generated by myself", queueBlock.BlockID)
+		d.logger.WithFields(log.Fields{"type": consts.DuplicateObject, "block_id": queueBlock.BlockID}).Debug("queueBlock generated by myself")
 		return utils.ErrInfo(fmt.Errorf("queueBlock generated by myself: %d", queueBlock.BlockID))
 	}
 
@@ -0,0 +1,161 @@
+// MIT License
+//
+// Copyright (c) 2016-2018 GenesisKernel
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemons
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/GenesisKernel/go-genesis/packages/consts"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SyncStatus is the state of the synchronization of the blockchain by BlocksCollection
+type SyncStatus struct {
+	BlockID     int64       // the last block of the local blockchain
+	MaxBlockID  int64       // the biggest block id of the hosts observed by the last cycle
+	Lag         int64       // count of the blocks the node is behind the hosts
+	LastCycle   time.Time   // time of the last successful cycle, zero if there is no one
+	InitialLoad bool        // true while the blockchain is loaded for the first time
+	Hosts       []HostProbe // the probes of the hosts by the last cycle
+}
+
+// HostProbe is the outcome of the request of the max block id from the host
+type HostProbe struct {
+	Host    string
+	BlockID int64
+	Latency time.Duration
+	Error   error // the host is unreachable or incompatible if it isn't nil
+}
+
+type syncState struct {
+	mutex  sync.Mutex
+	status SyncStatus
+}
+
+var syncStatus = &syncState{}
+
+// GetSyncStatus returns the current state of the synchronization of the blockchain.
+// It can be used to decide if the node is caught up enough to serve the requests
+func GetSyncStatus() SyncStatus {
+	syncStatus.mutex.Lock()
+	defer syncStatus.mutex.Unlock()
+
+	status := syncStatus.status
+	status.Hosts = append([]HostProbe(nil), status.Hosts...)
+	if status.MaxBlockID > status.BlockID {
+		status.Lag = status.MaxBlockID - status.BlockID
+	}
+	return status
+}
+
+func (s *syncState) setBlockID(blockID int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.status.BlockID = blockID
+}
+
+func (s *syncState) setMaxBlockID(maxBlockID int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.status.MaxBlockID = maxBlockID
+}
+
+func (s *syncState) setHosts(probes []HostProbe) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.status.Hosts = probes
+}
+
+func (s *syncState) setInitialLoad(initialLoad bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.status.InitialLoad = initialLoad
+}
+
+func (s *syncState) cycleDone() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.status.LastCycle = time.Now()
+}
+
+// CatchUpInfo is the progress of UpdateChain
+type CatchUpInfo struct {
+	BlockID    int64         // the last played block
+	MaxBlockID int64         // the block which UpdateChain is going to reach
+	Rate       float64       // blocks per second since the start of UpdateChain
+	ETA        time.Duration // estimated time to reach MaxBlockID, 0 if the rate is unknown
+}
+
+// CatchUpProgress is called by UpdateChain not more often than once per consts.CatchUpProgressInterval
+// seconds while the blocks are played, nil disables it
+var CatchUpProgress func(CatchUpInfo)
+
+// catchUpReporter logs the progress of UpdateChain on a time-based cadence
+type catchUpReporter struct {
+	startBlockID int64
+	maxBlockID   int64
+	start        time.Time
+	last         time.Time
+	interval     time.Duration
+	logger       *log.Entry
+}
+
+func newCatchUpReporter(startBlockID, maxBlockID int64, logger *log.Entry) *catchUpReporter {
+	now := time.Now()
+	return &catchUpReporter{startBlockID: startBlockID, maxBlockID: maxBlockID, start: now, last: now,
+		interval: consts.CatchUpProgressInterval * time.Second, logger: logger}
+}
+
+// info calculates the rate and ETA for the played blockID
+func (r *catchUpReporter) info(blockID int64, now time.Time) CatchUpInfo {
+	info := CatchUpInfo{BlockID: blockID, MaxBlockID: r.maxBlockID}
+	if elapsed := now.Sub(r.start).Seconds(); elapsed > 0 && blockID > r.startBlockID {
+		info.Rate = float64(blockID-r.startBlockID) / elapsed
+		info.ETA = time.Duration(float64(r.maxBlockID-blockID) / info.Rate * float64(time.Second))
+	}
+	return info
+}
+
+// report reports the progress if the interval has passed since the previous report
+func (r *catchUpReporter) report(blockID int64) {
+	now := time.Now()
+	if now.Sub(r.last) < r.interval {
+		return
+	}
+	r.last = now
+
+	info := r.info(blockID, now)
+	r.logger.WithFields(log.Fields{"block_id": info.BlockID, "max_block_id": info.MaxBlockID,
+		"rate": fmt.Sprintf("%.2f", info.Rate), "eta": info.ETA.Round(time.Second).String()}).Info("catching up")
+	if onProgress := CatchUpProgress; onProgress != nil {
+		onProgress(info)
+	}
+}
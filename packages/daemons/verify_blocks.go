@@ -0,0 +1,129 @@
+// MIT License
+//
+// Copyright (c) 2016-2018 GenesisKernel
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daemons
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/GenesisKernel/go-genesis/packages/consts"
+	"github.com/GenesisKernel/go-genesis/packages/crypto"
+	"github.com/GenesisKernel/go-genesis/packages/model"
+	"github.com/GenesisKernel/go-genesis/packages/parser"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Names of the checks of VerifyBlockRange and ScanChainFile
+const (
+	VerifyCheckRead       = "read"
+	VerifyCheckProcess    = "process"
+	VerifyCheckHash       = "hash"
+	VerifyCheckBlock      = "check"
+	VerifyCheckStoredHash = "stored_hash"
+	VerifyCheckChain      = "chain"
+)
+
+// BlockVerifyResult is the result of the verification of the stored block
+type BlockVerifyResult struct {
+	BlockID int64
+	Valid   bool
+	Check   string // the first failed check
+	Error   error
+}
+
+// VerifyBlockRange checks the stored blocks from 'from' to 'to' inclusive without playing them.
+// It doesn't change the state of the database. The sleep time between blocks is checked
+// against the current full nodes list, so the blocks signed before the list was changed can fail
+func VerifyBlockRange(from, to int64) ([]BlockVerifyResult, error) {
+	if from < 1 || to < from {
+		log.WithFields(log.Fields{"type": consts.InvalidObject, "from": from, "to": to}).Error("wrong block range")
+		return nil, fmt.Errorf("wrong block range %d-%d", from, to)
+	}
+
+	results := make([]BlockVerifyResult, 0, to-from+1)
+	for blockID := from; blockID <= to; blockID++ {
+		block := &model.Block{}
+		found, err := block.Get(blockID)
+		if err != nil {
+			log.WithFields(log.Fields{"type": consts.DBError, "error": err, "block_id": blockID}).Error("getting block by ID")
+			return results, err
+		}
+		if !found {
+			log.WithFields(log.Fields{"type": consts.NotFound, "block_id": blockID}).Error("block not found")
+			results = append(results, BlockVerifyResult{BlockID: blockID, Check: VerifyCheckRead, Error: errors.New("block not found")})
+			continue
+		}
+		results = append(results, verifyStoredBlock(block))
+	}
+	return results, nil
+}
+
+func verifyStoredBlock(stored *model.Block) BlockVerifyResult {
+	res := BlockVerifyResult{BlockID: stored.ID}
+	logger := log.WithFields(log.Fields{"block_id": stored.ID})
+
+	block, err := parser.ProcessBlockWherePrevFromBlockchainTable(stored.Data)
+	if err != nil {
+		logger.WithFields(log.Fields{"type": consts.BlockError, "error": err}).Error("processing block")
+		res.Check, res.Error = VerifyCheckProcess, err
+		return res
+	}
+
+	hashMatched, err := block.CheckHash()
+	if err == nil && !hashMatched {
+		err = fmt.Errorf("block %d hash does not match", stored.ID)
+	}
+	if err != nil {
+		logger.WithFields(log.Fields{"type": consts.BlockError, "error": err}).Error("checking block hash")
+		res.Check, res.Error = VerifyCheckHash, err
+		return res
+	}
+
+	if err = block.CheckStoredBlock(); err != nil {
+		logger.WithFields(log.Fields{"type": consts.BlockError, "error": err}).Error("checking block")
+		res.Check, res.Error = VerifyCheckBlock, err
+		return res
+	}
+
+	hash, err := blockHash(block)
+	if err == nil && !bytes.Equal(hash, stored.Hash) {
+		err = fmt.Errorf("stored hash %x of block %d does not match %x", stored.Hash, stored.ID, hash)
+	}
+	if err != nil {
+		logger.WithFields(log.Fields{"type": consts.InvalidObject, "error": err}).Error("checking stored block hash")
+		res.Check, res.Error = VerifyCheckStoredHash, err
+		return res
+	}
+
+	res.Valid = true
+	return res
+}
+
+// blockHash calculates the hash of the block in the same way as UpdBlockInfo does it
+func blockHash(block *parser.Block) ([]byte, error) {
+	forSha := fmt.Sprintf("%d,%x,%s,%d,%d,%d,%d", block.Header.BlockID, block.PrevHeader.Hash, block.MrklRoot,
+		block.Header.Time, block.Header.EcosystemID, block.Header.KeyID, block.Header.NodePosition)
+	return crypto.DoubleHash([]byte(forSha))
+}
@@ -47,6 +47,11 @@ func RunAllDaemons() error {
 		return err
 	}
 
+	if err := daemons.VerifyFirstBlock(); err != nil {
+		log.Errorf("can't load first block: %s", err)
+		return err
+	}
+
 	log.Info("start daemons")
 	daemons.StartDaemons()
 
@@ -251,4 +251,13 @@ var (
 		"stop_time" int NOT NULL DEFAULT '0'
 		);
 		`
+
+	migrationBannedNodes = `DROP TABLE IF EXISTS "banned_nodes"; CREATE TABLE "banned_nodes" (
+		"host" varchar(255) NOT NULL DEFAULT '',
+		"reason" text NOT NULL DEFAULT '',
+		"ban_time" bigint NOT NULL DEFAULT '0',
+		"expire_time" bigint NOT NULL DEFAULT '0'
+		);
+		ALTER TABLE ONLY "banned_nodes" ADD CONSTRAINT banned_nodes_pkey PRIMARY KEY (host);
+		`
 )
@@ -35,6 +35,9 @@ var migrations = []*migration{
 
 	// Initial schema
 	&migration{"0.1.6b9", migrationInitialSchema},
+
+	// Banned nodes
+	&migration{"0.1.6b11", migrationBannedNodes},
 }
 
 type migration struct {
@@ -0,0 +1,84 @@
+// MIT License
+//
+// Copyright (c) 2016-2018 GenesisKernel
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package model
+
+// BannedNode is model
+type BannedNode struct {
+	Host       string `gorm:"primary_key;not null"`
+	Reason     string `gorm:"not null"`
+	BanTime    int64  `gorm:"not null"`
+	ExpireTime int64  `gorm:"not null"`
+}
+
+// TableName returns name of table
+func (bn *BannedNode) TableName() string {
+	return "banned_nodes"
+}
+
+// Save is saving model
+func (bn *BannedNode) Save() error {
+	return DBConn.Save(bn).Error
+}
+
+// Delete is deleting record
+func (bn *BannedNode) Delete() error {
+	return DBConn.Where("host = ?", bn.Host).Delete(&BannedNode{}).Error
+}
+
+// GetBannedNodes returns the nodes which are banned till now or later
+func GetBannedNodes(now int64) ([]BannedNode, error) {
+	var nodes []BannedNode
+	err := DBConn.Where("expire_time > ?", now).Find(&nodes).Error
+	return nodes, err
+}
+
+// DeleteOldestBannedNodes deletes the records which are over the limit. The expired records are deleted
+// first, if they aren't enough the unexpired records with the oldest ban time are deleted too
+func DeleteOldestBannedNodes(now int64, limit int) error {
+	over, err := bannedNodesOverLimit(limit)
+	if err != nil || over == 0 {
+		return err
+	}
+	err = DBConn.Exec(`DELETE FROM "banned_nodes" WHERE host IN (SELECT host FROM "banned_nodes"
+		WHERE expire_time <= ? ORDER BY expire_time LIMIT ?)`, now, over).Error
+	if err != nil {
+		return err
+	}
+	if over, err = bannedNodesOverLimit(limit); err != nil || over == 0 {
+		return err
+	}
+	return DBConn.Exec(`DELETE FROM "banned_nodes" WHERE host IN (SELECT host FROM "banned_nodes"
+		ORDER BY ban_time, host LIMIT ?)`, over).Error
+}
+
+// bannedNodesOverLimit returns the count of the records which are over the limit
+func bannedNodesOverLimit(limit int) (int, error) {
+	var count int
+	if err := DBConn.Model(&BannedNode{}).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	if count <= limit {
+		return 0, nil
+	}
+	return count - limit, nil
+}
@@ -24,6 +24,7 @@ package parser
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -178,6 +179,7 @@ type Parser struct {
 	TxHeader         *tx.Header
 	txParser         ParserInterface
 	DbTransaction    *model.DbTransaction
+	Context          context.Context // the contract of the transaction is stopped when it is done
 	SysUpdate        bool
 
 	SmartContract smart.SmartContract
@@ -505,6 +507,7 @@ func (p *Parser) CallContract(flags int) (resultContract string, err error) {
 		TxHash:        p.TxHash,
 		PublicKeys:    p.PublicKeys,
 		DbTransaction: p.DbTransaction,
+		Context:       p.Context,
 	}
 	resultContract, err = sc.CallContract(flags)
 	p.SysUpdate = sc.SysUpdate
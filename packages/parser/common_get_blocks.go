@@ -23,6 +23,7 @@
 package parser
 
 import (
+	"context"
 	"errors"
 	"fmt"
 
@@ -36,9 +37,14 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// GetBlocks is returning blocks
-func GetBlocks(blockID int64, host string) error {
-	rollback := syspar.GetRbBlocks1()
+// ErrForkTooDeep is returned by GetBlocks if the host sends more blocks than maxDepth and the fork point
+// hasn't been found, the local blocks aren't changed in this case
+var ErrForkTooDeep = errors.New("fork is deeper than the max rollback depth")
+
+// GetBlocks is returning blocks, it replaces the local blocks after the fork point with the blocks
+// from the host and returns the count of the rolled back local blocks. No more than maxDepth blocks
+// are received from the host
+func GetBlocks(blockID int64, host string, maxDepth int64) (int, error) {
 
 	badBlocks := make(map[int64]string)
 
@@ -48,32 +54,32 @@ func GetBlocks(blockID int64, host string) error {
 	for {
 		if blockID < 2 {
 			log.WithFields(log.Fields{"type": consts.BlockIsFirst}).Error("block id is smaller than 2")
-			return utils.ErrInfo(errors.New("block_id < 2"))
+			return 0, utils.ErrInfo(errors.New("block_id < 2"))
 		}
 		// if the limit of blocks received from the node was exaggerated
-		if count > int64(rollback) {
-			log.WithFields(log.Fields{"count": count, "max_count": int64(rollback)}).Error("limit of received from the node was exaggerated")
-			return utils.ErrInfo(errors.New("count > variables[rollback_blocks]"))
+		if count > maxDepth {
+			log.WithFields(log.Fields{"type": consts.ParameterExceeded, "count": count, "max_count": maxDepth}).Error("limit of received from the node was exaggerated")
+			return 0, ErrForkTooDeep
 		}
 
 		// load the block body from the host
-		binaryBlock, err := utils.GetBlockBody(host, blockID, consts.DATA_TYPE_BLOCK_BODY)
+		binaryBlock, err := utils.GetBlockBody(host, blockID, consts.DATA_TYPE_BLOCK_BODY, syspar.GetMaxBlockSize())
 		if err != nil {
-			return utils.ErrInfo(err)
+			return 0, utils.ErrInfo(err)
 		}
 
 		block, err := ProcessBlockWherePrevFromBlockchainTable(binaryBlock)
 		if err != nil {
-			return utils.ErrInfo(err)
+			return 0, utils.ErrInfo(err)
 		}
 
 		if badBlocks[block.Header.BlockID] == string(converter.BinToHex(block.Header.Sign)) {
 			log.WithFields(log.Fields{"block_id": block.Header.BlockID, "type": consts.InvalidObject}).Error("block is bad")
-			return utils.ErrInfo(errors.New("bad block"))
+			return 0, utils.ErrInfo(errors.New("bad block"))
 		}
 		if block.Header.BlockID != blockID {
 			log.WithFields(log.Fields{"header_block_id": block.Header.BlockID, "block_id": blockID, "type": consts.InvalidObject}).Error("block ids does not match")
-			return utils.ErrInfo(errors.New("bad block_data['block_id']"))
+			return 0, utils.ErrInfo(errors.New("bad block_data['block_id']"))
 		}
 
 		// TODO: add checking for MAX_BLOCK_SIZE
@@ -82,7 +88,7 @@ func GetBlocks(blockID int64, host string) error {
 		nodePublicKey, err := syspar.GetNodePublicKeyByPosition(block.Header.NodePosition)
 		if err != nil {
 			log.WithFields(log.Fields{"header_block_id": block.Header.BlockID, "block_id": blockID, "type": consts.InvalidObject}).Error("block ids does not match")
-			return utils.ErrInfo(err)
+			return 0, utils.ErrInfo(err)
 		}
 
 		// SIGN from 128 bytes to 512 bytes. Signature of TYPE, BLOCK_ID, PREV_BLOCK_HASH, TIME, WALLET_ID, state_id, MRKL_ROOT
@@ -111,7 +117,7 @@ func GetBlocks(blockID int64, host string) error {
 			"error": err,
 			"type":  consts.DBError,
 		}).Error("marking verified and not used transactions unverified")
-		return utils.ErrInfo(err)
+		return 0, utils.ErrInfo(err)
 	}
 
 	// we have the slice of blocks for applying
@@ -120,19 +126,19 @@ func GetBlocks(blockID int64, host string) error {
 	myRollbackBlocks, err := block.GetBlocksFrom(blockID, "desc")
 	if err != nil {
 		log.WithFields(log.Fields{"error": err, "type": consts.DBError}).Error("getting rollback blocks from blockID")
-		return utils.ErrInfo(err)
+		return 0, utils.ErrInfo(err)
 	}
 	for _, block := range myRollbackBlocks {
 		err := RollbackTxFromBlock(block.Data)
 		if err != nil {
-			return utils.ErrInfo(err)
+			return 0, utils.ErrInfo(err)
 		}
 	}
 
 	dbTransaction, err := model.StartTransaction()
 	if err != nil {
 		log.WithFields(log.Fields{"error": err, "type": consts.DBError}).Error("starting transaction")
-		return utils.ErrInfo(err)
+		return 0, utils.ErrInfo(err)
 	}
 
 	// go through new blocks from the smallest block_id to the largest block_id
@@ -159,12 +165,12 @@ func GetBlocks(blockID int64, host string) error {
 
 		if err := block.CheckBlock(); err != nil {
 			dbTransaction.Rollback()
-			return utils.ErrInfo(err)
+			return 0, utils.ErrInfo(err)
 		}
 
-		if err := block.playBlock(dbTransaction); err != nil {
+		if err := block.playBlock(context.Background(), dbTransaction); err != nil {
 			dbTransaction.Rollback()
-			return utils.ErrInfo(err)
+			return 0, utils.ErrInfo(err)
 		}
 		prevBlocks[block.Header.BlockID] = block
 
@@ -173,13 +179,13 @@ func GetBlocks(blockID int64, host string) error {
 			err := UpdBlockInfo(dbTransaction, block)
 			if err != nil {
 				dbTransaction.Rollback()
-				return utils.ErrInfo(err)
+				return 0, utils.ErrInfo(err)
 			}
 		}
 		if block.SysUpdate {
 			if err := syspar.SysUpdate(dbTransaction); err != nil {
 				log.WithFields(log.Fields{"type": consts.DBError, "error": err}).Error("updating syspar")
-				return utils.ErrInfo(err)
+				return 0, utils.ErrInfo(err)
 			}
 		}
 	}
@@ -192,15 +198,17 @@ func GetBlocks(blockID int64, host string) error {
 		err = b.DeleteById(dbTransaction, block.Header.BlockID)
 		if err != nil {
 			dbTransaction.Rollback()
-			return err
+			return 0, err
 		}
 		// insert new blocks into blockchain
 		if err := InsertIntoBlockchain(dbTransaction, block); err != nil {
 			dbTransaction.Rollback()
-			return err
+			return 0, err
 		}
 	}
 
-	err = dbTransaction.Commit()
-	return err
+	if err = dbTransaction.Commit(); err != nil {
+		return 0, err
+	}
+	return len(myRollbackBlocks), nil
 }
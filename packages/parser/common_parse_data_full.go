@@ -24,7 +24,9 @@ package parser
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -52,6 +54,9 @@ type Block struct {
 	BinData    []byte
 	Parsers    []*Parser
 	SysUpdate  bool
+
+	// the node public key and the previous hash which the signature has been checked with by PreCheckHash
+	checkedKey, checkedPrevHash []byte
 }
 
 // GetLogger is returns logger
@@ -62,17 +67,38 @@ func (b Block) GetLogger() *log.Entry {
 
 // InsertBlockWOForks is inserting blocks
 func InsertBlockWOForks(data []byte) error {
+	return InsertBlockWOForksContext(context.Background(), data)
+}
+
+// InsertBlockWOForksContext is inserting blocks, it stops between the transactions of the block if ctx is done
+func InsertBlockWOForksContext(ctx context.Context, data []byte) error {
 	block, err := ProcessBlockWherePrevFromBlockchainTable(data)
 	if err != nil {
 		return err
 	}
+	return InsertParsedBlockWOForksContext(ctx, block)
+}
+
+// InsertParsedBlockWOForks is inserting the block which has been parsed by ParseBlock.
+// The previous block is read from the blockchain table, so the blocks must be inserted in order
+func InsertParsedBlockWOForks(block *Block) error {
+	return InsertParsedBlockWOForksContext(context.Background(), block)
+}
+
+// InsertParsedBlockWOForksContext is inserting the parsed block like InsertParsedBlockWOForks, but it
+// stops between the transactions of the block if ctx is done. Nothing of the block is committed in this case
+func InsertParsedBlockWOForksContext(ctx context.Context, block *Block) error {
+	if block.PrevHeader == nil {
+		if err := block.readPreviousBlockFromBlockchainTable(); err != nil {
+			return err
+		}
+	}
 
 	if err := block.CheckBlock(); err != nil {
 		return err
 	}
 
-	err = block.PlayBlockSafe()
-	if err != nil {
+	if err := block.PlayBlockSafeContext(ctx); err != nil {
 		return err
 	}
 
@@ -82,6 +108,12 @@ func InsertBlockWOForks(data []byte) error {
 
 // PlayBlockSafe is inserting block safely
 func (b *Block) PlayBlockSafe() error {
+	return b.PlayBlockSafeContext(context.Background())
+}
+
+// PlayBlockSafeContext is inserting block safely, it stops between the transactions of the block
+// if ctx is done. Nothing of the block is committed in this case and the error of ctx is returned
+func (b *Block) PlayBlockSafeContext(ctx context.Context) error {
 	logger := b.GetLogger()
 	dbTransaction, err := model.StartTransaction()
 	if err != nil {
@@ -89,7 +121,7 @@ func (b *Block) PlayBlockSafe() error {
 		return err
 	}
 
-	err = b.playBlock(dbTransaction)
+	err = b.playBlock(ctx, dbTransaction)
 	if err != nil {
 		dbTransaction.Rollback()
 		return err
@@ -105,7 +137,16 @@ func (b *Block) PlayBlockSafe() error {
 		return err
 	}
 
-	dbTransaction.Commit()
+	if err := ctx.Err(); err != nil {
+		logger.WithFields(log.Fields{"type": consts.ContextError, "error": err}).Error("playing block is stopped")
+		dbTransaction.Rollback()
+		return err
+	}
+	if err := dbTransaction.Commit(); err != nil {
+		logger.WithFields(log.Fields{"type": consts.DBError, "error": err}).Error("committing db transaction")
+		dbTransaction.Rollback()
+		return err
+	}
 	if b.SysUpdate {
 		b.SysUpdate = false
 		if err = syspar.SysUpdate(nil); err != nil {
@@ -143,6 +184,21 @@ func ProcessBlockWherePrevFromMemory(data []byte) (*Block, error) {
 
 // ProcessBlockWherePrevFromBlockchainTable is processing block with in table previous block
 func ProcessBlockWherePrevFromBlockchainTable(data []byte) (*Block, error) {
+	block, err := ParseBlock(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := block.readPreviousBlockFromBlockchainTable(); err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+// ParseBlock parses the block and its transactions without reading the previous block, so it
+// doesn't depend on the state of the blockchain and the blocks can be parsed concurrently
+func ParseBlock(data []byte) (*Block, error) {
 	if int64(len(data)) > syspar.GetMaxBlockSize() {
 		log.WithFields(log.Fields{"size": len(data), "max_size": syspar.GetMaxBlockSize(), "type": consts.ParameterExceeded}).Error("binary block size exceeds max block size")
 		return nil, utils.ErrInfo(fmt.Errorf(`len(binaryBlock) > variables.Int64["max_block_size"]`))
@@ -160,10 +216,6 @@ func ProcessBlockWherePrevFromBlockchainTable(data []byte) (*Block, error) {
 	}
 	block.BinData = data
 
-	if err := block.readPreviousBlockFromBlockchainTable(); err != nil {
-		return nil, err
-	}
-
 	return block, nil
 }
 
@@ -511,6 +563,11 @@ func checkTransaction(p *Parser, checkTime int64, checkForDupTr bool) error {
 	if err != nil {
 		return utils.ErrInfo(err)
 	}
+	return checkTransactionTime(p, checkTime)
+}
+
+// checkTransactionTime checks the transaction time and the key id without looking for duplicates
+func checkTransactionTime(p *Parser, checkTime int64) error {
 	logger := log.WithFields(log.Fields{"tx_type": p.dataType, "tx_time": p.TxTime, "tx_state_id": p.TxEcosystemID})
 	// time in the transaction cannot be more than MAX_TX_FORW seconds of block time
 	if p.TxTime-consts.MAX_TX_FORW > checkTime {
@@ -588,18 +645,31 @@ func playTransaction(p *Parser) (string, error) {
 	return "", nil
 }
 
-func (b *Block) playBlock(dbTransaction *model.DbTransaction) error {
+func (b *Block) playBlock(ctx context.Context, dbTransaction *model.DbTransaction) error {
 	logger := b.GetLogger()
+	if err := ctx.Err(); err != nil {
+		logger.WithFields(log.Fields{"type": consts.ContextError, "error": err}).Error("playing block is stopped")
+		return err
+	}
 	if _, err := model.DeleteUsedTransactions(dbTransaction); err != nil {
 		logger.WithFields(log.Fields{"type": consts.DBError, "error": err}).Error("delete used transactions")
 		return err
 	}
 
 	for _, p := range b.Parsers {
-		p.DbTransaction = dbTransaction
+		if err := ctx.Err(); err != nil {
+			logger.WithFields(log.Fields{"type": consts.ContextError, "error": err, "tx_hash": p.TxHash}).Error("playing block is stopped")
+			return err
+		}
+		p.DbTransaction, p.Context = dbTransaction, ctx
 
 		msg, err := playTransaction(p)
 		if err != nil {
+			// the transaction which has been stopped isn't bad, the whole block is rolled back
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				logger.WithFields(log.Fields{"type": consts.ContextError, "error": ctxErr, "tx_hash": p.TxHash}).Error("playing transaction is stopped")
+				return ctxErr
+			}
 			// skip this transaction
 			model.MarkTransactionUsed(nil, p.TxHash)
 			p.processBadTransaction(p.TxHash, err.Error())
@@ -636,11 +706,35 @@ func (b *Block) playBlock(dbTransaction *model.DbTransaction) error {
 
 // CheckBlock is checking block
 func (b *Block) CheckBlock() error {
+	return b.checkBlock(false)
+}
+
+// CheckStoredBlock is checking block which has been already played,
+// its transactions are not checked for duplicates in log_transactions
+func (b *Block) CheckStoredBlock() error {
+	return b.checkBlock(true)
+}
+
+// ErrBlockFromFuture is returned if the time of the block is ahead of the local time more than the drift
+var ErrBlockFromFuture = errors.New("block time is in the future")
+
+// CheckBlockTime checks that the time of the block doesn't exceed now more than drift seconds
+func CheckBlockTime(blockTime, now, drift int64) error {
+	if drift < 0 {
+		drift = 0
+	}
+	if blockTime > now+drift {
+		return ErrBlockFromFuture
+	}
+	return nil
+}
+
+func (b *Block) checkBlock(stored bool) error {
 	logger := b.GetLogger()
 	// exclude blocks from future
-	if b.Header.Time > time.Now().Unix() {
-		logger.WithFields(log.Fields{"type": consts.ParameterExceeded}).Error("block time is larger than now")
-		return utils.ErrInfo(fmt.Errorf("incorrect block time - block.Header.Time > time.Now().Unix()"))
+	if err := CheckBlockTime(b.Header.Time, time.Now().Unix(), 0); err != nil {
+		logger.WithFields(log.Fields{"type": consts.ParameterExceeded, "block_time": b.Header.Time}).Error("block time is larger than now")
+		return utils.ErrInfo(err)
 	}
 	if b.PrevHeader == nil || b.PrevHeader.BlockID != b.Header.BlockID-1 {
 		if err := b.readPreviousBlockFromBlockchainTable(); err != nil {
@@ -688,7 +782,13 @@ func (b *Block) CheckBlock() error {
 			return utils.ErrInfo(fmt.Errorf("max_block_user_transactions"))
 		}
 
-		if err := checkTransaction(p, b.Header.Time, false); err != nil {
+		var err error
+		if stored {
+			err = checkTransactionTime(p, b.Header.Time)
+		} else {
+			err = checkTransaction(p, b.Header.Time, false)
+		}
+		if err != nil {
 			return utils.ErrInfo(err)
 		}
 
@@ -721,6 +821,9 @@ func (b *Block) CheckHash() (bool, error) {
 			logger.WithFields(log.Fields{"type": consts.EmptyObject}).Error("node public key is empty")
 			return false, utils.ErrInfo(fmt.Errorf("empty nodePublicKey"))
 		}
+		if b.checkedKey != nil && bytes.Equal(b.checkedKey, nodePublicKey) && bytes.Equal(b.checkedPrevHash, b.PrevHeader.Hash) {
+			return true, nil
+		}
 		// check the signature
 		forSign := fmt.Sprintf("0,%d,%x,%d,%d,%d,%d,%s", b.Header.BlockID, b.PrevHeader.Hash,
 			b.Header.Time, b.Header.EcosystemID, b.Header.KeyID, b.Header.NodePosition, b.MrklRoot)
@@ -737,6 +840,28 @@ func (b *Block) CheckHash() (bool, error) {
 	return true, nil
 }
 
+// PreCheckHash checks the signature of the block with PrevHeader like CheckHash before the block is inserted,
+// so the signatures of the blocks can be checked concurrently. CheckHash doesn't check the signature again
+// if the previous hash is the same and the public key of the node hasn't been changed since that
+func (b *Block) PreCheckHash() error {
+	if b.Header.BlockID == 1 || b.PrevHeader == nil {
+		return nil
+	}
+	nodePublicKey, err := syspar.GetNodePublicKeyByPosition(b.Header.NodePosition)
+	if err != nil {
+		return utils.ErrInfo(err)
+	}
+	result, err := b.CheckHash()
+	if err != nil {
+		return err
+	}
+	if !result {
+		return fmt.Errorf("incorrect signature / p.PrevBlock.BlockId: %d", b.PrevHeader.BlockID)
+	}
+	b.checkedKey, b.checkedPrevHash = nodePublicKey, b.PrevHeader.Hash
+	return nil
+}
+
 // MarshallBlock is marshalling block
 func MarshallBlock(header *utils.BlockData, trData [][]byte, prevHash []byte, key string) ([]byte, error) {
 	var mrklArray [][]byte
@@ -25,7 +25,9 @@ package script
 import (
 	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/GenesisKernel/go-genesis/packages/consts"
 
@@ -662,12 +664,24 @@ func fNameBlock(buf *[]*Block, state int, lexem *Lexem) error {
 }
 
 // CompileBlock compile the source code into the Block structure with a byte-code
-func (vm *VM) CompileBlock(input []rune, owner *OwnerInfo) (*Block, error) {
-	root := &Block{Info: owner.StateID, Owner: owner}
+func (vm *VM) CompileBlock(input []rune, owner *OwnerInfo) (root *Block, err error) {
+	// the references of the failed source are not checked by FlushExtern
+	refs := len(vm.stateRefs)
+	defer func() {
+		if err != nil {
+			vm.stateRefs = vm.stateRefs[:refs]
+		}
+	}()
 	lexems, err := lexParser(input)
 	if err != nil {
 		return nil, err
 	}
+	return vm.compileLexems(lexems, owner)
+}
+
+// compileLexems compiles the lexems of the source into the root block
+func (vm *VM) compileLexems(lexems Lexems, owner *OwnerInfo) (*Block, error) {
+	root := &Block{Info: owner.StateID, Owner: owner}
 	if len(lexems) == 0 {
 		return root, nil
 	}
@@ -740,6 +754,9 @@ func (vm *VM) CompileBlock(input []rune, owner *OwnerInfo) (*Block, error) {
 					(*prev).Code = append((*prev).Code, &ByteCode{cmdContinue, 0})
 				}
 			}
+			if vm.SourceLines {
+				blockstack[len(blockstack)-1].addLines(lexem.Line)
+			}
 			blockstack = blockstack[:len(blockstack)-1]
 		}
 		if (newState.NewState & stateToBlock) > 0 {
@@ -748,24 +765,156 @@ func (vm *VM) CompileBlock(input []rune, owner *OwnerInfo) (*Block, error) {
 		if (newState.NewState & stateToBody) > 0 {
 			nextState = stateBody
 		}
+		if newState.Func == cfFParam && vm.NoShadowing {
+			if err := vm.checkShadowing(lexem, &blockstack); err != nil {
+				return nil, err
+			}
+		}
 		if newState.Func > 0 {
 			if err := funcs[newState.Func](&blockstack, nextState, lexem); err != nil {
 				return nil, err
 			}
 		}
+		if vm.SourceLines {
+			for _, block := range blockstack {
+				block.addLines(lexem.Line)
+			}
+		}
 		curState = nextState
 	}
 	if len(stack) > 0 {
 		return nil, fError(&blockstack, errMustRCurly, lexems[len(lexems)-1])
 	}
+	for _, item := range root.Children {
+		if item.Type == ObjContract {
+			item.Info.(*ContractInfo).VMType = vm.VMType
+			if err := vm.checkMethods(item); err != nil {
+				return nil, err
+			}
+			if err := vm.checkTxParams(item.Info.(*ContractInfo)); err != nil {
+				return nil, err
+			}
+			if isReadOnly(item.Info.(*ContractInfo)) {
+				if err := vm.checkReadOnly(item); err != nil {
+					return nil, err
+				}
+			}
+			if vm.FuncPolicy != nil {
+				if err := vm.checkFuncPolicy(item); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
 	return root, nil
 }
 
+// checkMethods returns an error if any of the methods of the contract called by ExecContract
+// is not a function or has parameters. The other functions of the contract are not checked
+func (vm *VM) checkMethods(contract *Block) error {
+	for _, method := range vm.methods {
+		obj, ok := contract.Objects[method]
+		if !ok {
+			continue
+		}
+		if obj.Type != ObjFunc || len(obj.Value.(*Block).Info.(*FuncInfo).Params) > 0 {
+			name := contract.Info.(*ContractInfo).Name
+			log.WithFields(log.Fields{"type": consts.ParseError, "contract_name": name, "method_name": method}).Error("wrong contract method")
+			return fmt.Errorf(eMethodParams, method, name)
+		}
+	}
+	return nil
+}
+
+// isReadOnly returns true if the contract has 'readonly = 1' in its settings
+func isReadOnly(info *ContractInfo) bool {
+	val, ok := info.Settings[`readonly`]
+	return ok && fmt.Sprint(val) == `1`
+}
+
+// checkReadOnly returns an error if the contract calls any extended function out of vm.ReadOnlyFuncs
+func (vm *VM) checkReadOnly(contract *Block) error {
+	cname := contract.Info.(*ContractInfo).Name
+	return walkExtFuncs(contract, make(map[*Block]bool), func(name string) error {
+		if _, ok := vm.ReadOnlyFuncs[name]; !ok {
+			log.WithFields(log.Fields{"type": consts.ParseError, "contract_name": cname, "func_name": name}).Error("read-only contract calls not allowed function")
+			return fmt.Errorf(eReadOnlyCall, cname, name)
+		}
+		return nil
+	})
+}
+
+// checkFuncPolicy returns an error if the contract calls any extended function forbidden by vm.FuncPolicy
+func (vm *VM) checkFuncPolicy(contract *Block) error {
+	cname := contract.Info.(*ContractInfo).Name
+	return walkExtFuncs(contract, make(map[*Block]bool), func(name string) error {
+		if !vm.FuncPolicy.Allowed(name) {
+			log.WithFields(log.Fields{"type": consts.ParseError, "contract_name": cname, "func_name": name}).Error("contract calls forbidden function")
+			return fmt.Errorf(eForbiddenCall, cname, name)
+		}
+		return nil
+	})
+}
+
+// walkExtFuncs walks the byte-code of the block and its children including the called functions
+// and calls check for every called extended function
+func walkExtFuncs(block *Block, visited map[*Block]bool, check func(string) error) error {
+	if visited[block] {
+		return nil
+	}
+	visited[block] = true
+	for _, code := range block.Code {
+		if code.Cmd != cmdCall && code.Cmd != cmdCallVari {
+			continue
+		}
+		obj := code.Value.(*ObjInfo)
+		switch obj.Type {
+		case ObjExtFunc:
+			if err := check(obj.Value.(ExtFuncInfo).Name); err != nil {
+				return err
+			}
+		case ObjFunc:
+			if err := walkExtFuncs(obj.Value.(*Block), visited, check); err != nil {
+				return err
+			}
+		}
+	}
+	for _, child := range block.Children {
+		if err := walkExtFuncs(child, visited, check); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addLines sets the line of the source code for the new instructions of the block
+func (block *Block) addLines(line uint32) {
+	if len(block.Lines) > len(block.Code) {
+		block.Lines = block.Lines[:len(block.Code)]
+	}
+	for len(block.Lines) < len(block.Code) {
+		block.Lines = append(block.Lines, line)
+	}
+}
+
+// SourceLine returns the line of the source code of the pc instruction of the block.
+// It returns 0 if the block has been compiled without the line table
+func (block *Block) SourceLine(pc int) int {
+	if pc < 0 || pc >= len(block.Lines) {
+		return 0
+	}
+	return int(block.Lines[pc])
+}
+
 // FlushBlock loads the compiled Block into the virtual machine
 func (vm *VM) FlushBlock(root *Block) {
+	vm.flushMutex.Lock()
+	defer vm.flushMutex.Unlock()
+
 	shift := len(vm.Children)
 	for key, item := range root.Objects {
 		if cur, ok := vm.Objects[key]; ok {
+			vm.compiled.invalidate(key)
 			switch item.Type {
 			case ObjContract:
 				root.Objects[key].Value.(*Block).Info.(*ContractInfo).ID = cur.Value.(*Block).Info.(*ContractInfo).ID + flushMark
@@ -801,12 +950,224 @@ func (vm *VM) FlushBlock(root *Block) {
 	}
 }
 
-// FlushExtern switches off the extern mode of the compilation
-func (vm *VM) FlushExtern() {
+// ReplaceContract compiles the source of the name contract and replaces the loaded contract with it.
+// The source must contain only this contract. The new contract keeps the identifier and the owner
+// of the replaced one. The virtual machine is not changed if the compilation or the validation fails
+func (vm *VM) ReplaceContract(name, source string) error {
+	cur, ok := vm.Objects[name]
+	if !ok || cur.Type != ObjContract {
+		log.WithFields(log.Fields{"type": consts.ContractError, "contract_name": name}).Error("unknown contract")
+		return newError(ErrUnknownContract, eUnknownContract, name)
+	}
+	curInfo := cur.Value.(*Block).Info.(*ContractInfo)
+	root, err := vm.CompileBlock([]rune(source), curInfo.Owner)
+	if err != nil {
+		return err
+	}
+	item, ok := root.Objects[name]
+	if !ok || item.Type != ObjContract || len(root.Children) != 1 {
+		log.WithFields(log.Fields{"type": consts.ContractError, "contract_name": name}).Error("source must contain only the replaced contract")
+		return fmt.Errorf(eReplaceContract, name)
+	}
+	vm.FlushBlock(root)
+	return nil
+}
+
+// RemoveContract removes the loaded name contract from the virtual machine and frees its slot
+// in Children. The contract can't be removed while other loaded contracts call it, in this case
+// the error lists them. The contracts compiled in the extern mode which call it are not tracked
+func (vm *VM) RemoveContract(name string) error {
+	vm.flushMutex.Lock()
+	defer vm.flushMutex.Unlock()
+
+	cur, ok := vm.Objects[name]
+	if !ok || cur.Type != ObjContract {
+		log.WithFields(log.Fields{"type": consts.ContractError, "contract_name": name}).Error("unknown contract")
+		return newError(ErrUnknownContract, eUnknownContract, name)
+	}
+	id := cur.Value.(*Block).Info.(*ContractInfo).ID
+	dependents := make([]string, 0)
+	for _, block := range vm.Children {
+		if block == nil || block.Type != ObjContract {
+			continue
+		}
+		info := block.Info.(*ContractInfo)
+		if info.ID != id && info.Used[name] {
+			dependents = append(dependents, info.Name)
+		}
+	}
+	if len(dependents) > 0 {
+		sort.Strings(dependents)
+		log.WithFields(log.Fields{"type": consts.ContractError, "contract_name": name, "dependents": dependents}).Error("removing used contract")
+		return newError(ErrContractInUse, eContractInUse, name, strings.Join(dependents, `, `))
+	}
+	delete(vm.Objects, name)
+	vm.compiled.invalidate(name)
+	if int(id) < len(vm.Children) {
+		vm.Children[id] = nil
+	}
+	return nil
+}
+
+// CompileBatch compiles the set of the interdependent sources, the keys of sources are used only
+// in the error messages. The sources are compiled in passes, each pass compiles the sources which
+// refer to the already loaded objects. If there are cyclic references between the contracts,
+// the rest sources are compiled in the extern mode and the called contracts are looked up
+// at run time. Nothing is loaded into the virtual machine if any source can't be compiled
+func (vm *VM) CompileBatch(sources map[string]string, owner *OwnerInfo) error {
+	snap := vm.Snapshot()
+	pending := make([]string, 0, len(sources))
+	for name := range sources {
+		pending = append(pending, name)
+	}
+	sort.Strings(pending)
+
+	for len(pending) > 0 {
+		rest := make([]string, 0, len(pending))
+		for _, name := range pending {
+			if err := vm.Compile([]rune(sources[name]), owner); err != nil {
+				rest = append(rest, name)
+			}
+		}
+		if len(rest) < len(pending) {
+			pending = rest
+			continue
+		}
+		extern := vm.Extern
+		vm.Extern = true
+		for _, name := range rest {
+			if err := vm.Compile([]rune(sources[name]), owner); err != nil {
+				log.WithFields(log.Fields{"type": consts.ParseError, "source": name, "error": err}).Error("compiling batch")
+				vm.Extern = extern
+				vm.Restore(snap)
+				return fmt.Errorf(eCompileBatch, name, err)
+			}
+		}
+		vm.Extern = extern
+		break
+	}
+	return nil
+}
+
+// CompileExtern compiles the source in the extern mode with the new virtual machine, e.g. to check
+// the contracts before they are deployed. The contracts and the functions of the source belong to
+// the first ecosystem. In the extern mode the calls of the unknown contracts and functions are compiled
+// as the calls of the contracts which are looked up at run time, so neither their existence nor
+// their parameters are checked. The virtual machine has only the built-in functions, so the extended
+// functions of the platform are considered as the contracts too. All other errors are returned:
+// if the source can't be compiled, each top-level contract and function is compiled separately and
+// the errors of all of them are returned with the nil block
+func CompileExtern(src string) (*Block, []error) {
+	owner := &OwnerInfo{StateID: 1, Active: true}
+	vm := NewVM()
+	vm.Extern = true
+	lexems, err := lexParser([]rune(src))
+	if err != nil {
+		return nil, []error{err}
+	}
+	root, err := vm.compileLexems(lexems, owner)
+	if err == nil {
+		return root, nil
+	}
+
+	// the objects are compiled one by one, the compiled ones are loaded so the next ones can use them
+	vm = NewVM()
+	vm.Extern = true
+	errs := make([]error, 0)
+	for _, part := range splitLexems(lexems) {
+		part, err := vm.compileLexems(part, owner)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		vm.FlushBlock(part)
+	}
+	if len(errs) == 0 {
+		// the source is wrong as a whole, e.g. it has an unpaired curly bracket
+		errs = append(errs, err)
+	}
+	return nil, errs
+}
+
+// splitLexems splits the lexems of the source into the top-level objects, the rest lexems
+// after the last closed object are returned as the last part
+func splitLexems(lexems Lexems) []Lexems {
+	var (
+		parts []Lexems
+		depth int
+		start int
+	)
+	for i, lexem := range lexems {
+		switch lexem.Type {
+		case isLCurly:
+			depth++
+		case isRCurly:
+			depth--
+			if depth == 0 {
+				parts = append(parts, lexems[start:i+1])
+				start = i + 1
+			}
+		}
+	}
+	for _, lexem := range lexems[start:] {
+		if lexem.Type != lexNewLine {
+			parts = append(parts, lexems[start:])
+			break
+		}
+	}
+	return parts
+}
+
+// FlushExtern switches off the extern mode of the compilation. It returns an error if any contract
+// called with the state prefix, e.g. @1name, has not been loaded while the extern mode was on.
+// All such calls are logged and the error of the first of them is returned
+func (vm *VM) FlushExtern() (err error) {
 	vm.Extern = false
+	refs := vm.stateRefs
+	vm.stateRefs = nil
+	for _, ref := range refs {
+		if obj := vm.getObjByNameExt(ref.name, ref.state); obj != nil && obj.Type == ObjContract {
+			continue
+		}
+		vm.logger.WithFields(log.Fields{"type": consts.ContractError, "contract_name": ref.name, "caller": ref.caller,
+			"line": ref.line, "column": ref.column}).Error("unknown contract")
+		if err == nil {
+			err = newError(ErrUnknownContract, eUnknownReference, ref.name, ref.caller, ref.line, ref.column)
+		}
+	}
 	return
 }
 
+// stateRef is the call of the contract with the state prefix which is checked by FlushExtern
+type stateRef struct {
+	name   string
+	state  uint32
+	caller string // the name of the contract or the function which calls the contract
+	line   uint32
+	column uint32
+}
+
+// checkStateRef checks the call of the unknown contract with the state prefix. The call is an error
+// in the normal mode and the contract is checked later by FlushExtern in the extern mode
+func (vm *VM) checkStateRef(lexem *Lexem, block *[]*Block) error {
+	ref := stateRef{name: lexem.Value.(string), state: (*block)[0].Info.(uint32), line: lexem.Line, column: lexem.Column}
+	if len(*block) > 1 {
+		for name, obj := range (*block)[0].Objects {
+			if obj.Value == (*block)[1] {
+				ref.caller = name
+				break
+			}
+		}
+	}
+	if vm.Extern {
+		vm.stateRefs = append(vm.stateRefs, ref)
+		return nil
+	}
+	logger := lexem.GetLogger()
+	logger.WithFields(log.Fields{"type": consts.ParseError, "contract_name": ref.name, "caller": ref.caller}).Error("unknown contract")
+	return newError(ErrUnknownContract, eUnknownReference, ref.name, ref.caller, ref.line, ref.column)
+}
+
 // Compile compiles a source code and loads the byte-code into the virtual machine
 func (vm *VM) Compile(input []rune, owner *OwnerInfo) error {
 	root, err := vm.CompileBlock(input, owner)
@@ -816,6 +1177,48 @@ func (vm *VM) Compile(input []rune, owner *OwnerInfo) error {
 	return err
 }
 
+// checkShadowing returns an error if the declared variable or parameter has the name of the object
+// of the enclosing blocks or of the virtual machine, or the name of the data field of the contract
+// which is available as the extend variable
+func (vm *VM) checkShadowing(lexem *Lexem, block *[]*Block) error {
+	name := lexem.Value.(string)
+	var shadowed string
+	if obj, _ := findVar(name, block); obj != nil {
+		shadowed = objKind(obj.Type)
+	} else if obj, ok := vm.Objects[name]; ok {
+		shadowed = objKind(obj.Type)
+	} else if obj, ok := vm.Objects[StateName((*block)[0].Info.(uint32), name)]; ok {
+		shadowed = objKind(obj.Type)
+	}
+	for _, item := range *block {
+		if item.Type != ObjContract || item.Info.(*ContractInfo).Tx == nil {
+			continue
+		}
+		for _, tx := range *item.Info.(*ContractInfo).Tx {
+			if tx.Name == name {
+				shadowed = `data field`
+			}
+		}
+	}
+	if len(shadowed) == 0 {
+		return nil
+	}
+	logger := lexem.GetLogger()
+	logger.WithFields(log.Fields{"type": consts.ParseError, "lex_value": name, "shadowed": shadowed}).Error("declaration shadows name")
+	return newError(ErrShadowing, eShadowing, name, shadowed, lexem.Line, lexem.Column)
+}
+
+// objKind returns the name of the type of the object for the error messages
+func objKind(objType int) string {
+	switch objType {
+	case ObjContract:
+		return `contract`
+	case ObjFunc, ObjExtFunc:
+		return `function`
+	}
+	return `variable`
+}
+
 func findVar(name string, block *[]*Block) (ret *ObjInfo, owner *Block) {
 	var ok bool
 	i := len(*block) - 1
@@ -1068,6 +1471,12 @@ main:
 			}
 		case lexIdent:
 			objInfo, tobj := vm.findObj(lexem.Value.(string), block)
+			if objInfo == nil && strings.HasPrefix(lexem.Value.(string), `@`) && i < len(*lexems)-2 &&
+				(*lexems)[i+1].Type == isLPar {
+				if err := vm.checkStateRef(lexem, block); err != nil {
+					return err
+				}
+			}
 			if objInfo == nil && (!vm.Extern || i > *ind || i >= len(*lexems)-2 || (*lexems)[i+1].Type != isLPar) {
 				logger.WithFields(log.Fields{"lex_value": lexem.Value.(string), "type": consts.ParseError}).Error("unknown identifier")
 				return fmt.Errorf(`unknown identifier %s`, lexem.Value.(string))
@@ -1081,7 +1490,7 @@ main:
 					if objInfo == nil || (objInfo.Type != ObjExtFunc && objInfo.Type != ObjFunc &&
 						objInfo.Type != ObjContract) {
 						logger.WithFields(log.Fields{"lex_value": lexem.Value.(string), "type": consts.ParseError}).Error("unknown function")
-						return fmt.Errorf(`unknown function %s`, lexem.Value.(string))
+						return newError(ErrUnknownFunc, eUnknownFunc, lexem.Value.(string))
 					}
 					if objInfo.Type == ObjContract {
 						objInfo, tobj = vm.findObj(`ExecContract`, block)
@@ -1102,10 +1511,7 @@ main:
 						for j := len(*block) - 1; j >= 0; j-- {
 							topblock := (*block)[j]
 							if topblock.Type == ObjContract {
-								if topblock.Info.(*ContractInfo).Used == nil {
-									topblock.Info.(*ContractInfo).Used = make(map[string]bool)
-								}
-								topblock.Info.(*ContractInfo).Used[name] = true
+								topblock.Info.(*ContractInfo).addUsed(name)
 							}
 						}
 						bytecode = append(bytecode, &ByteCode{cmdPush, name})
@@ -0,0 +1,88 @@
+// MIT License
+//
+// Copyright (c) 2016-2018 GenesisKernel
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package script
+
+import (
+	"crypto/sha256"
+)
+
+// compiledSource is the loaded root block of the source compiled by CompileCached
+type compiledSource struct {
+	owner OwnerInfo
+	root  *Block
+}
+
+// compileCache keeps the loaded blocks by the hashes of their sources and the hashes by the names
+// of the objects, so the entry is removed when any of its objects is replaced or removed
+type compileCache struct {
+	sources map[[sha256.Size]byte]*compiledSource
+	names   map[string][sha256.Size]byte
+}
+
+// CompileCached compiles the source and loads it into the virtual machine like Compile, it returns
+// the loaded root block. If the same source has been loaded by CompileCached for the same owner and
+// none of its objects has been replaced or removed since, the source isn't compiled again and
+// the loaded block is returned
+func (vm *VM) CompileCached(src string, owner *OwnerInfo) (*Block, error) {
+	hash := sha256.Sum256([]byte(src))
+	vm.flushMutex.Lock()
+	cached, ok := vm.compiled.sources[hash]
+	vm.flushMutex.Unlock()
+	if ok && cached.owner == *owner {
+		return cached.root, nil
+	}
+
+	root, err := vm.CompileBlock([]rune(src), owner)
+	if err != nil {
+		return nil, err
+	}
+	vm.FlushBlock(root)
+
+	vm.flushMutex.Lock()
+	defer vm.flushMutex.Unlock()
+	if vm.compiled.sources == nil {
+		vm.compiled.sources = make(map[[sha256.Size]byte]*compiledSource)
+		vm.compiled.names = make(map[string][sha256.Size]byte)
+	}
+	vm.compiled.sources[hash] = &compiledSource{owner: *owner, root: root}
+	for name := range root.Objects {
+		vm.compiled.names[name] = hash
+	}
+	return root, nil
+}
+
+// invalidate removes the cached source which has loaded the name object, it is called
+// with locked flushMutex when the object is replaced or removed
+func (c *compileCache) invalidate(name string) {
+	hash, ok := c.names[name]
+	if !ok {
+		return
+	}
+	if cached, ok := c.sources[hash]; ok {
+		for key := range cached.root.Objects {
+			delete(c.names, key)
+		}
+		delete(c.sources, hash)
+	}
+	delete(c.names, name)
+}
@@ -23,9 +23,20 @@
 package script
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
 )
 
 type TestVM struct {
@@ -466,3 +477,2230 @@ func TestContractList(t *testing.T) {
 		}
 	}
 }
+
+func TestContractResults(t *testing.T) {
+	test := []TestVM{
+		{`contract named {
+			action {
+				var res map
+				res["id"] = 7
+				res["status"] = "created"
+				$result = res
+			}
+		}
+		func results() string {
+			var m map
+			m = ExecContractResults("@22named", "", "")
+			return Sprintf("%v %v", m["id"], m["status"])
+		}`, `results`, `7 created`},
+		{`contract single {
+			action {
+				$result = "single value"
+			}
+		}
+		func results() string {
+			var m map
+			m = ExecContractResults("@23single", "", "")
+			return m["result"] + "=" + single()
+		}`, `results`, `single value=single value`},
+		{`contract multiple {
+			action {
+				$result = "primary"
+				$results["fee"] = 10
+				$results["status"] = "paid"
+			}
+		}
+		func results() string {
+			var m map
+			m = ExecContractResults("@24multiple", "", "")
+			return Sprintf("%v %v %v %v", m["result"], m["fee"], m["status"], multiple())
+		}`, `results`, `primary 10 paid primary`},
+	}
+	vm := NewVM()
+	vm.Extern = true
+	vm.Extend(&ExtendData{map[string]interface{}{"Sprintf": fmt.Sprintf}, nil})
+
+	for ikey, item := range test {
+		source := []rune(item.Input)
+		if err := vm.Compile(source, &OwnerInfo{StateID: uint32(ikey) + 22, Active: true, TableID: 1}); err != nil {
+			t.Error(err)
+			break
+		}
+		out, err := vm.Call(item.Func, nil, &map[string]interface{}{`rt_state`: uint32(ikey) + 22})
+		if err != nil {
+			t.Error(err)
+			break
+		}
+		if out[0].(string) != item.Output {
+			t.Error(`error vm ` + out[0].(string) + `!=` + item.Output)
+			break
+		}
+	}
+}
+
+func TestInvokeContract(t *testing.T) {
+	vm := NewVM()
+	vm.Extern = true
+	vm.Extend(&ExtendData{map[string]interface{}{
+		"Invoke": func(rt *RunTime, name string, value string) (interface{}, error) {
+			return rt.InvokeContract(name, map[string]interface{}{`Value`: value})
+		}}, map[string]string{`*script.RunTime`: `rt`}})
+
+	source := []rune(`contract inner {
+			data {
+				Value string
+			}
+			action {
+				$result = "inner " + $Value
+			}
+		}
+		contract outer {
+			action {
+				$result = Invoke("outer", "loop")
+			}
+		}
+		func invoke() string {
+			return Invoke("inner", "value")
+		}
+		func loop() string {
+			return outer()
+		}`)
+	if err := vm.Compile(source, &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	out, err := vm.Call(`invoke`, nil, &map[string]interface{}{`rt_state`: uint32(22)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out[0].(string) != `inner value` {
+		t.Errorf(`wrong result %v`, out[0])
+	}
+	if _, err = vm.Call(`loop`, nil, &map[string]interface{}{`rt_state`: uint32(22)}); err == nil ||
+		err.Error() != fmt.Sprintf(eContractLoop, `@22outer`) {
+		t.Errorf(`wrong loop error %v`, err)
+	}
+}
+
+func TestReplaceContract(t *testing.T) {
+	vm := NewVM()
+	vm.Extern = true
+	if err := vm.Compile([]rune(`contract upgrade {
+			action {
+				$result = "version 1"
+			}
+		}
+		func check() string {
+			return upgrade()
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	id := vm.Objects[`@22upgrade`].Value.(*Block).Info.(*ContractInfo).ID
+
+	check := func(want string) {
+		out, err := vm.Call(`check`, nil, &map[string]interface{}{`rt_state`: uint32(22)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out[0].(string) != want {
+			t.Errorf(`wrong result %s != %s`, out[0], want)
+		}
+	}
+	check(`version 1`)
+
+	for _, source := range []string{`contract upgrade { action { $result = "broken"`,
+		`contract upgrade {} contract another {}`, `contract another {}`} {
+		if err := vm.ReplaceContract(`@22upgrade`, source); err == nil {
+			t.Errorf(`replacing must fail for %s`, source)
+		}
+	}
+	check(`version 1`)
+
+	if err := vm.ReplaceContract(`@22upgrade`, `contract upgrade {
+			action {
+				$result = "version 2"
+			}
+		}`); err != nil {
+		t.Fatal(err)
+	}
+	check(`version 2`)
+	if newID := vm.Objects[`@22upgrade`].Value.(*Block).Info.(*ContractInfo).ID; newID != id {
+		t.Errorf(`wrong contract id %d != %d`, newID, id)
+	}
+	if err := vm.ReplaceContract(`@22unknown`, `contract unknown {}`); err == nil {
+		t.Error(`replacing unknown contract must fail`)
+	}
+}
+
+func TestCostProfile(t *testing.T) {
+	vm := NewVM()
+	vm.Extern = true
+	vm.ExtCost = func(name string) int64 {
+		if name == `str` {
+			return 20
+		}
+		return -1
+	}
+	vm.Extend(&ExtendData{map[string]interface{}{"str": str, "lenArray": lenArray}, nil})
+	if err := vm.Compile([]rune(`func GetList() array {
+			var list array
+			return list
+		}
+		func profile() string {
+			var i int
+			var s string
+			while i < 3 {
+				s = s + str(i)
+				i = i + 1
+			}
+			return s + str(lenArray(GetList()))
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if len(vm.CostProfile()) != 0 {
+		t.Error(`cost profile must be empty by default`)
+	}
+	vm.EnableCostProfile()
+	if _, err := vm.Call(`profile`, nil, &map[string]interface{}{`rt_state`: uint32(22)}); err != nil {
+		t.Fatal(err)
+	}
+	profile := vm.CostProfile()
+	if stat := profile[`str`]; stat.Count != 4 || stat.Cost != 4*20 {
+		t.Errorf(`wrong str stat %v`, stat)
+	}
+	if stat := profile[`lenArray`]; stat.Count != 1 || stat.Cost != CostCall {
+		t.Errorf(`wrong lenArray stat %v`, stat)
+	}
+	if _, ok := profile[`GetList`]; ok {
+		t.Error(`functions must not be in the cost profile`)
+	}
+}
+
+func TestContractVMType(t *testing.T) {
+	smartVM := NewVM()
+	smartVM.VMType = VMTypeSmart
+	root, err := smartVM.CompileBlock([]rune(`contract smart {
+			action {
+				$result = "smart"
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := NewVM()
+	vm.VMType = VMTypeVDE
+	vm.FlushBlock(root)
+	if err = vm.Compile([]rune(`contract vde {
+			action {
+				$result = "vde"
+			}
+		}
+		func callvde() string {
+			return vde()
+		}
+		func callsmart() string {
+			return smart()
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	extend := map[string]interface{}{`rt_state`: uint32(22)}
+	if out, err := vm.Call(`callvde`, nil, &extend); err != nil || out[0].(string) != `vde` {
+		t.Errorf(`wrong result %v %v`, out, err)
+	}
+	_, err = vm.Call(`callsmart`, nil, &extend)
+	if err == nil || err.Error() != fmt.Sprintf(eWrongVMType, `@22smart`, VMTypeSmart, VMTypeVDE) {
+		t.Errorf(`wrong error %v`, err)
+	}
+}
+
+func TestIsolateMethods(t *testing.T) {
+	var recorded []string
+	vm := NewVM()
+	vm.Extend(&ExtendData{map[string]interface{}{"Record": func(s string) {
+		recorded = append(recorded, s)
+	}}, nil})
+	if err := vm.Compile([]rune(`contract iso {
+			conditions {
+				$val = $val + " cond"
+			}
+			action {
+				Record($val)
+				$val = $val + " action"
+			}
+		}
+		func calliso() {
+			iso()
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, isolate := range []bool{false, true} {
+		vm.IsolateMethods = isolate
+		recorded = recorded[:0]
+		extend := map[string]interface{}{`rt_state`: uint32(22), `val`: `start`}
+		if _, err := vm.Call(`calliso`, nil, &extend); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{`start cond`, `start cond action`}
+		if isolate {
+			want = []string{`start`, `start`}
+		}
+		if len(recorded) != 1 || recorded[0] != want[0] || extend[`val`] != want[1] {
+			t.Errorf(`isolate %v: wrong result %v %v`, isolate, recorded, extend[`val`])
+		}
+	}
+
+	// the result and the stop of the isolated methods are returned to the caller
+	if err := vm.Compile([]rune(`contract isoresult {
+			conditions {
+				$result = "cond"
+			}
+			action {
+				$result = $result + " action"
+				$stop = 1
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	vm.IsolateMethods = true
+	rt := vm.RunInit(CostDefault)
+	rt.extend = &map[string]interface{}{`rt_state`: uint32(22), `result`: ``}
+	if result, err := ExecContract(rt, `@22isoresult`, ``, ``); err != nil || result != `cond action` {
+		t.Errorf(`wrong result %q %v`, result, err)
+	}
+	if _, ok := (*rt.extend)[`stop`]; ok {
+		t.Errorf(`stop of the contract is left in extend`)
+	}
+}
+
+func TestContractOwner(t *testing.T) {
+	vm := NewVM()
+	if err := vm.Compile([]rune(`contract owned {
+			action {
+			}
+		}
+		func notcontract() {
+		}`), &OwnerInfo{StateID: 22, Active: false, TableID: 5, WalletID: 7}); err != nil {
+		t.Fatal(err)
+	}
+	owner, err := vm.ContractOwner(`@22owned`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner.StateID != 22 || owner.Active || owner.TableID != 5 || owner.WalletID != 7 {
+		t.Errorf(`wrong owner %v`, owner)
+	}
+	owner.Active = true
+	if owner, _ = vm.ContractOwner(`@22owned`); owner.Active {
+		t.Errorf(`owner info of the contract has been changed`)
+	}
+	for _, name := range []string{`@22unknown`, `notcontract`} {
+		if _, err = vm.ContractOwner(name); err == nil || err.Error() != fmt.Sprintf(eUnknownContract, name) {
+			t.Errorf(`wrong error %v`, err)
+		}
+	}
+}
+
+func TestContractInactive(t *testing.T) {
+	var executed []string
+	vm := NewVM()
+	vm.CheckActive = true
+	vm.Extend(&ExtendData{map[string]interface{}{"Executed": func(s string) {
+		executed = append(executed, s)
+	}}, nil})
+	for i, active := range []bool{true, false} {
+		if err := vm.Compile([]rune(fmt.Sprintf(`contract cont%d {
+			data {
+				Name string
+			}
+			action {
+				Executed($Name)
+			}
+		}`, i)), &OwnerInfo{StateID: 22, Active: active, TableID: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := vm.Compile([]rune(`func exec0() {
+			ExecContract("@22cont0", "Name", "cont0")
+		}
+		func exec1() {
+			ExecContract("@22cont1", "Name", "cont1")
+		}
+		func execnopars() {
+			ExecContract("@22cont1", "", "")
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	extend := map[string]interface{}{`rt_state`: uint32(22)}
+	if _, err := vm.Call(`exec0`, nil, &extend); err != nil {
+		t.Errorf(`active contract: %v`, err)
+	}
+	if _, err := vm.Call(`exec1`, nil, &extend); err != ErrContractInactive {
+		t.Errorf(`inactive contract: wrong error %v`, err)
+	}
+	// the parameters are validated before the active flag
+	if _, err := vm.Call(`execnopars`, nil, &extend); err == nil || err == ErrContractInactive {
+		t.Errorf(`inactive contract without parameters: wrong error %v`, err)
+	}
+	if len(executed) != 1 || executed[0] != `cont0` {
+		t.Errorf(`wrong executed contracts %v`, executed)
+	}
+
+	vm.CheckActive = false
+	if _, err := vm.Call(`exec1`, nil, &extend); err != nil || len(executed) != 2 {
+		t.Errorf(`inactive contract without check: %v %v`, err, executed)
+	}
+}
+
+func TestReadOnlyContract(t *testing.T) {
+	vm := NewVM()
+	vm.Extend(&ExtendData{map[string]interface{}{
+		"Sprintf":  fmt.Sprintf,
+		"DBInsert": func(table string) int64 { return 1 },
+	}, nil})
+	vm.ReadOnlyFuncs = map[string]struct{}{"Sprintf": {}}
+	owner := &OwnerInfo{StateID: 22, Active: true, TableID: 1}
+	if err := vm.Compile([]rune(`func insert() {
+			DBInsert("test")
+		}
+		contract notview {
+			action {
+				DBInsert("test")
+			}
+		}`), owner); err != nil {
+		t.Fatal(err)
+	}
+
+	test := []struct {
+		Input string
+		Error string
+	}{
+		{`contract view {
+			settings {
+				readonly = 1
+			}
+			action {
+				$result = Sprintf("%d", 1)
+			}
+		}`, ``},
+		{`contract view {
+			settings {
+				readonly = 1
+			}
+			action {
+				if $a {
+					DBInsert("test")
+				}
+			}
+		}`, fmt.Sprintf(eReadOnlyCall, `@22view`, `DBInsert`)},
+		{`func myinsert() {
+			insert()
+		}
+		contract view {
+			settings {
+				readonly = 1
+			}
+			conditions {
+				myinsert()
+			}
+		}`, fmt.Sprintf(eReadOnlyCall, `@22view`, `DBInsert`)},
+		{`contract view {
+			settings {
+				readonly = 1
+			}
+			action {
+				notview()
+			}
+		}`, fmt.Sprintf(eReadOnlyCall, `@22view`, `ExecContract`)},
+	}
+	for i, item := range test {
+		_, err := vm.CompileBlock([]rune(item.Input), owner)
+		if item.Error == `` && err != nil {
+			t.Errorf(`%d: %v`, i, err)
+		}
+		if item.Error != `` && (err == nil || err.Error() != item.Error) {
+			t.Errorf(`%d: wrong error %v`, i, err)
+		}
+	}
+}
+
+func TestGetAllSettings(t *testing.T) {
+	vm := NewVM()
+	if err := vm.Compile([]rune(`contract sets {
+			settings {
+				val = 1.56
+				name = "Name parameter"
+			}
+			action {
+			}
+		}
+		contract nosets {
+			action {
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	rt := vm.RunInit(CostDefault)
+	for i := 0; i < 10; i++ {
+		sets, err := GetAllSettings(rt, `@22sets`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sets) != 2 || sets[0].Key != `name` || sets[0].Value != `Name parameter` ||
+			sets[1].Key != `val` || fmt.Sprint(sets[1].Value) != `1.56` {
+			t.Errorf(`wrong settings %v`, sets)
+		}
+	}
+	if sets, err := GetAllSettings(rt, `@22nosets`); err != nil || sets == nil || len(sets) != 0 {
+		t.Errorf(`wrong empty settings %v %v`, sets, err)
+	}
+	if _, err := GetAllSettings(rt, `@22unknown`); err == nil {
+		t.Errorf(`unknown contract must return error`)
+	}
+
+	setsMap, err := getSettingsMap(rt, `@22sets`)
+	if err != nil || len(setsMap) != 2 || setsMap[`name`] != `Name parameter` {
+		t.Errorf(`wrong settings map %v %v`, setsMap, err)
+	}
+	setsMap[`name`] = `changed`
+	if val, _ := GetSettings(rt, `@22sets`, `name`); val != `Name parameter` {
+		t.Errorf(`settings of the contract have been changed`)
+	}
+}
+
+func TestCallByID(t *testing.T) {
+	vm := NewVM()
+	if err := vm.Compile([]rune(`contract sum {
+			data {
+				A int
+				B int
+			}
+			action {
+				$result = $A + $B
+			}
+		}
+		contract hello {
+			action {
+				$result = "hello"
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	sumID := vm.Objects[`@22sum`].Value.(*Block).Info.(*ContractInfo).ID
+	helloID := vm.Objects[`@22hello`].Value.(*Block).Info.(*ContractInfo).ID
+
+	if out, err := vm.CallByID(sumID, []interface{}{int64(2), int64(3)}, nil); err != nil || out[0] != `5` {
+		t.Errorf(`wrong result %v %v`, out, err)
+	}
+	if out, err := vm.CallByID(helloID, nil, nil); err != nil || out[0] != `hello` {
+		t.Errorf(`wrong result %v %v`, out, err)
+	}
+	if _, err := vm.CallByID(sumID, []interface{}{int64(2)}, nil); err != ErrWrongCountPars {
+		t.Errorf(`wrong error %v`, err)
+	}
+	if _, err := vm.CallByID(0, nil, nil); err == nil || err.Error() != fmt.Sprintf(eUnknownContractID, 0) {
+		t.Errorf(`wrong error %v`, err)
+	}
+
+	// the replaced contract keeps its identifier
+	if err := vm.ReplaceContract(`@22hello`, `contract hello {
+			action {
+				$result = "replaced"
+			}
+		}`); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := vm.CallByID(helloID, nil, nil); err != nil || out[0] != `replaced` {
+		t.Errorf(`wrong result %v %v`, out, err)
+	}
+}
+
+func TestSourceLines(t *testing.T) {
+	source := `func lines(a int) int {
+			var b int
+			b = a + 1
+			if b > 2 {
+				b = b * 2
+			}
+			return b
+		}`
+	vm := NewVM()
+	vm.SourceLines = true
+	if err := vm.Compile([]rune(source), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	block := vm.Objects[`lines`].Value.(*Block)
+	if len(block.Lines) != len(block.Code) {
+		t.Fatalf(`wrong length of the line table %d != %d`, len(block.Lines), len(block.Code))
+	}
+	var checked int
+	for pc, code := range block.Code {
+		line := block.SourceLine(pc)
+		switch code.Cmd {
+		case cmdAssign, cmdIf, cmdReturn:
+			checked++
+		}
+		switch code.Cmd {
+		case cmdAssign:
+			if line != 3 {
+				t.Errorf(`wrong line %d of assign`, line)
+			}
+		case cmdIf:
+			if line != 4 {
+				t.Errorf(`wrong line %d of if`, line)
+			}
+			ifBlock := code.Value.(*Block)
+			if len(ifBlock.Lines) == 0 || ifBlock.SourceLine(0) != 5 {
+				t.Errorf(`wrong lines %v of if block`, ifBlock.Lines)
+			}
+		case cmdReturn:
+			if line != 7 {
+				t.Errorf(`wrong line %d of return`, line)
+			}
+		}
+	}
+	if checked != 3 {
+		t.Errorf(`wrong count of checked instructions %d`, checked)
+	}
+
+	vm = NewVM()
+	if err := vm.Compile([]rune(source), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if block = vm.Objects[`lines`].Value.(*Block); block.Lines != nil || block.SourceLine(0) != 0 {
+		t.Errorf(`line table must be empty`)
+	}
+}
+
+func TestContractParamTypes(t *testing.T) {
+	vm := NewVM()
+	vm.Extend(&ExtendData{map[string]interface{}{"Sprintf": fmt.Sprintf}, nil})
+	if err := vm.Compile([]rune(`contract typed {
+			data {
+				Count int
+				Rate float
+				Amount money
+				Name string
+			}
+			action {
+				$result = Sprintf("%v %v %v %s", $Count, $Rate, $Amount, $Name)
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	test := []struct {
+		Params []interface{}
+		Result string
+		Error  string
+	}{
+		{[]interface{}{int64(1), 1.5, decimal.New(10, 0), `name`}, `1 1.5 10 name`, ``},
+		{[]interface{}{1, int64(2), `100`, `name`}, `1 2 100 name`, ``},
+		{[]interface{}{float64(3), `2.5`, 1.25, `name`}, `3 2.5 1.25 name`, ``},
+		{[]interface{}{`4`, 1.5, int64(10), `name`}, `4 1.5 10 name`, ``},
+		{[]interface{}{`one`, 1.5, int64(10), `name`}, ``, fmt.Sprintf(eParamType, `Count`, `int64`)},
+		{[]interface{}{1.5, 1.5, int64(10), `name`}, ``, fmt.Sprintf(eParamType, `Count`, `int64`)},
+		{[]interface{}{int64(1), 1.5, `wrong`, `name`}, ``, fmt.Sprintf(eParamType, `Amount`, `decimal.Decimal`)},
+		{[]interface{}{int64(1), 1.5, int64(10), int64(5)}, ``, fmt.Sprintf(eParamType, `Name`, `string`)},
+	}
+	for i, item := range test {
+		rt := vm.RunInit(CostDefault)
+		rt.extend = &map[string]interface{}{}
+		result, err := ExecContract(rt, `@22typed`, `Count,Rate,Amount,Name`, item.Params...)
+		if item.Error == `` && (err != nil || result != item.Result) {
+			t.Errorf(`%d: wrong result %s %v`, i, result, err)
+		}
+		if item.Error != `` && (err == nil || err.Error() != item.Error) {
+			t.Errorf(`%d: wrong error %v`, i, err)
+		}
+	}
+
+	// the values are passed as they are in the legacy mode
+	vm.LegacyParams = true
+	rt := vm.RunInit(CostDefault)
+	rt.extend = &map[string]interface{}{}
+	if result, err := ExecContract(rt, `@22typed`, `Count,Rate,Amount,Name`, 1.5, 1.5, `wrong`, int64(5)); err != nil || result != `1.5 1.5 wrong %!s(int64=5)` {
+		t.Errorf(`wrong legacy result %s %v`, result, err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	vm := NewVM()
+	owner := &OwnerInfo{StateID: 22, Active: false, TableID: 1}
+	if err := vm.Compile([]rune(`func value() string {
+			return "old"
+		}
+		contract first {
+			action {
+				$result = value()
+			}
+		}`), owner); err != nil {
+		t.Fatal(err)
+	}
+	call := func() string {
+		rt := vm.RunInit(CostDefault)
+		rt.extend = &map[string]interface{}{}
+		result, err := ExecContract(rt, `@22first`, ``, ``)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	children := len(vm.Children)
+	snap := vm.Snapshot()
+
+	if err := vm.Compile([]rune(`func value() string {
+			return "new"
+		}
+		contract second {
+			action {
+			}
+		}`), owner); err != nil {
+		t.Fatal(err)
+	}
+	vm.Objects[`@22first`].Value.(*Block).Info.(*ContractInfo).Owner.Active = true
+	if result := call(); result != `new` {
+		t.Errorf(`wrong result %s`, result)
+	}
+
+	vm.Restore(snap)
+	if result := call(); result != `old` {
+		t.Errorf(`wrong result after restore %s`, result)
+	}
+	if _, ok := vm.Objects[`@22second`]; ok || len(vm.Children) != children {
+		t.Errorf(`second contract has not been removed`)
+	}
+	if owner, _ := vm.ContractOwner(`@22first`); owner.Active {
+		t.Errorf(`active flag has not been restored`)
+	}
+}
+
+func TestCompileBatch(t *testing.T) {
+	vm := NewVM()
+	owner := &OwnerInfo{StateID: 22, Active: true, TableID: 1}
+	err := vm.CompileBatch(map[string]string{
+		`a`: `contract first {
+			action {
+				$result = second() + "first"
+			}
+		}`,
+		`b`: `contract second {
+			action {
+				$result = helper()
+			}
+		}`,
+		`c`: `func helper() string {
+			return "helper"
+		}`,
+		`d`: `contract ping {
+			action {
+				if $stop {
+					pong()
+				}
+			}
+		}
+		contract pong {
+			action {
+				ping()
+			}
+		}`,
+	}, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.Extern {
+		t.Errorf(`extern mode must be switched off`)
+	}
+	rt := vm.RunInit(CostDefault)
+	rt.extend = &map[string]interface{}{`rt_state`: uint32(22)}
+	if result, err := ExecContract(rt, `@22first`, ``, ``); err != nil || result != `helperfirst` {
+		t.Errorf(`wrong result %s %v`, result, err)
+	}
+
+	children := len(vm.Children)
+	err = vm.CompileBatch(map[string]string{
+		`good`: `contract good {
+			action {
+			}
+		}`,
+		`bad`: `contract bad {
+			action {
+		}`,
+	}, owner)
+	if err == nil || !strings.HasPrefix(err.Error(), `bad: `) {
+		t.Errorf(`wrong error %v`, err)
+	}
+	if _, ok := vm.Objects[`@22good`]; ok || len(vm.Children) != children {
+		t.Errorf(`batch has not been rolled back`)
+	}
+}
+
+func TestContractMethods(t *testing.T) {
+	vm := NewVM()
+	if err := vm.SetContractMethods([]string{`conditions`, `action`, `aftercommit`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Compile([]rune(`contract lifecycle {
+			func aftercommit() {
+				$result = $result + " aftercommit"
+			}
+			func helper(s string) string {
+				return s + " action"
+			}
+			action {
+				$result = helper($result)
+			}
+			conditions {
+				$result = "conditions"
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	id := vm.Objects[`@22lifecycle`].Value.(*Block).Info.(*ContractInfo).ID
+	if out, err := vm.CallByID(id, nil, nil); err != nil ||
+		out[0] != `conditions action aftercommit` {
+		t.Errorf(`wrong result %v %v`, out, err)
+	}
+
+	err := vm.Compile([]rune(`contract badmethod {
+			func aftercommit(s string) {
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1})
+	if err == nil || err.Error() != fmt.Sprintf(eMethodParams, `aftercommit`, `@22badmethod`) {
+		t.Errorf(`wrong error %v`, err)
+	}
+
+	for _, methods := range [][]string{{`action`, `action`}, {``}, {`1init`}, {`data`}} {
+		if err := vm.SetContractMethods(methods); err == nil {
+			t.Errorf(`%v must be wrong`, methods)
+		}
+	}
+	if methods := vm.ContractMethods(); len(methods) != 3 || methods[2] != `aftercommit` {
+		t.Errorf(`wrong methods %v`, methods)
+	}
+	if methods := NewVM().ContractMethods(); len(methods) != 3 || methods[0] != `init` {
+		t.Errorf(`wrong default methods %v`, methods)
+	}
+}
+
+func TestMaxTxParams(t *testing.T) {
+	vm := NewVM()
+	vm.MaxTxParams = 2
+	if err := vm.Compile([]rune(`contract twopars {
+			data {
+				A int
+				B int
+			}
+			action {
+				$result = $A + $B
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	err := vm.Compile([]rune(`contract threepars {
+			data {
+				A int
+				B int
+				C int
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 2})
+	if err == nil || err.Error() != fmt.Sprintf(eTooManyParams, `@22threepars`, 3, 2) {
+		t.Errorf(`wrong error %v`, err)
+	}
+	if err := vm.Compile([]rune(`func call() string {
+			var pars map
+			pars["A"] = 1
+			pars["B"] = 2
+			return CallContract("twopars", pars)
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := vm.Call(`call`, nil, &map[string]interface{}{`rt_state`: uint32(22)}); err != nil || out[0] != `3` {
+		t.Errorf(`wrong result %v %v`, out, err)
+	}
+
+	// the limit is checked again when the contract is called
+	vm.MaxTxParams = 1
+	_, err = vm.Call(`call`, nil, &map[string]interface{}{`rt_state`: uint32(22)})
+	if err == nil || err.Error() != fmt.Sprintf(eTooManyParams, `@22twopars`, 2, 1) {
+		t.Errorf(`wrong error %v`, err)
+	}
+}
+
+func TestFuncPolicy(t *testing.T) {
+	vm := NewVM()
+	vm.Extend(&ExtendData{map[string]interface{}{"DBInsert": func(s string) {}, "Sprintf": fmt.Sprintf}, nil})
+	vm.FuncPolicy = &FuncPolicy{Deny: map[string]struct{}{`DBInsert`: {}}}
+
+	owner := &OwnerInfo{StateID: 22, Active: true, TableID: 1}
+	if err := vm.Compile([]rune(`func insert() {
+			DBInsert("system")
+		}`), owner); err != nil {
+		t.Fatal(err)
+	}
+	err := vm.Compile([]rune(`contract tenant {
+			action {
+				insert()
+			}
+		}`), owner)
+	if err == nil || err.Error() != fmt.Sprintf(eForbiddenCall, `@22tenant`, `DBInsert`) {
+		t.Errorf(`wrong error %v`, err)
+	}
+	if err := vm.Compile([]rune(`contract allowed {
+			action {
+				$result = Sprintf("%d", 1)
+			}
+		}`), owner); err != nil {
+		t.Error(err)
+	}
+
+	vm.FuncPolicy = &FuncPolicy{Allow: map[string]struct{}{`DBInsert`: {}}}
+	err = vm.Compile([]rune(`contract notallowed {
+			action {
+				$result = Sprintf("%d", 1)
+			}
+		}`), owner)
+	if err == nil || err.Error() != fmt.Sprintf(eForbiddenCall, `@22notallowed`, `Sprintf`) {
+		t.Errorf(`wrong error %v`, err)
+	}
+
+	vm.FuncPolicy = nil
+	if err := vm.Compile([]rune(`contract system {
+			action {
+				insert()
+			}
+		}`), owner); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRollbackExtend(t *testing.T) {
+	vm := NewVM()
+	vm.Extend(&ExtendData{map[string]interface{}{"Fail": func() error {
+		return fmt.Errorf(`failed`)
+	}}, nil})
+	if err := vm.Compile([]rune(`contract failing {
+			conditions {
+				$val = $val + " cond"
+			}
+			action {
+				$val = $val + " action"
+				$added = 1
+				Fail()
+			}
+		}
+		func callfailing() {
+			failing()
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, rollback := range []bool{false, true} {
+		vm.RollbackExtend = rollback
+		extend := map[string]interface{}{`rt_state`: uint32(22), `val`: `start`}
+		if _, err := vm.Call(`callfailing`, nil, &extend); err == nil || err.Error() != `failed` {
+			t.Errorf(`rollback %v: wrong error %v`, rollback, err)
+		}
+		_, added := extend[`added`]
+		want := `start cond action`
+		if rollback {
+			want = `start cond`
+		}
+		if extend[`val`] != want || added == rollback {
+			t.Errorf(`rollback %v: wrong extend %v`, rollback, extend)
+		}
+	}
+
+	rt := vm.RunInit(CostDefault)
+	extend := map[string]interface{}{`a`: 1, `b`: 2}
+	rt.extend = &extend
+	restore := rt.SnapshotExtend()
+	extend[`a`] = 10
+	delete(extend, `b`)
+	extend[`c`] = 3
+	restore()
+	if len(extend) != 2 || extend[`a`] != 1 || extend[`b`] != 2 {
+		t.Errorf(`wrong restored extend %v`, extend)
+	}
+}
+
+func TestRequiresSignature(t *testing.T) {
+	vm := NewVM()
+	if err := vm.Compile([]rune(`contract signed {
+			data {
+				Amount money
+				Signature string "optional"
+			}
+		}
+		contract unsigned {
+			data {
+				Amount money
+			}
+		}
+		contract nodata {
+			action {
+			}
+		}
+		func notcontract() {
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{`@22signed`: true, `@22unsigned`: false, `@22nodata`: false} {
+		if signature, err := vm.RequiresSignature(name); err != nil || signature != want {
+			t.Errorf(`%s: wrong result %v %v`, name, signature, err)
+		}
+	}
+	for _, name := range []string{`@22unknown`, `notcontract`} {
+		if _, err := vm.RequiresSignature(name); err == nil || err.Error() != fmt.Sprintf(eUnknownContract, name) {
+			t.Errorf(`wrong error %v`, err)
+		}
+	}
+}
+
+func TestExContractParamTypes(t *testing.T) {
+	vm := NewVM()
+	vm.Extend(&ExtendData{map[string]interface{}{"Sprintf": fmt.Sprintf}, nil})
+	if err := vm.Compile([]rune(`contract typed {
+			data {
+				Count int
+				Name string
+				Note string "optional"
+			}
+			action {
+				$result = Sprintf("%d %s", $Count, $Name)
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	rt := vm.RunInit(CostDefault)
+	rt.extend = &map[string]interface{}{`rt_state`: uint32(22)}
+
+	_, err := ExContract(rt, 22, `typed`, map[string]interface{}{`Count`: `ten`, `Name`: `name`})
+	if err == nil || err.Error() != fmt.Sprintf(eParamActualType, `Count`, `int64`, `ten`) {
+		t.Errorf(`wrong error %v`, err)
+	}
+	_, err = ExContract(rt, 22, `typed`, map[string]interface{}{`Count`: int64(10), `Name`: 5})
+	if err == nil || err.Error() != `parameter Name expected type string, got int` {
+		t.Errorf(`wrong error %v`, err)
+	}
+	// the absent optional parameter is not checked
+	if out, err := ExContract(rt, 22, `typed`, map[string]interface{}{`Count`: 10, `Name`: `name`}); err != nil || out != `10 name` {
+		t.Errorf(`wrong result %v %v`, out, err)
+	}
+
+	// the numbers of the decoded JSON are float64, the integral ones are accepted by int fields
+	vm.Extend(&ExtendData{map[string]interface{}{"JSONToMap": func(input string) (map[string]interface{}, error) {
+		var ret map[string]interface{}
+		err := json.Unmarshal([]byte(input), &ret)
+		return ret, err
+	}}, nil})
+	if err := vm.Compile([]rune(`func calljson() string {
+			return CallContract("typed", JSONToMap($input))
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for input, want := range map[string]string{`{"Count": 10, "Name": "name"}`: `10 name`, `{"Count": "12", "Name": "name"}`: `12 name`} {
+		if out, err := vm.Call(`calljson`, nil, &map[string]interface{}{`rt_state`: uint32(22), `input`: input}); err != nil || out[0] != want {
+			t.Errorf(`%s: wrong result %v %v`, input, out, err)
+		}
+	}
+	_, err = vm.Call(`calljson`, nil, &map[string]interface{}{`rt_state`: uint32(22), `input`: `{"Count": 10.5, "Name": "name"}`})
+	if !errors.Is(err, ErrParamType) {
+		t.Errorf(`wrong error %v`, err)
+	}
+	vm.LegacyParams = true
+	if out, err := ExContract(rt, 22, `typed`, map[string]interface{}{`Count`: int64(7), `Name`: `name`, `Note`: 5}); err != nil || out != `7 name` {
+		t.Errorf(`wrong legacy result %v %v`, out, err)
+	}
+}
+
+func TestExecContractMap(t *testing.T) {
+	vm := NewVM()
+	vm.Extend(&ExtendData{map[string]interface{}{"Sprintf": fmt.Sprintf}, nil})
+	if err := vm.Compile([]rune(`contract ordered {
+			data {
+				First string
+				Second int
+			}
+			action {
+				$result = Sprintf("%s %d", $First, $Second)
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	rt := vm.RunInit(CostDefault)
+	rt.extend = &map[string]interface{}{`rt_state`: uint32(22)}
+
+	out, err := ExecContractMap(rt, `@22ordered`, map[string]interface{}{`Second`: 2, `First`: `one`, `Extra`: true})
+	if err != nil || out != `one 2` {
+		t.Errorf(`wrong result %v %v`, out, err)
+	}
+	if _, err = ExecContractMap(rt, `@22ordered`, map[string]interface{}{`First`: `one`}); !errors.Is(err, ErrUndefinedParam) {
+		t.Errorf(`wrong error %v`, err)
+	}
+	if _, err = ExecContractMap(rt, `ordered`, nil); !errors.Is(err, ErrUnknownContract) {
+		t.Errorf(`wrong error %v`, err)
+	}
+}
+
+func TestVMPanic(t *testing.T) {
+	vm := NewVM()
+	vm.Extend(&ExtendData{map[string]interface{}{"Crash": func() {
+		var m map[string]int
+		m[`crash`] = 1
+	}}, nil})
+	if err := vm.Compile([]rune(`contract crash {
+			action {
+				Crash()
+			}
+		}
+		contract quiet {
+			action {
+				$result = "quiet"
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	rt := vm.RunInit(CostDefault)
+	rt.extend = &map[string]interface{}{`rt_state`: uint32(22)}
+	_, err := ExecContract(rt, `@22crash`, ``, ``)
+	if perr, ok := err.(*ErrVMPanic); !ok || perr.Value == nil {
+		t.Errorf(`wrong error of the panic in the contract %v`, err)
+	}
+
+	// the panic outside of the contract methods
+	rt.extend = &map[string]interface{}{`rt_state`: uint32(22), `sc`: true,
+		`stack_cont`: func(interface{}, string) { panic(`stack_cont`) }}
+	_, err = ExecContract(rt, `@22quiet`, ``, ``)
+	if perr, ok := err.(*ErrVMPanic); !ok || perr.Value != `stack_cont` {
+		t.Errorf(`wrong error of the panic in the contract checks %v`, err)
+	}
+}
+
+func TestRunTimePool(t *testing.T) {
+	vm := NewVM()
+	vm.Extend(&ExtendData{map[string]interface{}{"Sprintf": fmt.Sprintf}, nil})
+	if err := vm.Compile([]rune(`contract leaf {
+			data {
+				Num int
+			}
+			action {
+				var local int
+				local = $Num * 2
+				$result = Sprintf("%d", local)
+			}
+		}
+		contract node {
+			data {
+				Val int
+			}
+			action {
+				var i int
+				var s string
+				while i < 3 {
+					s = s + ExecContract("@22leaf", "Num", $Val + i)
+					i = i + 1
+				}
+				$result = s
+			}
+		}
+		func run() string {
+			return ExecContract("@22node", "Val", $val)
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(val int64) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				rt := vm.RunInit(CostDefault)
+				if len(rt.stack) != 0 || len(rt.blocks) != 0 || len(rt.vars) != 0 || rt.extend != nil || rt.err != nil {
+					errs <- fmt.Errorf(`runtime is not reset`)
+					return
+				}
+				out, err := rt.Run(vm.Objects[`run`].Value.(*Block), nil,
+					&map[string]interface{}{`rt_state`: uint32(22), `val`: val})
+				want := fmt.Sprintf(`%d%d%d`, val*2, (val+1)*2, (val+2)*2)
+				if err != nil || len(out) != 1 || out[0] != want {
+					errs <- fmt.Errorf(`wrong result %v %v, expected %s`, out, err, want)
+					return
+				}
+				rt.release()
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestExtFunctions(t *testing.T) {
+	vm := NewVM()
+	vm.Extend(&ExtendData{Objects: map[string]interface{}{
+		"Sum":  func(rt *RunTime, values ...interface{}) int64 { return 0 },
+		"Pair": func(name string, id int64) (string, error) { return name, nil },
+	}, AutoPars: map[string]string{
+		`*script.RunTime`: `rt`,
+	}})
+	funcs := make(map[string]ExtFuncSummary)
+	names := make([]string, 0)
+	for _, item := range vm.ExtFunctions() {
+		funcs[item.Name] = item
+		names = append(names, item.Name)
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Errorf(`functions are not sorted %v`, names)
+	}
+	if sum := fmt.Sprint(funcs[`Sum`]); sum != `{Sum [[]interface {}] [int64] true}` {
+		t.Errorf(`wrong Sum %s`, sum)
+	}
+	if pair := fmt.Sprint(funcs[`Pair`]); pair != `{Pair [string int64] [string error] false}` {
+		t.Errorf(`wrong Pair %s`, pair)
+	}
+}
+
+type testTracer struct {
+	events []string
+}
+
+func (tracer *testTracer) EnterContract(trace *ContractTrace) {
+	tracer.events = append(tracer.events, fmt.Sprintf(`enter %s %s %d %v`, trace.Name, trace.Parent,
+		trace.Depth, trace.Params))
+}
+
+func (tracer *testTracer) ExitContract(trace *ContractTrace) {
+	tracer.events = append(tracer.events, fmt.Sprintf(`exit %s %d %v`, trace.Name, trace.Cost, trace.Error))
+}
+
+func TestContractTracer(t *testing.T) {
+	vm := NewVM()
+	if err := vm.Compile([]rune(`contract login {
+			data {
+				Name string
+				Pin string "hidden"
+				Code string "hashed"
+			}
+			action {
+				$result = $Name
+			}
+		}
+		contract enter {
+			data {
+				User string
+			}
+			action {
+				$result = ExecContract("@22login", "Name,Pin,Code", $User, "1234", "abc")
+			}
+		}
+		func run() string {
+			return ExecContract("@22enter", "User", "alice")
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	tracer := &testTracer{}
+	vm.Tracer = tracer
+	out, err := vm.RunInit(CostDefault).Run(vm.Objects[`run`].Value.(*Block), nil,
+		&map[string]interface{}{`rt_state`: uint32(22)})
+	if err != nil || len(out) != 1 || out[0] != `alice` {
+		t.Fatalf(`wrong result %v %v`, out, err)
+	}
+	if len(tracer.events) != 4 {
+		t.Fatalf(`wrong events %v`, tracer.events)
+	}
+	want := []string{`enter @22enter  0 map[User:alice]`,
+		`enter @22login @22enter 1 map[Code:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad Name:alice]`}
+	for i, event := range want {
+		if tracer.events[i] != event {
+			t.Errorf(`wrong event %s, expected %s`, tracer.events[i], event)
+		}
+	}
+	var inner, outer int64
+	fmt.Sscanf(tracer.events[2], `exit @22login %d <nil>`, &inner)
+	fmt.Sscanf(tracer.events[3], `exit @22enter %d <nil>`, &outer)
+	if inner < CostContract || outer <= inner {
+		t.Errorf(`wrong cost %v`, tracer.events)
+	}
+	if !bytes.Equal(hashParams(map[string]interface{}{`a`: 1, `b`: `x`}),
+		hashParams(map[string]interface{}{`b`: `x`, `a`: 1})) {
+		t.Errorf(`hash depends on the order`)
+	}
+}
+
+func TestErrorsIs(t *testing.T) {
+	vm := NewVM()
+	if err := vm.Compile([]rune(`contract typed {
+			data {
+				Count int
+			}
+		}
+		contract looped {
+			action {
+				ExecContract("@22looped", "", "")
+			}
+		}
+		func runlooped() {
+			ExecContract("@22looped", "", "")
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	rt := vm.RunInit(CostDefault)
+	rt.extend = &map[string]interface{}{`rt_state`: uint32(22)}
+
+	_, errExec := ExecContract(rt, `@22unknown`, ``, ``)
+	_, errEx := ExContract(rt, 22, `unknown`, nil)
+	_, errSettings := GetSettings(rt, `@22unknown`, `name`)
+	_, errID := vm.CallByID(1000, nil, nil)
+	_, errMissing := ExContract(rt, 22, `typed`, nil)
+	_, errType := ExContract(rt, 22, `typed`, map[string]interface{}{`Count`: `ten`})
+	_, errCall := vm.Call(`unknown`, nil, &map[string]interface{}{})
+	_, errLoop := vm.Call(`runlooped`, nil, &map[string]interface{}{`rt_state`: uint32(22)})
+	for _, item := range []struct {
+		err    error
+		target error
+		msg    string
+	}{
+		{errExec, ErrUnknownContract, fmt.Sprintf(eUnknownContract, `@22unknown`)},
+		{errEx, ErrUnknownContract, fmt.Sprintf(eUnknownContract, `@22unknown`)},
+		{errSettings, ErrUnknownContract, fmt.Sprintf(eUnknownContract, `@22unknown`)},
+		{errID, ErrUnknownContract, fmt.Sprintf(eUnknownContractID, 1000)},
+		{errMissing, ErrUndefinedParam, fmt.Sprintf(eUndefinedParam, `Count`)},
+		{errType, ErrParamType, fmt.Sprintf(eParamActualType, `Count`, `int64`, `ten`)},
+		{errCall, ErrUnknownFunc, fmt.Sprintf(eUnknownFunc, `unknown`)},
+		{errLoop, ErrContractLoop, fmt.Sprintf(eContractLoop, `@22looped`)},
+	} {
+		if !errors.Is(item.err, item.target) || item.err.Error() != item.msg {
+			t.Errorf(`wrong error %v, expected %s`, item.err, item.target)
+		}
+	}
+}
+
+func TestMaxCost(t *testing.T) {
+	vm := NewVM()
+	if err := vm.Compile([]rune(`func sum(a, b int) int {
+			return a + b
+		}
+		contract inner {
+			data {
+				Value int
+			}
+			action {
+				var i int
+				i = sum($Value, 2)
+				if i > 10 {
+					i = i * 2
+				} else {
+					i = i - 1
+				}
+			}
+		}
+		contract outer {
+			action {
+				inner("Value", 7)
+			}
+		}
+		contract looped {
+			action {
+				var i int
+				while i < 10 {
+					i = i + 1
+				}
+			}
+		}
+		contract callsLooped {
+			action {
+				looped()
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{`@22inner`, `@22outer`} {
+		maxCost, err := vm.MaxCost(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rt := vm.RunInit(CostDefault)
+		rt.extend = &map[string]interface{}{`rt_state`: uint32(22)}
+		if _, err = ExecContract(rt, name, `Value`, 7); err != nil {
+			t.Fatal(err)
+		}
+		if spent := CostDefault - rt.Cost(); maxCost < spent {
+			t.Errorf(`%s: max cost %d is less than spent cost %d`, name, maxCost, spent)
+		}
+	}
+	for _, item := range []struct {
+		name   string
+		target error
+	}{
+		{`@22looped`, ErrUnboundedCost},
+		{`@22callsLooped`, ErrUnboundedCost},
+		{`@22unknown`, ErrUnknownContract},
+		{`sum`, ErrUnknownContract},
+	} {
+		if _, err := vm.MaxCost(item.name); !errors.Is(err, item.target) {
+			t.Errorf(`%s: wrong error %v`, item.name, err)
+		}
+	}
+}
+
+func TestStateReferences(t *testing.T) {
+	vm := NewVM()
+	if err := vm.Compile([]rune(`contract target {
+			action {
+			}
+		}`), &OwnerInfo{StateID: 5, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	owner := &OwnerInfo{StateID: 22, Active: true, TableID: 2}
+	if err := vm.Compile([]rune(`contract valid {
+			action {
+				@5target()
+			}
+		}`), owner); err != nil {
+		t.Fatal(err)
+	}
+	err := vm.Compile([]rune(`contract broken {
+			action {
+				@5missing()
+			}
+		}`), owner)
+	if !errors.Is(err, ErrUnknownContract) || err.Error() != fmt.Sprintf(eUnknownReference, `@5missing`, `@22broken`, 3, 6) {
+		t.Errorf(`wrong error %v`, err)
+	}
+
+	// the contracts can be loaded later in the extern mode
+	vm.Extern = true
+	if err = vm.Compile([]rune(`contract later {
+			action {
+				@7loaded()
+			}
+		}
+		contract lost {
+			action {
+				@7missing()
+			}
+		}`), owner); err != nil {
+		t.Fatal(err)
+	}
+	if err = vm.Compile([]rune(`contract loaded {
+			action {
+			}
+		}`), &OwnerInfo{StateID: 7, Active: true, TableID: 3}); err != nil {
+		t.Fatal(err)
+	}
+	err = vm.FlushExtern()
+	if !errors.Is(err, ErrUnknownContract) || err.Error() != fmt.Sprintf(eUnknownReference, `@7missing`, `@22lost`, 8, 6) {
+		t.Errorf(`wrong error %v`, err)
+	}
+	if err = vm.FlushExtern(); err != nil {
+		t.Errorf(`references are checked again: %v`, err)
+	}
+}
+
+func TestEvalConditions(t *testing.T) {
+	vm := NewVM()
+	vm.Extend(&ExtendData{map[string]interface{}{"Sprintf": fmt.Sprintf, "Println": fmt.Println}, nil})
+	vm.ReadOnlyFuncs = map[string]struct{}{"Sprintf": {}}
+	if err := vm.Compile([]rune(`contract guard {
+			data {
+				Amount int
+				Note string "optional"
+			}
+			conditions {
+				$checked = Sprintf("%d", $Amount)
+				if $Amount > 10 {
+					error "too much"
+				}
+			}
+			action {
+				$acted = 1
+			}
+		}
+		contract open {
+			action {
+				$acted = 1
+			}
+		}
+		contract noisy {
+			conditions {
+				Println("checked")
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	rt := vm.RunInit(CostDefault)
+	rt.extend = &map[string]interface{}{`rt_state`: uint32(22)}
+
+	for _, item := range []struct {
+		name   string
+		params []interface{}
+		passed bool
+	}{
+		{`@22guard`, []interface{}{5}, true},
+		{`@22guard`, []interface{}{int64(20), `note`}, false},
+		{`@22open`, nil, true},
+	} {
+		passed, err := EvalConditions(rt, item.name, item.params...)
+		if err != nil || passed != item.passed {
+			t.Errorf(`%v: wrong result %v %v`, item, passed, err)
+		}
+	}
+	for _, key := range []string{`checked`, `acted`, `Amount`} {
+		if _, ok := (*rt.extend)[key]; ok {
+			t.Errorf(`%s is assigned in the extend map`, key)
+		}
+	}
+
+	if _, err := EvalConditions(rt, `@22noisy`); err == nil || err.Error() != fmt.Sprintf(eConditionsCall, `@22noisy`, `Println`) {
+		t.Errorf(`wrong error %v`, err)
+	}
+	if _, err := EvalConditions(rt, `@22guard`); !errors.Is(err, ErrUndefinedParam) {
+		t.Errorf(`wrong error %v`, err)
+	}
+	if _, err := EvalConditions(rt, `@22guard`, 1, `note`, true); err != ErrContractPars {
+		t.Errorf(`wrong error %v`, err)
+	}
+	if _, err := EvalConditions(rt, `@22unknown`); !errors.Is(err, ErrUnknownContract) {
+		t.Errorf(`wrong error %v`, err)
+	}
+}
+
+func TestContractStop(t *testing.T) {
+	vm := NewVM()
+	if err := vm.Compile([]rune(`contract early {
+			data {
+				Skip int
+			}
+			conditions {
+				$result = "checked"
+				if $Skip == 1 {
+					$stop = 1
+				}
+			}
+			action {
+				$result = "acted"
+			}
+		}
+		contract caller {
+			conditions {
+				early("Skip", 1)
+			}
+			action {
+				$result = "caller"
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []struct {
+		name   string
+		skip   int64
+		result string
+	}{
+		{`@22early`, 1, `checked`},
+		{`@22early`, 0, `acted`},
+		{`@22caller`, 0, `caller`},
+	} {
+		rt := vm.RunInit(CostDefault)
+		rt.extend = &map[string]interface{}{`rt_state`: uint32(22)}
+		out, err := ExecContract(rt, item.name, `Skip`, item.skip)
+		if err != nil || out != item.result {
+			t.Errorf(`%v: wrong result %s %v`, item, out, err)
+		}
+		if _, ok := (*rt.extend)[`stop`]; ok {
+			t.Errorf(`%v: stop is kept in the extend map`, item)
+		}
+	}
+}
+
+func TestDeterministicExecution(t *testing.T) {
+	vm := NewVM()
+	vm.Extend(&ExtendData{map[string]interface{}{"Sprintf": fmt.Sprintf}, nil})
+	if err := vm.Compile([]rune(`func query(table string).Where(format string, args ...).Limit(limit int) string {
+			return Sprintf("%s %s %v %d", table, format, args, limit)
+		}
+		contract report {
+			action {
+				$result = query("keys").Limit(5).Where("id=? and name=?", 10, "name")
+				$results["first"] = 1
+				$results["second"] = 2
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	vm.Extern = true
+	if err := vm.Compile([]rune(`contract unbounded {
+			action {
+				@22zeta()
+				@22alpha()
+				@22beta()
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	vm.FlushExtern()
+
+	var first string
+	for i := 0; i < 20; i++ {
+		rt := vm.RunInit(CostDefault)
+		rt.extend = &map[string]interface{}{`rt_state`: uint32(22)}
+		results, err := ExecContractResults(rt, `@22report`, ``, ``)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = vm.MaxCost(`@22unbounded`)
+		out := fmt.Sprint(results, err, CostDefault-rt.Cost())
+		if i == 0 {
+			first = out
+		} else if out != first {
+			t.Fatalf(`different output %s, expected %s`, out, first)
+		}
+	}
+	if !strings.Contains(first, `call of unknown @22alpha contract`) {
+		t.Errorf(`wrong output %s`, first)
+	}
+}
+
+func TestMapExtend(t *testing.T) {
+	m := map[string]interface{}{`key`: 1}
+	var ext Extend = MapExtend(m)
+	if val, ok := ext.Get(`key`); !ok || val != 1 {
+		t.Errorf(`wrong value %v %v`, val, ok)
+	}
+	ext.Set(`new`, `value`)
+	if m[`new`] != `value` {
+		t.Errorf(`the map is not changed`)
+	}
+	ext.Delete(`key`)
+	if _, ok := ext.Get(`key`); ok {
+		t.Errorf(`the key is not deleted`)
+	}
+	if rt := NewVM().RunInit(CostDefault); rt.Extend() != nil {
+		t.Errorf(`extend of the runtime without the map must be nil`)
+	}
+}
+
+func BenchmarkExtendMap(b *testing.B) {
+	extend := &map[string]interface{}{`parent`: ``}
+	for i := 0; i < b.N; i++ {
+		(*extend)[`loop_test`] = true
+		_ = (*extend)[`parent`]
+		delete(*extend, `loop_test`)
+	}
+}
+
+func BenchmarkExtendInterface(b *testing.B) {
+	var ext Extend = MapExtend(map[string]interface{}{`parent`: ``})
+	for i := 0; i < b.N; i++ {
+		ext.Set(`loop_test`, true)
+		ext.Get(`parent`)
+		ext.Delete(`loop_test`)
+	}
+}
+
+func BenchmarkExecContract(b *testing.B) {
+	vm := NewVM()
+	if err := vm.Compile([]rune(`contract inner {
+			data {
+				Value int
+			}
+			action {
+				$result = $Value * 2
+			}
+		}
+		contract outer {
+			data {
+				Value int
+			}
+			action {
+				$result = inner("Value", $Value)
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rt := vm.RunInit(CostDefault)
+		rt.extend = &map[string]interface{}{`rt_state`: uint32(22)}
+		if _, err := ExecContract(rt, `@22outer`, `Value`, 21); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRemoveContract(t *testing.T) {
+	vm := NewVM()
+	if err := vm.Compile([]rune(`contract inner {
+			action {
+				$result = "inner"
+			}
+		}
+		contract outer {
+			action {
+				$result = inner()
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	id := vm.Objects[`@22inner`].Value.(*Block).Info.(*ContractInfo).ID
+
+	err := vm.RemoveContract(`@22inner`)
+	if !errors.Is(err, ErrContractInUse) || err.Error() != `@22inner contract is used by @22outer` {
+		t.Fatalf(`wrong error %v`, err)
+	}
+	if err = vm.RemoveContract(`@22outer`); err != nil {
+		t.Fatal(err)
+	}
+	if err = vm.RemoveContract(`@22inner`); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := vm.Objects[`@22inner`]; ok || vm.Children[id] != nil {
+		t.Errorf(`contract is not removed`)
+	}
+	if err = vm.RemoveContract(`@22inner`); !errors.Is(err, ErrUnknownContract) {
+		t.Errorf(`wrong error %v`, err)
+	}
+	if _, err = vm.CallByID(id, nil, &map[string]interface{}{}); !errors.Is(err, ErrUnknownContract) {
+		t.Errorf(`removed contract is called: %v`, err)
+	}
+}
+
+func TestCallValues(t *testing.T) {
+	vm := NewVM()
+	vm.Extend(&ExtendData{map[string]interface{}{"Sprintf": fmt.Sprintf,
+		"Join": func(sep string, items ...interface{}) string {
+			return fmt.Sprint(len(items), sep, items)
+		}}, nil})
+	if err := vm.Compile([]rune(`func answer() int {
+			return 42
+		}`), &OwnerInfo{StateID: 1, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []struct {
+		name string
+		args []interface{}
+		want interface{}
+	}{
+		{`answer`, nil, int64(42)},
+		{`Sprintf`, []interface{}{`%d-%s`, int64(7), `x`}, `7-x`},
+		{`Join`, []interface{}{`:`, `a`, int64(1)}, `2:[a 1]`},
+	} {
+		args := make([]reflect.Value, len(item.args))
+		for i, arg := range item.args {
+			args[i] = reflect.ValueOf(arg)
+		}
+		out, err := vm.CallValues(item.name, args, &map[string]interface{}{})
+		if err != nil || len(out) == 0 || out[0].Interface() != item.want {
+			t.Errorf(`%s: wrong result %v %v`, item.name, out, err)
+		}
+		ret, err := vm.Call(item.name, item.args, &map[string]interface{}{})
+		if err != nil || len(ret) == 0 || ret[0] != item.want {
+			t.Errorf(`%s: wrong result of Call %v %v`, item.name, ret, err)
+		}
+	}
+	if _, err := vm.CallValues(`unknown`, nil, &map[string]interface{}{}); !errors.Is(err, ErrUnknownFunc) {
+		t.Errorf(`wrong error %v`, err)
+	}
+}
+
+func TestStrictExtend(t *testing.T) {
+	vm := NewVM()
+	first := func() string { return `first` }
+	second := func() string { return `second` }
+	if err := vm.Extend(&ExtendData{map[string]interface{}{"Name": first}, nil}); err != nil {
+		t.Fatal(err)
+	}
+	// the default mode replaces the function silently
+	if err := vm.Extend(&ExtendData{map[string]interface{}{"Name": second}, nil}); err != nil {
+		t.Fatal(err)
+	}
+	call := func() interface{} {
+		out, err := vm.Call(`Name`, nil, &map[string]interface{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out[0]
+	}
+	if out := call(); out != `second` {
+		t.Errorf(`wrong result %v`, out)
+	}
+
+	vm.StrictExtend = true
+	err := vm.Extend(&ExtendData{map[string]interface{}{"Name": first, "Other": first}, nil})
+	if !errors.Is(err, ErrExtendRegistered) || !strings.Contains(err.Error(), `Name`) {
+		t.Errorf(`wrong error %v`, err)
+	}
+	if out := call(); out != `second` {
+		t.Errorf(`function has been replaced %v`, out)
+	}
+	if _, ok := vm.Objects[`Other`]; ok {
+		t.Error(`failed Extend must not register functions`)
+	}
+	vm.ReplaceExtend(&ExtendData{map[string]interface{}{"Name": first}, nil})
+	if out := call(); out != `first` {
+		t.Errorf(`function has not been replaced %v`, out)
+	}
+}
+
+func TestCompileCached(t *testing.T) {
+	vm := NewVM()
+	src := `contract cached {
+			action {
+				$result = "first"
+			}
+		}`
+	owner := &OwnerInfo{StateID: 22, Active: true, TableID: 1}
+	first, err := vm.CompileCached(src, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	children := len(vm.Children)
+	if root, err := vm.CompileCached(src, &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil || root != first {
+		t.Errorf(`unchanged source must not be compiled %v`, err)
+	}
+	if len(vm.Children) != children {
+		t.Errorf(`wrong count of children %d`, len(vm.Children))
+	}
+	second, err := vm.CompileCached(src, &OwnerInfo{StateID: 22, Active: true, TableID: 2})
+	if err != nil || second == first {
+		t.Errorf(`source of another owner must be compiled %v`, err)
+	}
+
+	// the contract is replaced with the new source, so the cached block isn't loaded anymore
+	if err = vm.Compile([]rune(strings.Replace(src, `first`, `second`, 1)), owner); err != nil {
+		t.Fatal(err)
+	}
+	third, err := vm.CompileCached(src, &OwnerInfo{StateID: 22, Active: true, TableID: 2})
+	if err != nil || third == second {
+		t.Errorf(`replaced source must be compiled %v`, err)
+	}
+	rt := vm.RunInit(CostDefault)
+	rt.extend = &map[string]interface{}{`rt_state`: uint32(22)}
+	if out, err := ExecContract(rt, `@22cached`, ``, ``); err != nil || out != `first` {
+		t.Errorf(`wrong result %v %v`, out, err)
+	}
+
+	if _, err = vm.CompileCached(`contract {`, owner); err == nil {
+		t.Error(`wrong source must fail`)
+	}
+}
+
+func TestContractParams(t *testing.T) {
+	vm := NewVM()
+	if err := vm.Compile([]rune(`contract params {
+			data {
+				Name string "optional"
+				Amount money
+				Count int
+			}
+			action {}
+		}
+		contract empty {
+			action {}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	fields, err := vm.ContractParams(`@22params`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []string
+	for _, field := range fields {
+		list = append(list, fmt.Sprintf(`%s %s %s`, field.Name, field.Type, field.Tags))
+	}
+	if out := strings.Join(list, `,`); out != `Name string optional,Amount decimal.Decimal ,Count int64 ` {
+		t.Errorf(`wrong params %s`, out)
+	}
+	if fields, err = vm.ContractParams(`@22empty`); err != nil || fields == nil || len(fields) != 0 {
+		t.Errorf(`wrong params of parameterless contract %v %v`, fields, err)
+	}
+	if _, err = vm.ContractParams(`@22unknown`); !errors.Is(err, ErrUnknownContract) {
+		t.Errorf(`wrong error %v`, err)
+	}
+}
+
+func TestRunTimeCost(t *testing.T) {
+	vm := NewVM()
+	if err := vm.Compile([]rune(`contract inner {
+			action {
+				var i int
+				while i < 10 {
+					i = i + 1
+				}
+			}
+		}
+		contract outer {
+			action {
+				inner()
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	rt := vm.RunInit(10000)
+	rt.extend = &map[string]interface{}{`rt_state`: uint32(22)}
+	if _, err := ExecContract(rt, `@22inner`, ``, ``); err != nil {
+		t.Fatal(err)
+	}
+	inner := 10000 - rt.Cost()
+	// the nested contract spends the shared budget of the caller
+	if _, err := ExecContract(rt, `@22outer`, ``, ``); err != nil {
+		t.Fatal(err)
+	}
+	if outer := 10000 - inner - rt.Cost(); inner <= 0 || outer <= inner {
+		t.Errorf(`wrong costs %d %d`, inner, outer)
+	}
+
+	for _, cost := range []int64{-1, 10001} {
+		if err := rt.SetCost(cost); !errors.Is(err, ErrCostRange) {
+			t.Errorf(`%d: wrong error %v`, cost, err)
+		}
+	}
+	if err := rt.SetCost(10000); err != nil || rt.Cost() != 10000 {
+		t.Errorf(`cost is not reset %d %v`, rt.Cost(), err)
+	}
+	if err := rt.SetCost(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ExecContract(rt, `@22inner`, ``, ``); err == nil {
+		t.Error(`spent budget must stop the execution`)
+	}
+}
+
+func TestMaxExtendSize(t *testing.T) {
+	vm := NewVM()
+	vm.MaxExtendSize = 100
+	if err := vm.Compile([]rune(`contract fill {
+			data {
+				Count int
+			}
+			action {
+				var i int
+				var list array
+				while i < $Count {
+					$value = "0123456789"
+					i = i + 1
+				}
+				$list = list
+				i = 0
+				while i < $Count {
+					$list[i] = "0123456789"
+					i = i + 1
+				}
+			}
+		}
+		contract outer {
+			action {
+				$prefix = "012345678901234567890123456789012345678901234567890123456789"
+				fill("Count", 4)
+			}
+		}
+		contract overwrite {
+			data {
+				Count int
+			}
+			action {
+				var i int
+				var m map
+				var list array
+				$map = m
+				$list = list
+				while i < $Count {
+					$map["key"] = "0123456789"
+					$list[0] = "0123456789"
+					i = i + 1
+				}
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []struct {
+		name  string
+		count int64
+		err   error
+	}{
+		{`@22fill`, 4, nil},
+		{`@22fill`, 10, ErrExtendSize},
+		{`@22outer`, 0, ErrExtendSize},
+		{`@22overwrite`, 50, nil},
+	} {
+		rt := vm.RunInit(CostDefault)
+		rt.extend = &map[string]interface{}{`rt_state`: uint32(22)}
+		var err error
+		if item.count > 0 {
+			_, err = ExecContract(rt, item.name, `Count`, item.count)
+		} else {
+			_, err = ExecContract(rt, item.name, ``, ``)
+		}
+		if !errors.Is(err, item.err) {
+			t.Errorf(`%v: wrong error %v`, item, err)
+		}
+	}
+}
+
+func TestMaxExtendKeys(t *testing.T) {
+	vm := NewVM()
+	vm.MaxExtendKeys = 10
+	var assigns strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&assigns, "$v%d = %d\n", i, i)
+	}
+	if err := vm.Compile([]rune(`contract many {
+			action {
+				`+assigns.String()+`
+			}
+		}
+		contract same {
+			action {
+				var i int
+				while i < 100 {
+					$value = i
+					$result = i
+					$stop = false
+					i = i + 1
+				}
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []struct {
+		name string
+		err  error
+	}{
+		{`@22many`, ErrMemoryLimit},
+		{`@22same`, nil},
+	} {
+		rt := vm.RunInit(CostDefault)
+		rt.extend = &map[string]interface{}{`rt_state`: uint32(22)}
+		if _, err := ExecContract(rt, item.name, ``, ``); !errors.Is(err, item.err) {
+			t.Errorf(`%s: wrong error %v`, item.name, err)
+		}
+	}
+
+	// the variables which exist before the call aren't created by the contract
+	rt := vm.RunInit(CostDefault)
+	rt.extend = &map[string]interface{}{`rt_state`: uint32(22)}
+	for i := 0; i < 15; i++ {
+		(*rt.extend)[fmt.Sprintf(`v%d`, i)] = int64(0)
+	}
+	if _, err := ExecContract(rt, `@22many`, ``, ``); err != nil {
+		t.Errorf(`existing variables are counted: %v`, err)
+	}
+}
+
+func TestCompileExtern(t *testing.T) {
+	root, errs := CompileExtern(`func double(value int) int {
+			return value * 2
+		}
+		contract caller {
+			action {
+				unknown("Value", double(2))
+			}
+		}`)
+	if len(errs) != 0 || root == nil || root.Objects[`@1caller`] == nil {
+		t.Fatalf(`wrong result %v %v`, root, errs)
+	}
+
+	root, errs = CompileExtern(`contract first {
+			action {
+				$result = value + 1
+			}
+		}
+		func good() int {
+			return 1
+		}
+		contract second {
+			action {
+				var i
+			}
+		}
+		contract third {
+			action {
+				$result = good()
+			}
+		}`)
+	if root != nil || len(errs) != 2 {
+		t.Fatalf(`wrong result %v %v`, root, errs)
+	}
+	if errs[0].Error() != `unknown identifier value` || !strings.Contains(errs[1].Error(), `[Ln:11]`) {
+		t.Errorf(`wrong errors %v`, errs)
+	}
+
+	if _, errs = CompileExtern(`contract open {
+			action {`); len(errs) != 1 {
+		t.Errorf(`wrong errors %v`, errs)
+	}
+}
+
+func TestUsedContracts(t *testing.T) {
+	vm := NewVM()
+	if err := vm.Compile([]rune(`contract zeta {
+			action {
+			}
+		}
+		contract alpha {
+			action {
+			}
+		}
+		contract caller {
+			action {
+				zeta()
+				alpha()
+				zeta()
+			}
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	info := vm.Objects[`@22caller`].Value.(*Block).Info.(*ContractInfo)
+	if used := info.UsedContracts(); strings.Join(used, `,`) != `@22zeta,@22alpha` {
+		t.Errorf(`wrong used contracts %v`, used)
+	}
+	if len(info.Used) != 2 || !info.Used[`@22alpha`] {
+		t.Errorf(`wrong used map %v`, info.Used)
+	}
+}
+
+func TestContractLoader(t *testing.T) {
+	sources := map[string]string{
+		`@22outer`: `contract outer {
+			action {
+				$result = inner()
+			}
+		}`,
+		`@22inner`: `contract inner {
+			action {
+				$result = "loaded"
+			}
+		}`,
+		`@22first`: `contract first {
+			action {
+				second()
+			}
+		}`,
+		`@22second`: `contract second {
+			action {
+				first()
+			}
+		}`,
+	}
+	vm := NewVM()
+	run := func(name string) (string, error) {
+		rt := vm.RunInit(CostDefault)
+		rt.extend = &map[string]interface{}{`rt_state`: uint32(22)}
+		return ExecContract(rt, name, ``, ``)
+	}
+	if _, err := run(`@22outer`); !errors.Is(err, ErrUnknownContract) {
+		t.Errorf(`wrong error without loader %v`, err)
+	}
+
+	calls := make(map[string]int)
+	vm.Loader = func(name string) (string, bool) {
+		calls[name]++
+		source, ok := sources[name]
+		return source, ok
+	}
+	if out, err := run(`@22outer`); err != nil || out != `loaded` {
+		t.Errorf(`wrong result %s %v`, out, err)
+	}
+	if out, err := run(`@22outer`); err != nil || out != `loaded` || calls[`@22outer`] != 1 || calls[`@22inner`] != 1 {
+		t.Errorf(`wrong result %s %v %v`, out, err, calls)
+	}
+	if _, err := run(`@22first`); !errors.Is(err, ErrUnknownContract) {
+		t.Errorf(`wrong error of cyclic contracts %v`, err)
+	}
+	if _, ok := vm.Objects[`@22first`]; ok || len(vm.loading) != 0 {
+		t.Errorf(`cyclic contract is loaded`)
+	}
+}
+
+func TestNoShadowing(t *testing.T) {
+	vm := NewVM()
+	vm.Extend(&ExtendData{map[string]interface{}{"Println": fmt.Println}, nil})
+	sources := []string{
+		`contract Data { data { Amount int } action { var Amount int } }`,
+		`func outer(a int) int { if a > 0 { var a int } return a }`,
+		`func local() { var b int
+			while true { var b string } }`,
+		`func ext() { var Println int }`,
+		`func dup(Println string) {}`,
+	}
+	vm.NoShadowing = true
+	for _, src := range sources {
+		err := vm.Compile([]rune(src), &OwnerInfo{StateID: 1, Active: true, TableID: 1})
+		if !errors.Is(err, ErrShadowing) || !strings.Contains(err.Error(), `[Ln:`) {
+			t.Errorf(`%s: wrong error %v`, src, err)
+		}
+	}
+	if err := vm.Compile([]rune(`contract Plain { data { Amount int }
+		action { var total int
+			total = $Amount } }`), &OwnerInfo{StateID: 1, Active: true, TableID: 1}); err != nil {
+		t.Error(err)
+	}
+
+	vm.NoShadowing = false
+	for _, src := range sources {
+		if err := NewVM().Compile([]rune(src), &OwnerInfo{StateID: 1, Active: true, TableID: 1}); err != nil {
+			t.Errorf(`%s: %v`, src, err)
+		}
+	}
+}
+
+func TestCallExtendError(t *testing.T) {
+	vm := NewVM()
+	errDenied := errors.New(`denied`)
+	vm.Extend(&ExtendData{map[string]interface{}{
+		"Check": func(ok bool) (string, error) {
+			if !ok {
+				return ``, errDenied
+			}
+			return `passed`, nil
+		},
+		"Fail": func() error { return errDenied },
+	}, nil})
+	out, err := vm.Call(`Check`, []interface{}{true}, &map[string]interface{}{})
+	if err != nil || len(out) != 1 || out[0] != `passed` {
+		t.Errorf(`wrong result %v %v`, out, err)
+	}
+	if _, err = vm.Call(`Check`, []interface{}{false}, &map[string]interface{}{}); err != errDenied {
+		t.Errorf(`wrong error %v`, err)
+	}
+	out, err = vm.Call(`Fail`, nil, &map[string]interface{}{})
+	if err != errDenied || len(out) != 0 {
+		t.Errorf(`wrong result %v %v`, out, err)
+	}
+}
+
+func TestRunStopped(t *testing.T) {
+	vm := NewVM()
+	if err := vm.Compile([]rune(`contract spin {
+			data {
+				Step int
+			}
+			action {
+				var i int
+				while true {
+					i = i + $Step
+				}
+			}
+		}
+		func run() {
+			ExecContract("@22spin", "Step", 1)
+		}`), &OwnerInfo{StateID: 22, Active: true, TableID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// the endless transaction is stopped inside the called contract, the cost doesn't limit it
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := vm.RunInit(math.MaxInt64).Run(vm.Objects[`run`].Value.(*Block), nil,
+		&map[string]interface{}{`rt_state`: uint32(22), `rt_context`: ctx})
+	if !errors.Is(err, ErrStopped) {
+		t.Errorf(`wrong error %v`, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf(`contract is stopped in %s`, elapsed)
+	}
+}
@@ -0,0 +1,174 @@
+// MIT License
+//
+// Copyright (c) 2016-2018 GenesisKernel
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package script
+
+import (
+	"fmt"
+
+	"github.com/GenesisKernel/go-genesis/packages/consts"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxCost returns the upper bound of the cost of the name contract without its execution. It includes
+// the costs of the called functions and of the contracts which are called by their names. ErrUnboundedCost
+// is returned if the cost depends on the run-time values, e.g. the contract has loops or recursive calls,
+// calls the contracts by the computed names or calls the extended functions which are paid for the queries
+func (vm *VM) MaxCost(name string) (int64, error) {
+	obj, ok := vm.Objects[name]
+	if !ok || obj.Type != ObjContract {
+		vm.logger.WithFields(log.Fields{"type": consts.ContractError, "contract_name": name}).Error("unknown contract")
+		return 0, newError(ErrUnknownContract, eUnknownContract, name)
+	}
+	est := &costEstimator{vm: vm, name: name, path: make(map[*Block]bool)}
+	return est.contractCost(obj.Value.(*Block))
+}
+
+// costEstimator sums the worst-case costs of the byte-code in the same way as RunCode charges them
+type costEstimator struct {
+	vm   *VM
+	name string          // the estimated contract
+	path map[*Block]bool // the contracts and the functions which are being estimated
+}
+
+func (est *costEstimator) unbounded(reason string, args ...interface{}) error {
+	return newError(ErrUnboundedCost, eUnboundedCost, est.name, fmt.Sprintf(reason, args...))
+}
+
+func (est *costEstimator) enter(block *Block) error {
+	if est.path[block] {
+		return est.unbounded(`recursive call`)
+	}
+	est.path[block] = true
+	return nil
+}
+
+func (est *costEstimator) contractCost(contract *Block) (int64, error) {
+	if err := est.enter(contract); err != nil {
+		return 0, err
+	}
+	defer delete(est.path, contract)
+
+	cost := int64(CostContract)
+	for _, method := range est.vm.methods {
+		if obj, ok := contract.Objects[method]; ok && obj.Type == ObjFunc {
+			methodCost, err := est.blockCost(obj.Value.(*Block))
+			if err != nil {
+				return 0, err
+			}
+			cost += methodCost
+		}
+	}
+	return cost, nil
+}
+
+// blockCost returns the cost of the block, both branches of the conditions are included
+func (est *costEstimator) blockCost(block *Block) (int64, error) {
+	cost := int64(len(block.Vars))
+	for _, cmd := range block.Code {
+		cost++
+		switch cmd.Cmd {
+		case cmdIf, cmdElse:
+			subCost, err := est.blockCost(cmd.Value.(*Block))
+			if err != nil {
+				return 0, err
+			}
+			cost += subCost
+		case cmdWhile:
+			return 0, est.unbounded(`loop`)
+		case cmdExtend, cmdCallExtend:
+			cost += CostExtend
+		case cmdCall, cmdCallVari:
+			callCost, err := est.callCost(cmd.Value.(*ObjInfo), block)
+			if err != nil {
+				return 0, err
+			}
+			cost += callCost
+		}
+	}
+	return cost, nil
+}
+
+func (est *costEstimator) callCost(obj *ObjInfo, caller *Block) (int64, error) {
+	if obj.Type == ObjFunc {
+		fblock := obj.Value.(*Block)
+		if err := est.enter(fblock); err != nil {
+			return 0, err
+		}
+		defer delete(est.path, fblock)
+		funcCost, err := est.blockCost(fblock)
+		if err != nil {
+			return 0, err
+		}
+		return CostCall + funcCost, nil
+	}
+
+	finfo := obj.Value.(ExtFuncInfo)
+	if _, ok := est.vm.FuncCallsDB[finfo.Name]; ok {
+		return 0, est.unbounded(`call of %s function`, finfo.Name)
+	}
+	var cost int64
+	if est.vm.ExtCost != nil {
+		if cost = est.vm.ExtCost(finfo.Name); cost == -1 {
+			cost = CostCall
+		}
+	}
+	switch finfo.Name {
+	case `ExecContract`:
+		nested, err := est.usedCost(caller)
+		if err != nil {
+			return 0, err
+		}
+		cost += nested
+	case `CallContract`:
+		return 0, est.unbounded(`call of contract by computed name`)
+	}
+	return cost, nil
+}
+
+// usedCost returns the max cost of the contracts which are called by their names from the contract
+// of the caller block. ExecContract can be called with any of them, so the explicit calls of ExecContract
+// are supposed to call the same contracts
+func (est *costEstimator) usedCost(caller *Block) (int64, error) {
+	for caller != nil && caller.Type != ObjContract {
+		caller = caller.Parent
+	}
+	if caller == nil || len(caller.Info.(*ContractInfo).Used) == 0 {
+		return 0, est.unbounded(`call of contract by computed name`)
+	}
+	var maxCost int64
+	for _, name := range sortedKeys(caller.Info.(*ContractInfo).Used) {
+		obj, ok := est.vm.Objects[name]
+		if !ok || obj.Type != ObjContract {
+			return 0, est.unbounded(`call of unknown %s contract`, name)
+		}
+		cost, err := est.contractCost(obj.Value.(*Block))
+		if err != nil {
+			return 0, err
+		}
+		if cost > maxCost {
+			maxCost = cost
+		}
+	}
+	return maxCost, nil
+}
@@ -22,17 +22,85 @@
 
 package script
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 const (
-	eContractLoop    = `there is loop in %s contract`
-	eTypeParam       = `parameter %d has wrong type`
-	eUndefinedParam  = `%s is not defined`
-	eUnknownContract = `unknown contract %s`
-	eWrongParams     = `function %s must have %d parameters`
+	eContractLoop      = `there is loop in %s contract`
+	eTypeParam         = `parameter %d has wrong type`
+	eParamType         = `parameter %s expected type %s`
+	eParamActualType   = `parameter %s expected type %s, got %T`
+	eUndefinedParam    = `%s is not defined`
+	eUnknownContract   = `unknown contract %s`
+	eUnknownContractID = `unknown contract with id %d`
+	eUnknownFunc       = `unknown function %s`
+	eUnknownReference  = `unknown contract %s called by %s [Ln:%d Col:%d]`
+	eReplaceContract   = `source must contain only %s contract`
+	eCompileBatch      = `%s: %v`
+	eReadOnlyCall      = `read-only contract %s cannot call %s function`
+	eForbiddenCall     = `contract %s cannot call forbidden %s function`
+	eConditionsCall    = `conditions of %s contract cannot call %s function`
+	eMethodParams      = `method %s of %s contract cannot have parameters`
+	eTooManyParams     = `contract %s has %d parameters, the limit is %d`
+	eWrongMethod       = `wrong contract method %s`
+	eWrongParams       = `function %s must have %d parameters`
+	eWrongVMType       = `contract %s has been compiled for %d VM type, expected %d`
+	eUnboundedCost     = `cost of %s contract is unbounded: %s`
+	eContractInUse     = `%s contract is used by %s`
+	eExtendSize        = `size of extend variables exceeds %d bytes`
+	eMemoryLimit       = `count of extend variables exceeds %d`
+	eExtendRegistered  = `%s already registered`
+	eCostRange         = `cost %d is out of range [0, %d]`
+	eShadowing         = `%s shadows %s [Ln:%d Col:%d]`
 )
 
+// ErrVMPanic is returned instead of the panic which has occurred while the code has been executed
+type ErrVMPanic struct {
+	Value interface{} // the recovered value
+}
+
+func (e *ErrVMPanic) Error() string {
+	return `runtime panic error`
+}
+
+// The errors of the execution of the contracts. The returned errors can have more detailed messages,
+// so they should be checked with errors.Is
 var (
-	errContractPars   = errors.New(`wrong contract parameters`)
-	errWrongCountPars = errors.New(`wrong count of parameters`)
+	ErrUnknownContract  = errors.New(`unknown contract`)
+	ErrUnknownFunc      = errors.New(`unknown function`)
+	ErrContractLoop     = errors.New(`there is loop in contract`)
+	ErrUndefinedParam   = errors.New(`parameter is not defined`)
+	ErrParamType        = errors.New(`wrong type of parameter`)
+	ErrWrongVMType      = errors.New(`wrong vm type of contract`)
+	ErrContractPars     = errors.New(`wrong contract parameters`)
+	ErrContractInactive = errors.New(`contract is inactive`)
+	ErrWrongCountPars   = errors.New(`wrong count of parameters`)
+	ErrUnboundedCost    = errors.New(`cost of contract is unbounded`)
+	ErrContractInUse    = errors.New(`contract is used by other contracts`)
+	ErrExtendSize       = errors.New(`size of extend variables is exceeded`)
+	ErrMemoryLimit      = errors.New(`memory limit of extend variables is exceeded`)
+	ErrExtendRegistered = errors.New(`extended function is already registered`)
+	ErrCostRange        = errors.New(`cost is out of range`)
+	ErrShadowing        = errors.New(`declaration shadows name`)
+	ErrStopped          = errors.New(`execution has been stopped`)
 )
+
+// vmError is the error with the formatted message which matches its sentinel error with errors.Is
+type vmError struct {
+	err error
+	msg string
+}
+
+func (e *vmError) Error() string {
+	return e.msg
+}
+
+func (e *vmError) Unwrap() error {
+	return e.err
+}
+
+func newError(err error, format string, args ...interface{}) error {
+	return &vmError{err: err, msg: fmt.Sprintf(format, args...)}
+}
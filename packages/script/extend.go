@@ -0,0 +1,200 @@
+// MIT License
+//
+// Copyright (c) 2016-2018 GenesisKernel
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package script
+
+import (
+	"reflect"
+
+	"github.com/GenesisKernel/go-genesis/packages/consts"
+
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+)
+
+// Extend is the storage of the extend variables which are available to the contracts as $name.
+// ExecContract works with the variables through it, so the storage can be replaced with more
+// efficient one without changes of the callers
+type Extend interface {
+	Get(key string) (interface{}, bool)
+	Set(key string, value interface{})
+	Delete(key string)
+}
+
+// MapExtend is Extend backed by the extend map, the changes are made directly in the map
+type MapExtend map[string]interface{}
+
+// Get returns the value of the variable and true if it is defined
+func (ext MapExtend) Get(key string) (interface{}, bool) {
+	val, ok := ext[key]
+	return val, ok
+}
+
+// Set assigns the value to the variable
+func (ext MapExtend) Set(key string, value interface{}) {
+	ext[key] = value
+}
+
+// Delete removes the variable
+func (ext MapExtend) Delete(key string) {
+	delete(ext, key)
+}
+
+// Extend returns the extend variables of the runtime, it returns nil if the runtime is not running
+func (rt *RunTime) Extend() Extend {
+	if rt.extend == nil {
+		return nil
+	}
+	return MapExtend(*rt.extend)
+}
+
+// extendUsage is the approximate size of the values assigned to the extend variables and the count of
+// the created variables, it is shared by the runtimes of the nested contracts so the limits of
+// VM.MaxExtendSize and VM.MaxExtendKeys are applied to the whole call
+type extendUsage struct {
+	total int64
+	vars  map[string]int64
+	keys  int
+}
+
+// reservedExtend are the extend variables which are set by the runtime, the contracts can assign them
+// but they aren't counted by VM.MaxExtendKeys
+var reservedExtend = map[string]bool{
+	`result`: true,
+	`stop`:   true,
+	`parent`: true,
+}
+
+// trackExtend accounts the value assigned to the name extend variable, it replaces the previous value
+func (rt *RunTime) trackExtend(name string, value interface{}) error {
+	if rt.extendUsage == nil {
+		return nil
+	}
+	return rt.growExtend(name, valueSize(value, 0)-rt.extendUsage.vars[name])
+}
+
+// trackExtendItem accounts the value assigned to the item of the array or the map in the name extend
+// variable. Only the difference with the size of the replaced item is added, so the overwriting of
+// the same item doesn't grow the size of the variable
+func (rt *RunTime) trackExtendItem(name string, container, index, value interface{}) error {
+	if rt.extendUsage == nil {
+		return nil
+	}
+	return rt.growExtend(name, itemSizeDelta(container, index, value))
+}
+
+func (rt *RunTime) growExtend(name string, delta int64) error {
+	usage := rt.extendUsage
+	usage.vars[name] += delta
+	usage.total += delta
+	if limit := rt.vm.MaxExtendSize; limit > 0 && usage.total > limit {
+		rt.vm.logger.WithFields(log.Fields{"type": consts.VMError, "name": name, "size": usage.total, "limit": limit}).Error("extend size exceeded")
+		return newError(ErrExtendSize, eExtendSize, limit)
+	}
+	return nil
+}
+
+// itemSizeDelta returns how the size of the container changes if value is assigned to its index item.
+// The new key of the map is counted with the value, the array is extended by the empty items up to index
+func itemSizeDelta(container, index, value interface{}) int64 {
+	size := valueSize(value, 1)
+	switch items := container.(type) {
+	case map[string]interface{}:
+		key, _ := index.(string)
+		if prev, ok := items[key]; ok {
+			return size - valueSize(prev, 1)
+		}
+		return size + int64(len(key))
+	case map[string]string:
+		key, _ := index.(string)
+		if prev, ok := items[key]; ok {
+			return size - int64(len(prev))
+		}
+		return size + int64(len(key))
+	case []interface{}:
+		ind, _ := index.(int64)
+		if ind >= 0 && ind < int64(len(items)) {
+			return size - valueSize(items[ind], 1)
+		}
+		return size + (ind-int64(len(items)))*scalarSize
+	case []map[string]string:
+		ind, _ := index.(int64)
+		if ind >= 0 && ind < int64(len(items)) {
+			return size - valueSize(items[ind], 1)
+		}
+	}
+	return size
+}
+
+// trackExtendKey counts the name extend variable which is created by the contract
+func (rt *RunTime) trackExtendKey(name string) error {
+	if rt.extendUsage == nil || reservedExtend[name] {
+		return nil
+	}
+	if _, ok := (*rt.extend)[name]; ok {
+		return nil
+	}
+	rt.extendUsage.keys++
+	if limit := rt.vm.MaxExtendKeys; limit > 0 && rt.extendUsage.keys > limit {
+		rt.vm.logger.WithFields(log.Fields{"type": consts.VMError, "name": name, "limit": limit}).Error("extend keys exceeded")
+		return newError(ErrMemoryLimit, eMemoryLimit, limit)
+	}
+	return nil
+}
+
+// maxSizeDepth is the depth of the nested arrays and maps after which the values are counted as scalars
+const maxSizeDepth = 16
+
+// scalarSize is the size of the number, the boolean value and the reference
+const scalarSize = 8
+
+// valueSize returns the coarse size of the value in bytes. The strings and the byte slices are counted
+// by their lengths, the arrays and the maps by their items and keys, the other values have the fixed size
+func valueSize(value interface{}, depth int) int64 {
+	switch v := value.(type) {
+	case string:
+		return int64(len(v))
+	case []byte:
+		return int64(len(v))
+	case decimal.Decimal:
+		return int64(len(v.String()))
+	}
+	if depth >= maxSizeDepth || value == nil {
+		return scalarSize
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		size := int64(scalarSize)
+		for i := 0; i < rv.Len(); i++ {
+			size += valueSize(rv.Index(i).Interface(), depth+1)
+		}
+		return size
+	case reflect.Map:
+		size := int64(scalarSize)
+		for _, key := range rv.MapKeys() {
+			size += valueSize(key.Interface(), depth+1) + valueSize(rv.MapIndex(key).Interface(), depth+1)
+		}
+		return size
+	}
+	return scalarSize
+}
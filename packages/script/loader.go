@@ -0,0 +1,74 @@
+// MIT License
+//
+// Copyright (c) 2016-2018 GenesisKernel
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package script
+
+import (
+	"strconv"
+
+	"github.com/GenesisKernel/go-genesis/packages/consts"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxLoadDepth is the max count of the contracts which can be loaded by Loader at the same time,
+// e.g. when the loaded contract calls another unknown contract
+const maxLoadDepth = 16
+
+// loadContract compiles the source of the unknown name contract returned by Loader and loads it
+// into the virtual machine. The contract which is being loaded isn't requested again, so the cyclic
+// references between the loaded contracts fail as the unknown ones
+func (vm *VM) loadContract(name string) *ObjInfo {
+	if vm.Loader == nil || len(name) < 2 || name[0] != '@' || vm.loading[name] {
+		return nil
+	}
+	logger := vm.logger.WithFields(log.Fields{"type": consts.ContractError, "contract_name": name})
+	if len(vm.loading) >= maxLoadDepth {
+		logger.WithFields(log.Fields{"depth": len(vm.loading)}).Error("too deep loading of contracts")
+		return nil
+	}
+	source, ok := vm.Loader(name)
+	if !ok {
+		return nil
+	}
+	if vm.loading == nil {
+		vm.loading = make(map[string]bool)
+	}
+	vm.loading[name] = true
+	defer delete(vm.loading, name)
+
+	i := 1
+	for i < len(name) && name[i] >= '0' && name[i] <= '9' {
+		i++
+	}
+	state, _ := strconv.ParseUint(name[1:i], 10, 32)
+	if err := vm.Compile([]rune(source), &OwnerInfo{StateID: uint32(state)}); err != nil {
+		logger.WithFields(log.Fields{"error": err}).Error("compiling loaded contract")
+		return nil
+	}
+	obj, ok := vm.Objects[name]
+	if !ok || obj.Type != ObjContract {
+		logger.Error("loaded source doesn't contain the contract")
+		return nil
+	}
+	return obj
+}
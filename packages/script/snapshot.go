@@ -0,0 +1,101 @@
+// MIT License
+//
+// Copyright (c) 2016-2018 GenesisKernel
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package script
+
+// VMSnapshot is the saved state of the compiled objects of the virtual machine. It captures
+// the map of the objects, the list of the children blocks, the values of the objects, the
+// contract and function information and the owners, so the compilation, the replacement and
+// the activation of the contracts can be rolled back. The byte-code of the blocks isn't copied
+// because it isn't changed after the compilation. The extend maps belong to the callers and
+// the settings of the VM like ExtCost or the cost profile are not captured
+type VMSnapshot struct {
+	objects  map[string]*ObjInfo
+	values   map[*ObjInfo]ObjInfo
+	children Blocks
+	infos    map[*Block]interface{}
+	owners   map[*OwnerInfo]OwnerInfo
+}
+
+// Snapshot saves the current state of the compiled objects of the virtual machine
+func (vm *VM) Snapshot() *VMSnapshot {
+	vm.flushMutex.Lock()
+	defer vm.flushMutex.Unlock()
+
+	snap := &VMSnapshot{
+		objects:  make(map[string]*ObjInfo, len(vm.Objects)),
+		values:   make(map[*ObjInfo]ObjInfo, len(vm.Objects)),
+		children: make(Blocks, len(vm.Children), cap(vm.Children)),
+		infos:    make(map[*Block]interface{}),
+		owners:   make(map[*OwnerInfo]OwnerInfo),
+	}
+	for key, obj := range vm.Objects {
+		snap.objects[key] = obj
+		snap.values[obj] = *obj
+	}
+	copy(snap.children, vm.Children)
+	for _, block := range vm.Children {
+		if block == nil {
+			continue
+		}
+		switch info := block.Info.(type) {
+		case *ContractInfo:
+			snap.infos[block] = *info
+			if info.Owner != nil {
+				snap.owners[info.Owner] = *info.Owner
+			}
+		case *FuncInfo:
+			snap.infos[block] = *info
+		}
+		if block.Owner != nil {
+			snap.owners[block.Owner] = *block.Owner
+		}
+	}
+	return snap
+}
+
+// Restore returns the virtual machine to the state saved by Snapshot. The snapshot can be restored many times
+func (vm *VM) Restore(snap *VMSnapshot) {
+	vm.flushMutex.Lock()
+	defer vm.flushMutex.Unlock()
+
+	vm.Objects = make(map[string]*ObjInfo, len(snap.objects))
+	for key, obj := range snap.objects {
+		vm.Objects[key] = obj
+	}
+	for obj, value := range snap.values {
+		*obj = value
+	}
+	vm.Children = make(Blocks, len(snap.children), cap(snap.children))
+	copy(vm.Children, snap.children)
+	for block, info := range snap.infos {
+		switch info := info.(type) {
+		case ContractInfo:
+			*block.Info.(*ContractInfo) = info
+		case FuncInfo:
+			*block.Info.(*FuncInfo) = info
+		}
+	}
+	for owner, value := range snap.owners {
+		*owner = value
+	}
+}
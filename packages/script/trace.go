@@ -0,0 +1,105 @@
+// MIT License
+//
+// Copyright (c) 2016-2018 GenesisKernel
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package script
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ContractTrace describes one execution of the contract for ContractTracer. The nested contracts
+// have the name of the calling contract in Parent and the bigger Depth, so the graph of the calls
+// can be reconstructed from the sequence of EnterContract and ExitContract
+type ContractTrace struct {
+	Name   string
+	Parent string // the name of the calling contract, it's empty for the top contract
+	Depth  int
+	// Params are the parameters of the contract. The values of the fields with 'hidden' tag
+	// are omitted and the values of the fields with 'hashed' tag are replaced with their SHA256 hashes
+	Params     map[string]interface{}
+	ParamsHash []byte // the SHA256 hash of Params
+	Cost       int64  // the cost spent by the contract and its nested contracts, it is set on exit
+	Error      error  // the error of the contract, it is set on exit
+}
+
+// ContractTracer receives the events of the execution of the contracts. The methods can be called
+// from different goroutines if the VM executes the contracts concurrently
+type ContractTracer interface {
+	EnterContract(trace *ContractTrace)
+	ExitContract(trace *ContractTrace)
+}
+
+// traceEnter notifies the tracer about the start of the contract and returns the trace of the contract
+func (rt *RunTime) traceEnter(name string, cblock *Block, pars []string, values []interface{}) *ContractTrace {
+	trace := &ContractTrace{Name: name, Params: traceParams(cblock.Info.(*ContractInfo).Tx, pars, values)}
+	if rt.trace != nil {
+		trace.Parent, trace.Depth = rt.trace.Name, rt.trace.Depth+1
+	}
+	trace.ParamsHash = hashParams(trace.Params)
+	rt.vm.Tracer.EnterContract(trace)
+	return trace
+}
+
+// traceExit notifies the tracer about the end of the contract
+func (rt *RunTime) traceExit(trace *ContractTrace, cost int64, err error) {
+	trace.Cost, trace.Error = cost-rt.cost, err
+	rt.vm.Tracer.ExitContract(trace)
+}
+
+func traceParams(fields *[]*FieldInfo, pars []string, values []interface{}) map[string]interface{} {
+	tags := make(map[string]string)
+	if fields != nil {
+		for _, field := range *fields {
+			tags[field.Name] = field.Tags
+		}
+	}
+	params := make(map[string]interface{}, len(pars))
+	for i, name := range pars {
+		if len(name) == 0 {
+			continue
+		}
+		switch {
+		case strings.Contains(tags[name], `hidden`):
+		case strings.Contains(tags[name], `hashed`):
+			params[name] = fmt.Sprintf(`%x`, sha256.Sum256([]byte(fmt.Sprint(values[i]))))
+		default:
+			params[name] = values[i]
+		}
+	}
+	return params
+}
+
+func hashParams(params map[string]interface{}) []byte {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%v;", name, params[name])
+	}
+	return h.Sum(nil)
+}
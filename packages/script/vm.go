@@ -23,12 +23,15 @@
 package script
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"reflect"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/GenesisKernel/go-genesis/packages/consts"
 
@@ -68,7 +71,12 @@ type RunTime struct {
 	extend *map[string]interface{}
 	vm     *VM
 	cost   int64
+	budget int64 // the cost passed to RunInit, SetCost can't exceed it
 	err    error
+	trace  *ContractTrace // the trace of the running contract if VM has Tracer
+	// extendUsage is the size of the extend variables if VM has MaxExtendSize or MaxExtendKeys
+	extendUsage *extendUsage
+	done        <-chan struct{} // the done channel of rt_context, the code is stopped when it is closed
 }
 
 func (rt *RunTime) callFunc(cmd uint16, obj *ObjInfo) (err error) {
@@ -94,8 +102,8 @@ func (rt *RunTime) callFunc(cmd uint16, obj *ObjInfo) (err error) {
 		if cmd == cmdCallVari {
 			parcount := count + 1 - in
 			if parcount < 0 {
-				log.WithFields(log.Fields{"type": consts.VMError}).Error(errWrongCountPars.Error())
-				return errWrongCountPars
+				log.WithFields(log.Fields{"type": consts.VMError}).Error(ErrWrongCountPars.Error())
+				return ErrWrongCountPars
 			}
 			pars := make([]interface{}, parcount)
 			shift := size - parcount
@@ -107,15 +115,15 @@ func (rt *RunTime) callFunc(cmd uint16, obj *ObjInfo) (err error) {
 		}
 		finfo := obj.Value.(*Block).Info.(*FuncInfo)
 		if len(rt.stack) < len(finfo.Params) {
-			log.WithFields(log.Fields{"type": consts.VMError}).Error(errWrongCountPars.Error())
-			return errWrongCountPars
+			log.WithFields(log.Fields{"type": consts.VMError}).Error(ErrWrongCountPars.Error())
+			return ErrWrongCountPars
 		}
 		for i, v := range finfo.Params {
 			switch v.String() {
 			case `string`, `int64`:
 				if reflect.TypeOf(rt.stack[len(rt.stack)-in+i]) != v {
 					log.WithFields(log.Fields{"type": consts.VMError}).Error(eTypeParam)
-					return fmt.Errorf(eTypeParam, i+1)
+					return newError(ErrParamType, eTypeParam, i+1)
 				}
 			}
 		}
@@ -200,7 +208,7 @@ func (rt *RunTime) extendFunc(name string) error {
 		f  interface{}
 	)
 	if f, ok = (*rt.extend)[name]; !ok || reflect.ValueOf(f).Kind().String() != `func` {
-		return fmt.Errorf(`unknown function %s`, name)
+		return newError(ErrUnknownFunc, eUnknownFunc, name)
 	}
 	size := len(rt.stack)
 	foo := reflect.ValueOf(f)
@@ -225,6 +233,19 @@ func (rt *RunTime) extendFunc(name string) error {
 	return nil
 }
 
+// sortedKeys returns the string keys of the map m in the ascending order. The VM enumerates the maps
+// in this order while the contracts are executed if the order can affect the result, so all nodes get
+// the same result of the same transaction. The maps which are only copied are enumerated as is
+func sortedKeys(m interface{}) []string {
+	keys := reflect.ValueOf(m).MapKeys()
+	ret := make([]string, len(keys))
+	for i, key := range keys {
+		ret[i] = key.String()
+	}
+	sort.Strings(ret)
+	return ret
+}
+
 func valueToBool(v interface{}) bool {
 	switch val := v.(type) {
 	case int:
@@ -309,20 +330,147 @@ func ValueToDecimal(v interface{}) (ret decimal.Decimal) {
 	return
 }
 
-// SetCost sets the max cost of the execution.
-func (rt *RunTime) SetCost(cost int64) {
+// SetCost sets the remaining cost of the execution, so several contracts which are executed with
+// the same RunTime share one budget. The cost must be between 0 and the cost passed to RunInit.
+// It should be called between the calls, ExecContract passes the remaining cost to the nested
+// contracts and takes back what they have left, so the cost set during the call is overwritten
+func (rt *RunTime) SetCost(cost int64) error {
+	if cost < 0 || cost > rt.budget {
+		rt.vm.logger.WithFields(log.Fields{"type": consts.ParameterExceeded, "cost": cost, "budget": rt.budget}).Error("cost is out of range")
+		return newError(ErrCostRange, eCostRange, cost, rt.budget)
+	}
 	rt.cost = cost
+	return nil
 }
 
-// Cost return the remain cost of the execution.
+// Cost return the remain cost of the execution. It includes the costs of the nested contracts
+// which have returned, so the budget spent by the calls is the cost passed to RunInit minus Cost
 func (rt *RunTime) Cost() int64 {
 	return rt.cost
 }
 
+// SnapshotExtend saves the current keys and values of the extend map and returns the function
+// which restores them. The map is copied shallowly, so the changes inside the maps and arrays stored
+// in the extend map are not reverted. It takes O(n) time and memory for n keys both for the saving
+// and for the restoring, so it should be used carefully with the large extend maps
+func (rt *RunTime) SnapshotExtend() func() {
+	if rt.extend == nil {
+		return func() {}
+	}
+	saved := make(map[string]interface{}, len(*rt.extend))
+	for key, val := range *rt.extend {
+		saved[key] = val
+	}
+	extend := rt.extend
+	return func() {
+		for key := range *extend {
+			if _, ok := saved[key]; !ok {
+				delete(*extend, key)
+			}
+		}
+		for key, val := range saved {
+			(*extend)[key] = val
+		}
+	}
+}
+
+// CostStat is the total cost and the count of calls of the extended function
+type CostStat struct {
+	Count int64
+	Cost  int64
+}
+
+type costProfile struct {
+	mutex sync.Mutex
+	stats map[string]CostStat
+}
+
+func (cp *costProfile) add(name string, cost int64) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+
+	stat := cp.stats[name]
+	stat.Count++
+	stat.Cost += cost
+	cp.stats[name] = stat
+}
+
+// EnableCostProfile switches on the accumulation of the cost of the extended functions.
+// The cost of the function includes the cost of the contracts called by it.
+// It should be called before the virtual machine starts running the code
+func (vm *VM) EnableCostProfile() {
+	vm.costProfile = &costProfile{stats: make(map[string]CostStat)}
+}
+
+// DisableCostProfile switches off the accumulation of the cost of the extended functions
+func (vm *VM) DisableCostProfile() {
+	vm.costProfile = nil
+}
+
+// CostProfile returns the snapshot of the accumulated cost of the extended functions by their names
+func (vm *VM) CostProfile() map[string]CostStat {
+	ret := make(map[string]CostStat)
+	if vm.costProfile == nil {
+		return ret
+	}
+	vm.costProfile.mutex.Lock()
+	defer vm.costProfile.mutex.Unlock()
+	for name, stat := range vm.costProfile.stats {
+		ret[name] = stat
+	}
+	return ret
+}
+
+// InvokeContract executes the name contract with the specified parameters in the current state.
+// It is intended for the extended functions which get *RunTime as the first parameter.
+// The cost of the contract is charged against the remaining cost of rt and
+// the contract can't be called if it is already running in the chain of calls
+func (rt *RunTime) InvokeContract(name string, params map[string]interface{}) (interface{}, error) {
+	if rt.extend == nil {
+		rt.vm.logger.WithFields(log.Fields{"type": consts.VMError, "contract_name": name}).Error("runtime is not running")
+		return nil, fmt.Errorf(`runtime is not running`)
+	}
+	if rt.cost <= CostContract {
+		rt.vm.logger.WithFields(log.Fields{"type": consts.VMError}).Warn("paid CPU resource is over")
+		return nil, fmt.Errorf(`paid CPU resource is over`)
+	}
+	var state uint32
+	if val, ok := (*rt.extend)[`rt_state`]; ok {
+		state = val.(uint32)
+	}
+	return ExContract(rt, state, name, params)
+}
+
 // RunInit creates a new RunTime for the virtual machine
 func (vm *VM) RunInit(cost int64) *RunTime {
-	rt := RunTime{stack: make([]interface{}, 0, 1024), vm: vm, cost: cost}
-	return &rt
+	rt := runTimePool.Get().(*RunTime)
+	rt.vm, rt.cost, rt.budget = vm, cost, cost
+	return rt
+}
+
+// runTimePool keeps the released RunTime objects, so the nested contract calls don't allocate
+// the stacks again
+var runTimePool = sync.Pool{
+	New: func() interface{} {
+		return &RunTime{stack: make([]interface{}, 0, 1024)}
+	},
+}
+
+// release resets RunTime and returns it to the pool. RunTime must not be used after that
+func (rt *RunTime) release() {
+	// the references are cleared so the pooled objects don't keep the values from being collected
+	stack, vars, blocks := rt.stack[:cap(rt.stack)], rt.vars[:cap(rt.vars)], rt.blocks[:cap(rt.blocks)]
+	for i := range stack {
+		stack[i] = nil
+	}
+	for i := range vars {
+		vars[i] = nil
+	}
+	for i := range blocks {
+		blocks[i] = nil
+	}
+	*rt = RunTime{stack: stack[:0], vars: vars[:0], blocks: blocks[:0]}
+	runTimePool.Put(rt)
 }
 
 func SetVMError(eType string, eText interface{}) error {
@@ -363,7 +511,8 @@ func (rt *RunTime) RunCode(block *Block) (status int, err error) {
 		rt.vars = append(rt.vars, value)
 	}
 	if namemap != nil {
-		for key, item := range namemap {
+		for _, key := range sortedKeys(namemap) {
+			item := namemap[key]
 			params := (*block.Info.(*FuncInfo).Names)[key]
 			if params.Variadic {
 
@@ -389,6 +538,14 @@ func (rt *RunTime) RunCode(block *Block) (status int, err error) {
 			rt.vm.logger.WithFields(log.Fields{"type": consts.VMError}).Warn("paid CPU resource is over")
 			return 0, fmt.Errorf(`paid CPU resource is over`)
 		}
+		if rt.done != nil {
+			select {
+			case <-rt.done:
+				rt.vm.logger.WithFields(log.Fields{"type": consts.ContextError}).Warn("running code is stopped")
+				return 0, ErrStopped
+			default:
+			}
+		}
 		cmd := block.Code[ci]
 		var bin interface{}
 		size := len(rt.stack)
@@ -442,7 +599,14 @@ func (rt *RunTime) RunCode(block *Block) (status int, err error) {
 			for ivar, item := range assign {
 				if item.Owner == nil {
 					if (*item).Obj.Type == ObjExtend {
-						(*rt.extend)[(*item).Obj.Value.(string)] = rt.stack[len(rt.stack)-count+ivar]
+						name, value := (*item).Obj.Value.(string), rt.stack[len(rt.stack)-count+ivar]
+						if err = rt.trackExtendKey(name); err != nil {
+							break
+						}
+						if err = rt.trackExtend(name, value); err != nil {
+							break
+						}
+						(*rt.extend)[name] = value
 					}
 				} else {
 					var i int
@@ -483,6 +647,7 @@ func (rt *RunTime) RunCode(block *Block) (status int, err error) {
 			rt.stack = rt.stack[:mapoff+1]
 			continue
 		case cmdCallVari, cmdCall:
+			costBefore := rt.cost
 			if cmd.Value.(*ObjInfo).Type == ObjExtFunc {
 				finfo := cmd.Value.(*ObjInfo).Value.(ExtFuncInfo)
 				if rt.vm.ExtCost != nil {
@@ -501,6 +666,9 @@ func (rt *RunTime) RunCode(block *Block) (status int, err error) {
 				rt.cost -= CostCall
 			}
 			err = rt.callFunc(cmd.Cmd, cmd.Value.(*ObjInfo))
+			if rt.vm.costProfile != nil && cmd.Value.(*ObjInfo).Type == ObjExtFunc {
+				rt.vm.costProfile.add(cmd.Value.(*ObjInfo).Value.(ExtFuncInfo).Name, costBefore-rt.cost)
+			}
 
 		case cmdVar:
 			ivar := cmd.Value.(*VarInfo)
@@ -557,6 +725,11 @@ func (rt *RunTime) RunCode(block *Block) (status int, err error) {
 				err = fmt.Errorf(`Type %s doesn't support indexing`, itype)
 			}
 		case cmdSetIndex:
+			if indexInfo := cmd.Value.(*IndexInfo); indexInfo.Owner == nil {
+				if err = rt.trackExtendItem(indexInfo.Extend, rt.stack[size-3], rt.stack[size-2], rt.stack[size-1]); err != nil {
+					break
+				}
+			}
 			itype := reflect.TypeOf(rt.stack[size-3]).String()
 			switch {
 			case itype[:3] == `map`:
@@ -830,16 +1003,28 @@ func (rt *RunTime) RunCode(block *Block) (status int, err error) {
 	return
 }
 
-// Run executes Block with the specified parameters and extended variables and functions
+// recoverPanic logs the recovered panic and returns ErrVMPanic error
+func recoverPanic(logger *log.Entry, r interface{}) error {
+	logger.WithFields(log.Fields{"type": consts.PanicRecoveredError, "error": r}).Error("runtime panic error")
+	logger.WithFields(log.Fields{"type": consts.PanicRecoveredError, "stack": string(debug.Stack())}).Debug("runtime panic stack")
+	return &ErrVMPanic{Value: r}
+}
+
+// Run executes Block with the specified parameters and extended variables and functions.
+// If the rt_context extended variable is context.Context, the code returns ErrStopped when it is done
 func (rt *RunTime) Run(block *Block, params []interface{}, extend *map[string]interface{}) (ret []interface{}, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			rt.vm.logger.WithFields(log.Fields{"type": consts.PanicRecoveredError, "stack": string(debug.Stack())}).Error("runtime panic error")
-			err = fmt.Errorf(`runtime panic error`)
+			err = recoverPanic(rt.vm.logger, r)
 		}
 	}()
 	info := block.Info.(*FuncInfo)
 	rt.extend = extend
+	if extend != nil {
+		if ctx, ok := (*extend)[`rt_context`].(context.Context); ok {
+			rt.done = ctx.Done()
+		}
+	}
 	if _, err = rt.RunCode(block); err == nil {
 		off := len(rt.stack) - len(info.Results)
 		for i := 0; i < len(info.Results); i++ {
@@ -24,13 +24,18 @@ package script
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"unicode"
 
 	"github.com/GenesisKernel/go-genesis/packages/consts"
 
+	"github.com/shopspring/decimal"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -87,6 +92,15 @@ type ExtFuncInfo struct {
 	Func     interface{}
 }
 
+// ExtFuncSummary describes the signature of the extended function as it is seen by the contracts.
+// The auto parameters like *RunTime are filled by VM, so they aren't included in Params
+type ExtFuncSummary struct {
+	Name     string
+	Params   []string
+	Results  []string
+	Variadic bool // the last parameter is a slice of the variadic values
+}
+
 // FieldInfo describes the field of the data structure
 type FieldInfo struct {
 	Name string
@@ -100,8 +114,26 @@ type ContractInfo struct {
 	Name     string
 	Owner    *OwnerInfo
 	Used     map[string]bool // Called contracts
+	used     []string        // Called contracts in the order of the first call
 	Tx       *[]*FieldInfo
 	Settings map[string]interface{}
+	VMType   VMType // type of the virtual machine the contract has been compiled for
+}
+
+// UsedContracts returns the names of the contracts called by the contract in the order
+// of their first calls in the source. Used should be checked if only the membership is needed
+func (info *ContractInfo) UsedContracts() []string {
+	return append([]string(nil), info.used...)
+}
+
+func (info *ContractInfo) addUsed(name string) {
+	if info.Used == nil {
+		info.Used = make(map[string]bool)
+	}
+	if !info.Used[name] {
+		info.Used[name] = true
+		info.used = append(info.used, name)
+	}
 }
 
 // FuncNameCmd for cmdFuncName
@@ -163,6 +195,7 @@ type Block struct {
 	Parent   *Block
 	Vars     []reflect.Type
 	Code     ByteCodes
+	Lines    []uint32 // lines of the source code of Code instructions if VM.SourceLines is on
 	Children Blocks
 }
 
@@ -174,8 +207,89 @@ type VM struct {
 	Block
 	ExtCost     func(string) int64
 	FuncCallsDB map[string]struct{}
-	Extern      bool // extern mode of compilation
+	// ReadOnlyFuncs is the set of the extended functions without side effects. The contracts
+	// with 'readonly = 1' in settings can call only these functions
+	ReadOnlyFuncs map[string]struct{}
+	Extern        bool // extern mode of compilation
+	VMType        VMType
+	// IsolateMethods makes init, conditions and action of the contract run with their own
+	// shallow copies of the extend map of the caller. The variables assigned by one method are
+	// not visible to the following methods and to the caller, but the maps and arrays are shared.
+	// Only the outputs of the contract $result and $stop are copied back to the caller.
+	// By default all methods work with the same extend map
+	IsolateMethods bool
+	// RollbackExtend makes ExecContract restore the extend map if the method of the contract fails,
+	// so the variables assigned by the failed method are reverted. See RunTime.SnapshotExtend
+	RollbackExtend bool
+	// CheckActive forbids the execution of the contracts which owners are not active.
+	// It is off by default because the contracts of the blockchain are inactive until
+	// somebody pays for them with ActivateContract
+	CheckActive bool
+	// SourceLines makes the compiler fill the line tables of the blocks for debugging and coverage
+	SourceLines bool
+	// FuncPolicy restricts the extended functions which can be called by the contracts compiled
+	// while it is set, e.g. it can be set before the compilation of the contracts of a tenant
+	FuncPolicy *FuncPolicy
+	// NoShadowing makes the compiler reject the variables and the parameters with the names of
+	// the variables of the enclosing blocks, the functions, the contracts and the data fields
+	NoShadowing bool
+	// StrictExtend makes Extend return the error instead of the replacement of the registered objects
+	StrictExtend bool
+	// LegacyParams turns off the check and the conversion of the contract parameters by ExecContract and
+	// CallContract, so the values are passed to the contract as they are. The check changes the on-chain
+	// behaviour, the parameters which were accepted before can be refused or get another type, so it should
+	// be set to replay the blocks which have been generated by the nodes without the check
+	LegacyParams bool
+	// MaxTxParams is the max count of the data fields of the contract, 0 means consts.MaxTxParams
+	MaxTxParams int
+	// MaxExtendSize is the max approximate size in bytes of the values assigned to the extend variables
+	// by the contract and the contracts called by it, 0 means unlimited. The size is coarse: the strings
+	// are counted by the length, the arrays and the maps by the items, the other values have the fixed size.
+	// Only the assignments of the contract are counted, the values which the extended functions put
+	// into the extend map and the items added to the arrays and the maps by the functions aren't counted
+	MaxExtendSize int64
+	// MaxExtendKeys is the max count of the extend variables which can be created by the contract and
+	// the contracts called by it, 0 means unlimited. The variables of the runtime like $result aren't counted
+	MaxExtendKeys int
+	// Tracer gets the events of the execution of the contracts, nothing is traced if it is nil
+	Tracer ContractTracer
+	// Loader returns the source of the unknown contract by its name with the state prefix, e.g. @1name.
+	// The source is compiled and loaded when the contract is called or compiled. The owner of the loaded
+	// contracts has only the state which is taken from the name. The loading changes the virtual machine
+	// like Compile does, so Loader must not be set while the contracts are executed concurrently
+	Loader      func(name string) (string, bool)
+	loading     map[string]bool // the contracts which are being loaded by Loader
+	methods     []string
+	stateRefs   []stateRef // the calls of the contracts with the state prefix compiled in the extern mode
 	logger      *log.Entry
+	flushMutex  sync.Mutex
+	compiled    compileCache // the sources loaded by CompileCached
+	costProfile *costProfile
+}
+
+// DefaultContractMethods is the default sequence of the methods which are called by ExecContract
+var DefaultContractMethods = []string{`init`, `conditions`, `action`}
+
+// FuncPolicy is the list of the allowed or denied extended functions. If Allow isn't nil
+// only the functions from Allow can be called. The functions from Deny can't be called in any case
+type FuncPolicy struct {
+	Allow map[string]struct{}
+	Deny  map[string]struct{}
+}
+
+// Allowed returns true if the extended function can be called according to the policy
+func (policy *FuncPolicy) Allowed(name string) bool {
+	if policy == nil {
+		return true
+	}
+	if _, ok := policy.Deny[name]; ok {
+		return false
+	}
+	if policy.Allow != nil {
+		_, ok := policy.Allow[name]
+		return ok
+	}
+	return true
 }
 
 // ExtendData is used for the definition of the extended functions and variables
@@ -200,51 +314,231 @@ func ParseContract(in string) (id uint64, name string) {
 }
 
 // ExecContract runs the name contract where txs contains the list of parameters and
-// params are the values of parameters
+// params are the values of parameters. Any method of the contract can finish the contract
+// successfully by assigning a true value to $stop, e.g. $stop = 1 in conditions, then the next
+// methods are not called. The value of $stop is dropped when the contract is finished, so it
+// doesn't stop the calling contract
 func ExecContract(rt *RunTime, name, txs string, params ...interface{}) (string, error) {
 	var result string
+	if _, err := execContractWithResults(rt, name, txs, params...); err != nil {
+		return ``, err
+	}
+	if val, _ := rt.Extend().Get(`result`); val != nil {
+		result = fmt.Sprint(val)
+	}
+	return result, nil
+}
 
+// EvalConditions runs only the conditions method of the name contract and returns true if it has passed,
+// any error of the conditions means that they have failed. The values of params are assigned to the data
+// fields of the contract in the order of their declaration. The conditions are supposed to have no side
+// effects, so the contract is rejected if its conditions call any extended function out of vm.ReadOnlyFuncs.
+// The conditions work with a shallow copy of the extend map, so the variables assigned by them are
+// dropped. The contract without conditions passes
+func EvalConditions(rt *RunTime, name string, params ...interface{}) (bool, error) {
 	contract, ok := rt.vm.Objects[name]
-	if !ok {
+	if !ok || contract.Type != ObjContract {
 		log.WithFields(log.Fields{"contract_name": name, "type": consts.ContractError}).Error("unknown contract")
-		return ``, fmt.Errorf(eUnknownContract, name)
+		return false, newError(ErrUnknownContract, eUnknownContract, name)
+	}
+	logger := log.WithFields(log.Fields{"contract_name": name, "type": consts.ContractError})
+	names := make([]string, 0, len(params))
+	if info := contract.Value.(*Block).Info.(*ContractInfo); info.Tx != nil {
+		for _, tx := range *info.Tx {
+			if len(names) < len(params) {
+				names = append(names, tx.Name)
+			}
+		}
+	}
+	if len(names) < len(params) {
+		logger.WithFields(log.Fields{"contract_params_len": len(names), "params_len": len(params)}).Error("too many contract parameters")
+		return false, ErrContractPars
+	}
+	if len(params) == 0 {
+		params = []interface{}{``}
+	}
+
+	extend := make(map[string]interface{})
+	if rt.extend != nil {
+		for key, val := range *rt.extend {
+			extend[key] = val
+		}
+	}
+	cblock, pars, values, err := contractParams(rt.vm, &extend, name, strings.Join(names, `,`), params)
+	if err != nil {
+		return false, err
+	}
+	conditions, ok := cblock.Objects[`conditions`]
+	if !ok || conditions.Type != ObjFunc {
+		return true, nil
+	}
+	if err = walkExtFuncs(conditions.Value.(*Block), make(map[*Block]bool), func(fname string) error {
+		if _, ok := rt.vm.ReadOnlyFuncs[fname]; !ok {
+			logger.WithFields(log.Fields{"func_name": fname}).Error("conditions call not read-only function")
+			return fmt.Errorf(eConditionsCall, name, fname)
+		}
+		return nil
+	}); err != nil {
+		return false, err
+	}
+	if _, ok := extend[`loop_`+name]; ok {
+		logger.Error("there is loop in contract")
+		return false, newError(ErrContractLoop, eContractLoop, name)
+	}
+	extend[`loop_`+name] = true
+	for i, ipar := range pars {
+		extend[ipar] = values[i]
+	}
+
+	rt.cost -= CostContract
+	rtemp := rt.vm.RunInit(rt.cost)
+	_, err = rtemp.Run(conditions.Value.(*Block), nil, &extend)
+	rt.cost = rtemp.cost
+	rtemp.release()
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err}).Debug("conditions have failed")
+		return false, nil
+	}
+	return true, nil
+}
+
+// ExecContractResults runs the contract like ExecContract but returns the named results of the contract.
+// The contract declares named results by assigning them to the $results map in any of its methods
+// or by assigning a map to $result, e.g.
+//
+//	action {
+//		var res map
+//		res["id"] = $id
+//		$result = res
+//		$results["fee"] = 10
+//	}
+//
+// The results are gathered after the action method has finished, the values of $results override
+// the values of $result with the same keys. Any other value of $result is returned with the "result" key
+// and the empty map is returned if nothing is assigned. The names result and results are reserved
+// in the extend map like parent, sc and rt_state, so they can't be used as the contract parameters
+func ExecContractResults(rt *RunTime, name, txs string, params ...interface{}) (map[string]interface{}, error) {
+	results, err := execContractWithResults(rt, name, txs, params...)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]interface{})
+	val, _ := rt.Extend().Get(`result`)
+	switch result := val.(type) {
+	case nil:
+	case map[string]interface{}:
+		for key, val := range result {
+			ret[key] = val
+		}
+	default:
+		ret[`result`] = result
+	}
+	for key, val := range results {
+		ret[key] = val
+	}
+	return ret, nil
+}
+
+// execContractWithResults runs the contract with the new map in $results and returns this map.
+// The previous value of $results is restored, so the results of the nested contracts don't mix
+func execContractWithResults(rt *RunTime, name, txs string, params ...interface{}) (ret map[string]interface{}, err error) {
+	// the contract methods recover in Run, but the panics of the checks of the contract are caught here
+	defer func() {
+		if r := recover(); r != nil {
+			ret, err = nil, recoverPanic(rt.vm.logger, r)
+		}
+	}()
+	ext := rt.Extend()
+	results := make(map[string]interface{})
+	prev, ok := ext.Get(`results`)
+	ext.Set(`results`, results)
+	defer func() {
+		if ok {
+			ext.Set(`results`, prev)
+		} else {
+			ext.Delete(`results`)
+		}
+	}()
+	if err = execContract(rt, name, txs, params...); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// contractParams checks the parameters of the name contract and returns the block of the contract
+// with the names and the converted values of the parameters. The missing optional parameters
+// are assigned the zero values in extend
+func contractParams(vm *VM, extend *map[string]interface{}, name, txs string,
+	params []interface{}) (*Block, []string, []interface{}, error) {
+	contract := vm.getObjByName(name)
+	if contract == nil || contract.Type != ObjContract {
+		log.WithFields(log.Fields{"contract_name": name, "type": consts.ContractError}).Error("unknown contract")
+		return nil, nil, nil, newError(ErrUnknownContract, eUnknownContract, name)
 	}
 	logger := log.WithFields(log.Fields{"contract_name": name, "type": consts.ContractError})
 	cblock := contract.Value.(*Block)
+	if vmType := cblock.Info.(*ContractInfo).VMType; vmType != vm.VMType {
+		logger.WithFields(log.Fields{"contract_vm_type": vmType, "vm_type": vm.VMType}).Error("wrong vm type of contract")
+		return nil, nil, nil, newError(ErrWrongVMType, eWrongVMType, name, vmType, vm.VMType)
+	}
 	parnames := make(map[string]bool)
 	pars := strings.Split(txs, `,`)
 	if len(pars) != len(params) {
 		logger.WithFields(log.Fields{"contract_params_len": len(pars), "contract_params_len_needed": len(params), "type": consts.ContractError}).Error("wrong contract parameters pars")
-		return ``, errContractPars
+		return nil, nil, nil, ErrContractPars
 	}
 	for _, ipar := range pars {
 		parnames[ipar] = true
 	}
-	var isSignature bool
+	fields := make(map[string]reflect.Type)
 	if cblock.Info.(*ContractInfo).Tx != nil {
 		for _, tx := range *cblock.Info.(*ContractInfo).Tx {
+			fields[tx.Name] = tx.Type
 			if !parnames[tx.Name] {
 				if !strings.Contains(tx.Tags, `optional`) {
 					logger.WithFields(log.Fields{"transaction_name": tx.Name, "type": consts.ContractError}).Error("transaction not defined")
-					return ``, fmt.Errorf(eUndefinedParam, tx.Name)
+					return nil, nil, nil, newError(ErrUndefinedParam, eUndefinedParam, tx.Name)
 				}
-				(*rt.extend)[tx.Name] = reflect.New(tx.Type).Elem().Interface()
+				(*extend)[tx.Name] = reflect.New(tx.Type).Elem().Interface()
 			}
-			if tx.Name == `Signature` {
-				isSignature = true
+		}
+	}
+	values := make([]interface{}, len(pars))
+	for i, ipar := range pars {
+		values[i] = params[i]
+		if ftype, ok := fields[ipar]; ok && !vm.LegacyParams {
+			if values[i], ok = convertParam(params[i], ftype); !ok {
+				logger.WithFields(log.Fields{"type": consts.ConversionError, "param": ipar, "param_type": fmt.Sprintf("%T", params[i]),
+					"expected_type": ftype}).Error("wrong type of contract parameter")
+				return nil, nil, nil, newError(ErrParamType, eParamType, ipar, ftype)
 			}
 		}
 	}
-	if _, ok := (*rt.extend)[`loop_`+name]; ok {
+	return cblock, pars, values, nil
+}
+
+func execContract(rt *RunTime, name, txs string, params ...interface{}) (err error) {
+	cblock, pars, values, err := contractParams(rt.vm, rt.extend, name, txs, params)
+	if err != nil {
+		return err
+	}
+	logger := log.WithFields(log.Fields{"contract_name": name, "type": consts.ContractError})
+	isSignature := hasSignature(cblock.Info.(*ContractInfo))
+	ext := rt.Extend()
+	if owner := cblock.Info.(*ContractInfo).Owner; rt.vm.CheckActive && (owner == nil || !owner.Active) {
+		logger.WithFields(log.Fields{"type": consts.ContractError, "contract_name": name}).Error("contract is inactive")
+		return ErrContractInactive
+	}
+	if _, ok := ext.Get(`loop_` + name); ok {
 		logger.WithFields(log.Fields{"type": consts.ContractError, "contract_name": name}).Error("there is loop in contract")
-		return ``, fmt.Errorf(eContractLoop, name)
+		return newError(ErrContractLoop, eContractLoop, name)
 	}
-	(*rt.extend)[`loop_`+name] = true
-	defer delete(*rt.extend, `loop_`+name)
+	ext.Set(`loop_`+name, true)
+	defer ext.Delete(`loop_` + name)
 	for i, ipar := range pars {
-		(*rt.extend)[ipar] = params[i]
+		ext.Set(ipar, values[i])
 	}
-	prevparent := (*rt.extend)[`parent`]
+	prevparent, _ := ext.Get(`parent`)
 	parent := ``
 	for i := len(rt.blocks) - 1; i >= 0; i-- {
 		if rt.blocks[i].Block.Type == ObjFunc && rt.blocks[i].Block.Parent != nil &&
@@ -262,40 +556,141 @@ func ExecContract(rt *RunTime, name, txs string, params ...interface{}) (string,
 			break
 		}
 	}
+	var trace *ContractTrace
+	if rt.vm.Tracer != nil {
+		trace = rt.traceEnter(name, cblock, pars, values)
+		defer func(cost int64) {
+			rt.traceExit(trace, cost, err)
+		}(rt.cost)
+	}
 	rt.cost -= CostContract
 	var stackCont func(interface{}, string)
-	if stack, ok := (*rt.extend)[`stack_cont`]; ok && (*rt.extend)[`sc`] != nil {
+	sc, _ := ext.Get(`sc`)
+	if stack, ok := ext.Get(`stack_cont`); ok && sc != nil {
 		stackCont = stack.(func(interface{}, string))
-		stackCont((*rt.extend)[`sc`], name)
+		stackCont(sc, name)
 	}
-	if (*rt.extend)[`sc`] != nil && isSignature {
+	if sc != nil && isSignature {
 		obj := rt.vm.Objects[`check_signature`]
 		finfo := obj.Value.(ExtFuncInfo)
 		if err := finfo.Func.(func(*map[string]interface{}, string) error)(rt.extend, name); err != nil {
 			logger.WithFields(log.Fields{"error": err, "func_name": finfo.Name, "type": consts.ContractError}).Error("executing exended function")
-			return ``, err
+			return err
+		}
+	}
+	// $stop of the caller is restored, so the called contract doesn't stop the methods of the caller
+	prevStop, hasStop := ext.Get(`stop`)
+	ext.Delete(`stop`)
+	defer func() {
+		if hasStop {
+			ext.Set(`stop`, prevStop)
+		} else {
+			ext.Delete(`stop`)
 		}
+	}()
+	if rt.extendUsage == nil && (rt.vm.MaxExtendSize > 0 || rt.vm.MaxExtendKeys > 0) {
+		rt.extendUsage = &extendUsage{vars: make(map[string]int64)}
 	}
-	for _, method := range []string{`init`, `conditions`, `action`} {
+	for _, method := range rt.vm.methods {
 		if block, ok := (*cblock).Objects[method]; ok && block.Type == ObjFunc {
 			rtemp := rt.vm.RunInit(rt.cost)
-			(*rt.extend)[`parent`] = parent
-			_, err := rtemp.Run(block.Value.(*Block), nil, rt.extend)
+			rtemp.trace, rtemp.extendUsage = trace, rt.extendUsage
+			extend := rt.extend
+			if rt.vm.IsolateMethods {
+				copied := make(map[string]interface{}, len(*rt.extend))
+				for key, val := range *rt.extend {
+					copied[key] = val
+				}
+				extend = &copied
+			}
+			var restore func()
+			if rt.vm.RollbackExtend && !rt.vm.IsolateMethods {
+				restore = rt.SnapshotExtend()
+			}
+			MapExtend(*extend).Set(`parent`, parent)
+			_, err := rtemp.Run(block.Value.(*Block), nil, extend)
 			rt.cost = rtemp.cost
+			rtemp.release()
 			if err != nil {
+				if restore != nil {
+					restore()
+				}
 				logger.WithFields(log.Fields{"error": err, "method_name": method, "type": consts.ContractError}).Error("executing contract method")
-				return ``, err
+				return err
+			}
+			if rt.vm.IsolateMethods {
+				for _, key := range []string{`result`, `stop`} {
+					if val, ok := MapExtend(*extend).Get(key); ok {
+						ext.Set(key, val)
+					}
+				}
+			}
+			if stop, _ := MapExtend(*extend).Get(`stop`); valueToBool(stop) {
+				break
 			}
 		}
 	}
 	if stackCont != nil {
-		stackCont((*rt.extend)[`sc`], ``)
+		sc, _ = ext.Get(`sc`)
+		stackCont(sc, ``)
 	}
-	(*rt.extend)[`parent`] = prevparent
-	if (*rt.extend)[`result`] != nil {
-		result = fmt.Sprint((*rt.extend)[`result`])
+	ext.Set(`parent`, prevparent)
+	return nil
+}
+
+// convertParam checks that the value of the contract parameter has the type of the data field.
+// The numeric values and the strings of numbers are converted to int, float and money fields,
+// e.g. the numbers of the decoded JSON are float64 and they are converted to int if they are integral
+func convertParam(val interface{}, ftype reflect.Type) (interface{}, bool) {
+	if val == nil || reflect.TypeOf(val) == ftype {
+		return val, true
 	}
-	return result, nil
+	switch ftype {
+	case reflect.TypeOf(int64(0)):
+		switch v := val.(type) {
+		case int:
+			return int64(v), true
+		case int32:
+			return int64(v), true
+		case float64:
+			if v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 {
+				return int64(v), true
+			}
+		case string:
+			if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return i, true
+			}
+		}
+	case reflect.TypeOf(float64(0)):
+		switch v := val.(type) {
+		case int:
+			return float64(v), true
+		case int64:
+			return float64(v), true
+		case string:
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				return f, true
+			}
+		}
+	case reflect.TypeOf(decimal.New(0, 0)):
+		switch v := val.(type) {
+		case int:
+			return decimal.New(int64(v), 0), true
+		case int64:
+			return decimal.New(v, 0), true
+		case float64:
+			return decimal.NewFromFloat(v), true
+		case string:
+			if d, err := decimal.NewFromString(v); err == nil {
+				return d, true
+			}
+		}
+	default:
+		if reflect.TypeOf(val).AssignableTo(ftype) {
+			return val, true
+		}
+	}
+	return nil, false
 }
 
 // NewVM creates a new virtual machine
@@ -304,8 +699,9 @@ func NewVM() *VM {
 	vm.Objects = make(map[string]*ObjInfo)
 	// Reserved 256 indexes for system purposes
 	vm.Children = make(Blocks, 256, 1024)
+	vm.methods = DefaultContractMethods
 	vm.Extend(&ExtendData{map[string]interface{}{"ExecContract": ExecContract, "CallContract": ExContract,
-		"Settings": GetSettings},
+		"ExecContractResults": ExecContractResults, "Settings": GetSettings, "AllSettings": getSettingsMap},
 		map[string]string{
 			`*script.RunTime`: `rt`,
 		}})
@@ -313,8 +709,81 @@ func NewVM() *VM {
 	return &vm
 }
 
-// Extend sets the extended variables and functions
-func (vm *VM) Extend(ext *ExtendData) {
+// SetContractMethods replaces the sequence of the contract methods which are called by ExecContract.
+// The methods are called in the specified order, the contract can omit any of them. It should be called
+// before the compilation of the contracts because the compiler checks that the methods have no parameters
+func (vm *VM) SetContractMethods(methods []string) error {
+	used := make(map[string]bool)
+	for _, method := range methods {
+		if !isIdent(method) || used[method] {
+			log.WithFields(log.Fields{"type": consts.InvalidObject, "method_name": method}).Error("wrong contract method")
+			return fmt.Errorf(eWrongMethod, method)
+		}
+		if keyID, ok := keywords[method]; ok && keyID != keyAction && keyID != keyCond {
+			log.WithFields(log.Fields{"type": consts.InvalidObject, "method_name": method}).Error("contract method is keyword")
+			return fmt.Errorf(eWrongMethod, method)
+		}
+		used[method] = true
+	}
+	vm.methods = append([]string{}, methods...)
+	return nil
+}
+
+// ContractMethods returns the sequence of the contract methods which are called by ExecContract
+func (vm *VM) ContractMethods() []string {
+	return append([]string{}, vm.methods...)
+}
+
+// checkTxParams returns an error if the contract has more data fields than it is allowed
+func (vm *VM) checkTxParams(info *ContractInfo) error {
+	limit := vm.MaxTxParams
+	if limit <= 0 {
+		limit = consts.MaxTxParams
+	}
+	if info.Tx != nil && len(*info.Tx) > limit {
+		log.WithFields(log.Fields{"type": consts.ContractError, "contract_name": info.Name, "count": len(*info.Tx),
+			"limit": limit}).Error("too many contract parameters")
+		return fmt.Errorf(eTooManyParams, info.Name, len(*info.Tx), limit)
+	}
+	return nil
+}
+
+// isIdent returns true if the name can be used as the identifier of the function
+func isIdent(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i, ch := range name {
+		if ch != '_' && !unicode.IsLetter(ch) && (i == 0 || !unicode.IsDigit(ch)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Extend sets the extended variables and functions. The functions with the names of the registered
+// objects replace them, but if StrictExtend is set Extend registers nothing and returns the error
+func (vm *VM) Extend(ext *ExtendData) error {
+	if vm.StrictExtend {
+		names := make([]string, 0)
+		for key, item := range ext.Objects {
+			if _, ok := vm.Objects[key]; ok && reflect.ValueOf(item).Kind() == reflect.Func {
+				names = append(names, key)
+			}
+		}
+		if len(names) > 0 {
+			sort.Strings(names)
+			vm.logger.WithFields(log.Fields{"type": consts.DuplicateObject, "names": names}).Error("extended functions are already registered")
+			return newError(ErrExtendRegistered, eExtendRegistered, strings.Join(names, `, `))
+		}
+	}
+	vm.ReplaceExtend(ext)
+	return nil
+}
+
+// ReplaceExtend sets the extended variables and functions like Extend, but it always replaces
+// the registered objects with the same names, so it is used for the intentional override
+func (vm *VM) ReplaceExtend(ext *ExtendData) {
 	for key, item := range ext.Objects {
 		fobj := reflect.ValueOf(item).Type()
 		switch fobj.Kind() {
@@ -343,6 +812,9 @@ func (vm *VM) getObjByName(name string) (ret *ObjInfo) {
 	for i, name := range names {
 		ret, ok = block.Objects[name]
 		if !ok {
+			if i == 0 && len(names) == 1 {
+				return vm.loadContract(name)
+			}
 			return nil
 		}
 		if i == len(names)-1 {
@@ -382,8 +854,140 @@ func (vm *VM) getInParams(ret *ObjInfo) int {
 	return len(ret.Value.(*Block).Info.(*FuncInfo).Params)
 }
 
-// Call executes the name object with the specified params and extended variables and functions
+// ContractOwner returns a copy of the owner information of the name contract. The Active field
+// of the result shows whether the contract is active, so it can be checked before the execution
+func (vm *VM) ContractOwner(name string) (*OwnerInfo, error) {
+	obj, ok := vm.Objects[name]
+	if !ok || obj.Type != ObjContract {
+		vm.logger.WithFields(log.Fields{"type": consts.ContractError, "contract_name": name}).Error("unknown contract")
+		return nil, newError(ErrUnknownContract, eUnknownContract, name)
+	}
+	owner := OwnerInfo{}
+	if info := obj.Value.(*Block).Info.(*ContractInfo); info.Owner != nil {
+		owner = *info.Owner
+	}
+	return &owner, nil
+}
+
+// RequiresSignature returns true if the name contract has the Signature data field, so check_signature
+// is called when the contract is executed. It doesn't execute anything and can be used to decide whether
+// the user should sign the transaction before it is sent
+func (vm *VM) RequiresSignature(name string) (bool, error) {
+	obj, ok := vm.Objects[name]
+	if !ok || obj.Type != ObjContract {
+		vm.logger.WithFields(log.Fields{"type": consts.ContractError, "contract_name": name}).Error("unknown contract")
+		return false, newError(ErrUnknownContract, eUnknownContract, name)
+	}
+	return hasSignature(obj.Value.(*Block).Info.(*ContractInfo)), nil
+}
+
+// ContractParams returns the copies of the data fields of the name contract in the order of their
+// declaration, so the client can build the transaction of the contract without its execution. The name
+// must have the state prefix like @1name. The result is empty if the contract has no parameters
+func (vm *VM) ContractParams(name string) ([]FieldInfo, error) {
+	obj, ok := vm.Objects[name]
+	if !ok || obj.Type != ObjContract {
+		vm.logger.WithFields(log.Fields{"type": consts.ContractError, "contract_name": name}).Error("unknown contract")
+		return nil, newError(ErrUnknownContract, eUnknownContract, name)
+	}
+	fields := make([]FieldInfo, 0)
+	if info := obj.Value.(*Block).Info.(*ContractInfo); info.Tx != nil {
+		for _, tx := range *info.Tx {
+			fields = append(fields, *tx)
+		}
+	}
+	return fields, nil
+}
+
+// hasSignature returns true if the contract has the Signature data field
+func hasSignature(info *ContractInfo) bool {
+	if info.Tx == nil {
+		return false
+	}
+	for _, tx := range *info.Tx {
+		if tx.Name == `Signature` {
+			return true
+		}
+	}
+	return false
+}
+
+// ExtFunctions returns the signatures of all extended functions of VM sorted by name
+func (vm *VM) ExtFunctions() []ExtFuncSummary {
+	ret := make([]ExtFuncSummary, 0)
+	for _, obj := range vm.Objects {
+		if obj.Type != ObjExtFunc {
+			continue
+		}
+		finfo := obj.Value.(ExtFuncInfo)
+		summary := ExtFuncSummary{Name: finfo.Name, Params: make([]string, 0, len(finfo.Params)),
+			Results: make([]string, 0, len(finfo.Results)), Variadic: finfo.Variadic}
+		for i, par := range finfo.Params {
+			if len(finfo.Auto[i]) == 0 {
+				summary.Params = append(summary.Params, par.String())
+			}
+		}
+		for _, res := range finfo.Results {
+			summary.Results = append(summary.Results, res.String())
+		}
+		ret = append(ret, summary)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// CallByID executes the contract with the specified identifier. The identifier of the contract is
+// its index in vm.Children, so it is found without the lookup by name. The params are the values
+// of all data fields of the contract in the order of their declaration
+func (vm *VM) CallByID(id uint32, params []interface{}, extend *map[string]interface{}) ([]interface{}, error) {
+	if int(id) >= len(vm.Children) || vm.Children[id] == nil || vm.Children[id].Type != ObjContract {
+		vm.logger.WithFields(log.Fields{"type": consts.ContractError, "contract_id": id}).Error("unknown contract")
+		return nil, newError(ErrUnknownContract, eUnknownContractID, id)
+	}
+	info := vm.Children[id].Info.(*ContractInfo)
+	names := make([]string, 0)
+	if info.Tx != nil {
+		for _, tx := range *info.Tx {
+			names = append(names, tx.Name)
+		}
+	}
+	if len(params) != len(names) {
+		vm.logger.WithFields(log.Fields{"type": consts.ContractError, "contract_name": info.Name,
+			"params_len": len(params), "params_len_needed": len(names)}).Error("wrong count of contract parameters")
+		return nil, ErrWrongCountPars
+	}
+	if len(params) == 0 {
+		params = []interface{}{``}
+	}
+	if extend == nil {
+		extend = &map[string]interface{}{}
+	}
+	rt := vm.RunInit(CostDefault)
+	rt.extend = extend
+	result, err := ExecContract(rt, info.Name, strings.Join(names, `,`), params...)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{result}, nil
+}
+
+// Call executes the name object with the specified params and extended variables and functions.
+// If the last result of the extended function is error, it isn't returned in ret but is returned as err
 func (vm *VM) Call(name string, params []interface{}, extend *map[string]interface{}) (ret []interface{}, err error) {
+	args := make([]reflect.Value, len(params))
+	for i, param := range params {
+		args[i] = reflect.ValueOf(param)
+	}
+	result, err := vm.CallValues(name, args, extend)
+	for _, iret := range result {
+		ret = append(ret, valueInterface(iret))
+	}
+	return ret, err
+}
+
+// CallValues executes the name object like Call but takes and returns the reflected values, so
+// the callers which already have them don't convert them to interface{} and back
+func (vm *VM) CallValues(name string, args []reflect.Value, extend *map[string]interface{}) (ret []reflect.Value, err error) {
 	var obj *ObjInfo
 	if state, ok := (*extend)[`rt_state`]; ok {
 		obj = vm.getObjByNameExt(name, state.(uint32))
@@ -392,47 +996,71 @@ func (vm *VM) Call(name string, params []interface{}, extend *map[string]interfa
 	}
 	if obj == nil {
 		vm.logger.WithFields(log.Fields{"type": consts.VMError, "vm_func_name": name}).Error("unknown function")
-		return nil, fmt.Errorf(`unknown function %s`, name)
+		return nil, newError(ErrUnknownFunc, eUnknownFunc, name)
 	}
 	switch obj.Type {
 	case ObjFunc:
+		params := make([]interface{}, len(args))
+		for i, arg := range args {
+			params[i] = valueInterface(arg)
+		}
 		rt := vm.RunInit(CostDefault)
-		ret, err = rt.Run(obj.Value.(*Block), params, extend)
+		var result []interface{}
+		result, err = rt.Run(obj.Value.(*Block), params, extend)
+		for _, iret := range result {
+			ret = append(ret, reflect.ValueOf(iret))
+		}
 	case ObjExtFunc:
 		finfo := obj.Value.(ExtFuncInfo)
 		foo := reflect.ValueOf(finfo.Func)
-		var result []reflect.Value
-		pars := make([]reflect.Value, len(finfo.Params))
 		if finfo.Variadic {
-			for i := 0; i < len(pars)-1; i++ {
-				pars[i] = reflect.ValueOf(params[i])
+			last := len(finfo.Params) - 1
+			variadic := make([]interface{}, len(args)-last)
+			for i, arg := range args[last:] {
+				variadic[i] = valueInterface(arg)
 			}
-			pars[len(pars)-1] = reflect.ValueOf(params[len(pars)-1:])
-			result = foo.CallSlice(pars)
+			pars := make([]reflect.Value, len(finfo.Params))
+			copy(pars, args[:last])
+			pars[last] = reflect.ValueOf(variadic)
+			ret = foo.CallSlice(pars)
 		} else {
-			for i := 0; i < len(pars); i++ {
-				pars[i] = reflect.ValueOf(params[i])
-			}
-			result = foo.Call(pars)
+			ret = foo.Call(args[:len(finfo.Params)])
 		}
-		for _, iret := range result {
-			ret = append(ret, iret.Interface())
+		// the trailing error is returned as err like the VM does while the contracts are executed
+		if last := len(finfo.Results) - 1; last >= 0 && finfo.Results[last].String() == `error` {
+			if iret := ret[last].Interface(); iret != nil {
+				err = iret.(error)
+			}
+			ret = ret[:last]
 		}
 	default:
 		vm.logger.WithFields(log.Fields{"type": consts.VMError, "vm_func_name": name}).Error("unknown function")
-		return nil, fmt.Errorf(`unknown function %s`, name)
+		return nil, newError(ErrUnknownFunc, eUnknownFunc, name)
 	}
 	return ret, err
 }
 
+// valueInterface returns the value of v or nil if v is the zero Value, e.g. it is reflect.ValueOf(nil)
+func valueInterface(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	return v.Interface()
+}
+
 // ExContract executes the name contract in the state with specified parameters
 func ExContract(rt *RunTime, state uint32, name string, params map[string]interface{}) (string, error) {
+	return ExecContractMap(rt, StateName(state, name), params)
+}
 
-	name = StateName(state, name)
-	contract, ok := rt.vm.Objects[name]
-	if !ok {
+// ExecContractMap runs the name contract like ExecContract but takes the values of parameters
+// from the map by their names, so the order of parameters doesn't matter. The keys which are not
+// parameters of the contract are ignored
+func ExecContractMap(rt *RunTime, name string, params map[string]interface{}) (string, error) {
+	contract := rt.vm.getObjByName(name)
+	if contract == nil || contract.Type != ObjContract {
 		log.WithFields(log.Fields{"contract_name": name, "type": consts.ContractError}).Error("unknown contract")
-		return ``, fmt.Errorf(eUnknownContract, name)
+		return ``, newError(ErrUnknownContract, eUnknownContract, name)
 	}
 	if params == nil {
 		params = make(map[string]interface{})
@@ -442,11 +1070,20 @@ func ExContract(rt *RunTime, state uint32, name string, params map[string]interf
 	vals := make([]interface{}, 0)
 	cblock := contract.Value.(*Block)
 	if cblock.Info.(*ContractInfo).Tx != nil {
+		if err := rt.vm.checkTxParams(cblock.Info.(*ContractInfo)); err != nil {
+			return ``, err
+		}
 		for _, tx := range *cblock.Info.(*ContractInfo).Tx {
 			val, ok := params[tx.Name]
 			if !ok && !strings.Contains(tx.Tags, `optional`) {
 				logger.WithFields(log.Fields{"transaction_name": tx.Name, "type": consts.ContractError}).Error("transaction not defined")
-				return ``, fmt.Errorf(eUndefinedParam, tx.Name)
+				return ``, newError(ErrUndefinedParam, eUndefinedParam, tx.Name)
+			}
+			// the type is checked here to get the clear error instead of the failure inside the contract
+			if _, valid := convertParam(val, tx.Type); ok && !valid && !rt.vm.LegacyParams {
+				logger.WithFields(log.Fields{"transaction_name": tx.Name, "type": consts.ConversionError, "param_type": fmt.Sprintf("%T", val),
+					"expected_type": tx.Type}).Error("wrong type of contract parameter")
+				return ``, newError(ErrParamType, eParamActualType, tx.Name, tx.Type, val)
 			}
 			names = append(names, tx.Name)
 			vals = append(vals, val)
@@ -463,7 +1100,7 @@ func GetSettings(rt *RunTime, cntname, name string) (interface{}, error) {
 	contract, ok := rt.vm.Objects[cntname]
 	if !ok {
 		log.WithFields(log.Fields{"contract_name": name, "type": consts.ContractError}).Error("unknown contract")
-		return nil, fmt.Errorf(`unknown contract %s`, cntname)
+		return nil, newError(ErrUnknownContract, eUnknownContract, cntname)
 	}
 	cblock := contract.Value.(*Block)
 	if cblock.Info.(*ContractInfo).Settings != nil {
@@ -473,3 +1110,39 @@ func GetSettings(rt *RunTime, cntname, name string) (interface{}, error) {
 	}
 	return ``, nil
 }
+
+// SettingKV is the parameter of the contract settings
+type SettingKV struct {
+	Key   string
+	Value interface{}
+}
+
+// GetAllSettings returns all parameters of the contract settings sorted by the key,
+// so the result is stable and can be hashed
+func GetAllSettings(rt *RunTime, cntname string) ([]SettingKV, error) {
+	contract, ok := rt.vm.Objects[cntname]
+	if !ok || contract.Type != ObjContract {
+		log.WithFields(log.Fields{"contract_name": cntname, "type": consts.ContractError}).Error("unknown contract")
+		return nil, newError(ErrUnknownContract, eUnknownContract, cntname)
+	}
+	settings := contract.Value.(*Block).Info.(*ContractInfo).Settings
+	ret := make([]SettingKV, 0, len(settings))
+	for key, val := range settings {
+		ret = append(ret, SettingKV{Key: key, Value: val})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	return ret, nil
+}
+
+// getSettingsMap returns a copy of all parameters of the contract settings as a map for the contracts
+func getSettingsMap(rt *RunTime, cntname string) (map[string]interface{}, error) {
+	settings, err := GetAllSettings(rt, cntname)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]interface{}, len(settings))
+	for _, item := range settings {
+		ret[item.Key] = item.Value
+	}
+	return ret, nil
+}
@@ -24,6 +24,7 @@ package smart
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
@@ -83,6 +84,7 @@ type SmartContract struct {
 	TxHash        []byte
 	PublicKeys    [][]byte
 	DbTransaction *model.DbTransaction
+	Context       context.Context // the contract is stopped when it is done, nil means it isn't stopped
 }
 
 var (
@@ -92,6 +94,41 @@ var (
 		"DBUpdate":    {},
 		"DBUpdateExt": {},
 	}
+	// the functions without side effects which can be called from read-only contracts
+	readOnlyFuncs = map[string]struct{}{
+		"AddressToId":    {},
+		"AllSettings":    {},
+		"Contains":       {},
+		"DBSelect":       {},
+		"EcosysParam":    {},
+		"Float":          {},
+		"GetMapKeys":     {},
+		"HasPrefix":      {},
+		"HexToBytes":     {},
+		"HMac":           {},
+		"IdToAddress":    {},
+		"Int":            {},
+		"IsObject":       {},
+		"Join":           {},
+		"JSONToMap":      {},
+		"LangRes":        {},
+		"Len":            {},
+		"Money":          {},
+		"PubToID":        {},
+		"Replace":        {},
+		"Settings":       {},
+		"Size":           {},
+		"SortedKeys":     {},
+		"Split":          {},
+		"Sprintf":        {},
+		"Str":            {},
+		"Substr":         {},
+		"SysFuel":        {},
+		"SysParamInt":    {},
+		"SysParamString": {},
+		"ToLower":        {},
+		"TrimSpace":      {},
+	}
 	extendCost = map[string]int64{
 		"AddressToId":        10,
 		"ColumnCondition":    50,
@@ -202,6 +239,8 @@ func EmbedFuncs(vm *script.VM, vt script.VMType) {
 		"RowConditions":      RowConditions,
 	}
 
+	vm.VMType = vt
+	vm.ReadOnlyFuncs = readOnlyFuncs
 	switch vt {
 	case script.VMTypeVDE:
 		f["HTTPRequest"] = HTTPRequest
@@ -131,6 +131,7 @@ func GetVM(vde bool, ecosystemID int64) *script.VM {
 }
 
 func vmExternOff(vm *script.VM) {
+	// the calls of the unknown contracts are logged by FlushExtern, they fail only when they are executed
 	vm.FlushExtern()
 }
 
@@ -217,7 +218,7 @@ func vmGetUsedContracts(vm *script.VM, name string, state uint32, full bool) []s
 
 func VMGetContractByID(vm *script.VM, id int32) *Contract {
 	idcont := id // - CNTOFF
-	if len(vm.Children) <= int(idcont) || vm.Children[idcont].Type != script.ObjContract {
+	if len(vm.Children) <= int(idcont) || vm.Children[idcont] == nil || vm.Children[idcont].Type != script.ObjContract {
 		return nil
 	}
 	return &Contract{Name: vm.Children[idcont].Info.(*script.ContractInfo).Name,
@@ -414,6 +415,9 @@ func (sc *SmartContract) getExtend() *map[string]interface{} {
 		`block`:         block, `key_id`: keyID, `block_key_id`: blockKeyID,
 		`parent`: ``, `txcost`: sc.GetContractLimit(), `txhash`: sc.TxHash, `result`: ``,
 		`sc`: sc, `contract`: sc.TxContract, `block_time`: blockTime}
+	if sc.Context != nil {
+		extend[`rt_context`] = sc.Context
+	}
 	for key, val := range sc.TxData {
 		extend[key] = val
 	}
@@ -23,7 +23,10 @@
 package smart
 
 import (
+	"context"
+	"math"
 	"testing"
+	"time"
 
 	"github.com/GenesisKernel/go-genesis/packages/script"
 )
@@ -71,3 +74,25 @@ func TestNewContract(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestRunStoppedTransaction(t *testing.T) {
+	owner := script.OwnerInfo{StateID: 1, Active: true, TableID: 1}
+	if err := Compile(`contract Endless {
+			action {
+				var i int
+				while true {
+					i = i + 1
+				}
+			}
+		}`, &owner); err != nil {
+		t.Fatal(err)
+	}
+	// the cost of the transaction doesn't limit it, only the context of the block stops it
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	sc := &SmartContract{VDE: true, TxCost: math.MaxInt64, Context: ctx}
+	_, err := VMRun(smartVM, GetContract(`Endless`, 1).GetFunc(`action`), nil, sc.getExtend())
+	if err != script.ErrStopped {
+		t.Errorf("wrong error %v", err)
+	}
+}
@@ -30,8 +30,10 @@ import (
 )
 
 const (
-	Count = ".count"
-	Time  = ".time"
+	Count        = ".count"
+	Time         = ".time"
+	BlockGap     = ".block_gap"
+	BlockTimeout = ".block_timeout"
 )
 
 var Client statsd.Statter
@@ -41,6 +41,16 @@ type TransactionType struct {
 	Type uint16
 }
 
+// HandshakeRequest contains the version of the peer protocol of the client
+type HandshakeRequest struct {
+	Version uint16
+}
+
+// HandshakeResponse contains the version of the peer protocol of the server
+type HandshakeResponse struct {
+	Version uint16
+}
+
 // MaxBlockRequest is max block request
 type MaxBlockRequest struct{}
 
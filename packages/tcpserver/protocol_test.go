@@ -29,7 +29,9 @@ import (
 
 	"reflect"
 
+	"github.com/GenesisKernel/go-genesis/packages/consts"
 	"github.com/GenesisKernel/go-genesis/packages/converter"
+	"github.com/GenesisKernel/go-genesis/packages/utils"
 )
 
 func TestReadRequest(t *testing.T) {
@@ -110,3 +112,19 @@ func TestSendRequest(t *testing.T) {
 		t.Errorf("different values: %+v and %+v", test, test2)
 	}
 }
+
+func TestType11(t *testing.T) {
+	for _, version := range []uint16{consts.PROTOCOL_VERSION, consts.PROTOCOL_VERSION + 1} {
+		response := &bytes.Buffer{}
+		err := Type11(&HandshakeRequest{Version: version}, response)
+		if version == consts.PROTOCOL_VERSION && err != nil {
+			t.Errorf("handshake return err: %s", err)
+		}
+		if version != consts.PROTOCOL_VERSION && err != utils.ErrProtocolVersion {
+			t.Errorf("bad error: %v", err)
+		}
+		if !bytes.Equal(response.Bytes(), converter.DecToBin(consts.PROTOCOL_VERSION, 2)) {
+			t.Errorf("bad response: %x", response.Bytes())
+		}
+	}
+}
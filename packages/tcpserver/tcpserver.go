@@ -56,6 +56,22 @@ func HandleTCPRequest(rw io.ReadWriter) {
 		return
 	}
 
+	// the handshake precedes the request, the clients without the handshake are served too
+	if dType.Type == consts.DATA_TYPE_HANDSHAKE {
+		req := &HandshakeRequest{}
+		if err = ReadRequest(req, rw); err != nil {
+			log.Errorf("read handshake failed: %s", err)
+			return
+		}
+		if err = Type11(req, rw); err != nil {
+			return
+		}
+		if err = ReadRequest(dType, rw); err != nil {
+			log.Errorf("read request type failed: %s", err)
+			return
+		}
+	}
+
 	log.WithFields(log.Fields{"request_type": dType.Type}).Debug("tcpserver got request type")
 	var response interface{}
 
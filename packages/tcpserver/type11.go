@@ -0,0 +1,47 @@
+// MIT License
+//
+// Copyright (c) 2016-2018 GenesisKernel
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package tcpserver
+
+import (
+	"io"
+
+	"github.com/GenesisKernel/go-genesis/packages/consts"
+	"github.com/GenesisKernel/go-genesis/packages/utils"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Type11 sends our version of the peer protocol in reply to the handshake of the client.
+// It returns ErrProtocolVersion if the versions differ, so the connection is closed
+func Type11(req *HandshakeRequest, w io.Writer) error {
+	if err := SendRequest(&HandshakeResponse{Version: consts.PROTOCOL_VERSION}, w); err != nil {
+		log.WithFields(log.Fields{"type": consts.ConnectionError, "error": err}).Error("sending handshake")
+		return err
+	}
+	if req.Version != consts.PROTOCOL_VERSION {
+		log.WithFields(log.Fields{"type": consts.ProtocolError, "version": req.Version,
+			"our_version": consts.PROTOCOL_VERSION}).Warning("incompatible version of peer protocol")
+		return utils.ErrProtocolVersion
+	}
+	return nil
+}
@@ -37,6 +37,8 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/GenesisKernel/go-genesis/packages/conf"
@@ -287,18 +289,161 @@ func TypeInt(txType string) int64 {
 	return 0
 }
 
+// ErrBackoff is returned by TCPConnBackoff without dialing if the connections to the address have failed
+// recently and the delay of the reconnection hasn't expired
+var ErrBackoff = errors.New("reconnection to host is delayed after connection failures")
+
+// HostBackoff is the state of the reconnection backoff of the address
+type HostBackoff struct {
+	Failures int           // count of the successive connection failures
+	Delay    time.Duration // the current delay of the reconnection
+	Until    time.Time     // TCPConnBackoff returns ErrBackoff until this time
+}
+
+type hostBackoffs struct {
+	mutex sync.Mutex
+	hosts map[string]HostBackoff
+}
+
+var connBackoffs = &hostBackoffs{hosts: make(map[string]HostBackoff)}
+
+// backoffDelay returns the delay of the reconnection after the count of failures, it is doubled by each
+// failure from ConnBackoffMin up to ConnBackoffMax. It returns 0 if the backoff is disabled
+func backoffDelay(failures int) time.Duration {
+	min, max := conf.Config.ConnBackoffMin, conf.Config.ConnBackoffMax
+	if min < 0 {
+		return 0
+	}
+	if min == 0 {
+		min = consts.ConnBackoffMin
+	}
+	if max <= 0 {
+		max = consts.ConnBackoffMax
+	}
+	delay := min
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return time.Duration(delay) * time.Millisecond
+}
+
+// delayed returns true if the connection to the address must not be tried now
+func (b *hostBackoffs) delayed(addr string, now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	state, ok := b.hosts[addr]
+	return ok && now.Before(state.Until)
+}
+
+func (b *hostBackoffs) failed(addr string, now time.Time) HostBackoff {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	state := b.hosts[addr]
+	state.Failures++
+	state.Delay = backoffDelay(state.Failures)
+	state.Until = now.Add(state.Delay)
+	b.hosts[addr] = state
+	return state
+}
+
+func (b *hostBackoffs) succeeded(addr string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.hosts, addr)
+}
+
+// GetHostBackoffs returns the backoff states of the addresses which connections have failed
+// since the last successful connection
+func GetHostBackoffs() map[string]HostBackoff {
+	connBackoffs.mutex.Lock()
+	defer connBackoffs.mutex.Unlock()
+
+	ret := make(map[string]HostBackoff, len(connBackoffs.hosts))
+	for addr, state := range connBackoffs.hosts {
+		ret[addr] = state
+	}
+	return ret
+}
+
 // TCPConn connects to the address
 func TCPConn(Addr string) (net.Conn, error) {
-	conn, err := net.DialTimeout("tcp", Addr, 10*time.Second)
+	conn, err := net.DialTimeout("tcp", Addr, tcpTimeout(conf.Config.TCPDialTimeout, consts.DIAL_TIMEOUT))
 	if err != nil {
 		log.WithFields(log.Fields{"type": consts.ConnectionError, "error": err, "address": Addr}).Debug("dialing tcp")
 		return nil, ErrInfo(err)
 	}
-	conn.SetReadDeadline(time.Now().Add(consts.READ_TIMEOUT * time.Second))
-	conn.SetWriteDeadline(time.Now().Add(consts.WRITE_TIMEOUT * time.Second))
+	return &deadlineConn{Conn: conn,
+		readTimeout:  tcpTimeout(conf.Config.TCPReadWriteTimeout, consts.READ_TIMEOUT),
+		writeTimeout: tcpTimeout(conf.Config.TCPReadWriteTimeout, consts.WRITE_TIMEOUT),
+		deadline:     time.Now().Add(tcpTimeout(conf.Config.TCPRequestTimeout, consts.REQUEST_TIMEOUT)),
+	}, nil
+}
+
+// TCPConnBackoff connects to the address like TCPConn, but the successive connection failures delay
+// the next attempts exponentially. ErrBackoff is returned while the delay isn't expired, a successful
+// connection resets the delay. It is used by the synchronization of the blocks which polls the hosts
+func TCPConnBackoff(Addr string) (net.Conn, error) {
+	if connBackoffs.delayed(Addr, time.Now()) {
+		log.WithFields(log.Fields{"type": consts.ConnectionError, "address": Addr}).Debug("reconnection is delayed")
+		return nil, ErrBackoff
+	}
+	conn, err := TCPConn(Addr)
+	if err != nil {
+		state := connBackoffs.failed(Addr, time.Now())
+		log.WithFields(log.Fields{"type": consts.ConnectionError, "address": Addr,
+			"failures": state.Failures, "delay": state.Delay}).Debug("reconnection is delayed")
+		return nil, err
+	}
+	connBackoffs.succeeded(Addr)
 	return conn, nil
 }
 
+// tcpTimeout returns the configured timeout in milliseconds or the default timeout in seconds
+func tcpTimeout(configured int64, def int64) time.Duration {
+	if configured > 0 {
+		return time.Duration(configured) * time.Millisecond
+	}
+	return time.Duration(def) * time.Second
+}
+
+// deadlineConn sets the deadline before every read and write, so a peer which accepts
+// the connection but doesn't respond can block each operation only for the timeout.
+// The deadline of the operation never exceeds the deadline of the whole connection,
+// so a peer which sends the data byte by byte can't hold the request forever
+type deadlineConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	deadline     time.Time
+}
+
+func (c *deadlineConn) opDeadline(timeout time.Duration) time.Time {
+	if deadline := time.Now().Add(timeout); deadline.Before(c.deadline) {
+		return deadline
+	}
+	return c.deadline
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(c.opDeadline(c.readTimeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(c.opDeadline(c.writeTimeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
 // GetCurrentDir returns the current directory
 func GetCurrentDir() string {
 	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
@@ -309,11 +454,48 @@ func GetCurrentDir() string {
 	return dir
 }
 
-// GetBlockBody gets the block data
-func GetBlockBody(host string, blockID int64, dataTypeBlockBody int64) ([]byte, error) {
-	conn, err := TCPConn(host)
+// ErrProtocolVersion is returned by Handshake if the host uses another version of the peer protocol
+var ErrProtocolVersion = errors.New("incompatible version of peer protocol")
+
+// ErrNoHandshake is returned by Handshake if the host closes the connection instead of the response.
+// The hosts of the previous releases don't know the handshake, the request must be sent to them without it
+var ErrNoHandshake = errors.New("host doesn't support handshake")
+
+// Handshake sends our version of the peer protocol to the host and checks the version of the host.
+// Only the explicit response with another version means that the host is incompatible
+func Handshake(conn net.Conn, host string) error {
+	request := append(converter.DecToBin(consts.DATA_TYPE_HANDSHAKE, 2), converter.DecToBin(consts.PROTOCOL_VERSION, 2)...)
+	if _, err := conn.Write(request); err != nil {
+		log.WithFields(log.Fields{"type": consts.ConnectionError, "error": err, "host": host}).Error("writing handshake to host")
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		// the host closes the connection with the unread version, so it can be reset instead of closed
+		if err != io.EOF && err != io.ErrUnexpectedEOF && !errors.Is(err, syscall.ECONNRESET) {
+			log.WithFields(log.Fields{"type": consts.ConnectionError, "error": err, "host": host}).Error("reading handshake from host")
+			return err
+		}
+		log.WithFields(log.Fields{"type": consts.ProtocolError, "host": host}).Debug("host doesn't support handshake")
+		return ErrNoHandshake
+	}
+	if version := converter.BinToDec(buf); version != consts.PROTOCOL_VERSION {
+		log.WithFields(log.Fields{"type": consts.ProtocolError, "host": host, "version": version,
+			"our_version": consts.PROTOCOL_VERSION}).Warning("incompatible version of peer protocol")
+		return ErrProtocolVersion
+	}
+	return nil
+}
+
+// ErrBlockSize is returned by GetBlockBody if the size of the block exceeds the max size
+var ErrBlockSize = errors.New("block size exceeds the max block size")
+
+// GetBlockBody gets the block data, it returns ErrBlockSize if the host is going to send the block bigger than maxSize
+// and ErrBackoff if the reconnection to the host is delayed
+func GetBlockBody(host string, blockID int64, dataTypeBlockBody int64, maxSize int64) ([]byte, error) {
+	conn, err := TCPConnBackoff(host)
 	if err != nil {
-		return nil, ErrInfo(err)
+		return nil, err
 	}
 	defer conn.Close()
 
@@ -338,10 +520,14 @@ func GetBlockBody(host string, blockID int64, dataTypeBlockBody int64) ([]byte,
 		log.WithFields(log.Fields{"type": consts.IOError, "error": err}).Error("reading block data size from connection")
 		return nil, ErrInfo(err)
 	}
-	// if the data size is less than 10mb, we will receive them
+	// the data is received only if its size doesn't exceed maxSize
 	dataSize := converter.BinToDec(buf)
+	if dataSize > maxSize {
+		log.WithFields(log.Fields{"type": consts.ParameterExceeded, "size": dataSize, "max_size": maxSize, "host": host}).Error("block is too big")
+		return nil, ErrBlockSize
+	}
 	var binaryBlock []byte
-	if dataSize < 10485760 && dataSize > 0 {
+	if dataSize > 0 {
 		binaryBlock = make([]byte, dataSize)
 
 		_, err = io.ReadFull(conn, binaryBlock)